@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// decodeAdmissionReview parses an admission/v1 or admission/v1beta1
+// AdmissionReview. v1beta1 reviews are converted to v1 so that the decision
+// logic only deals with one version. The returned apiVersion is the one the
+// response has to be sent in, and is set on errors too once it is known.
+func decodeAdmissionReview(body []byte) (admissionv1.AdmissionReview, string, error) {
+	var typeMeta metav1.TypeMeta
+	if err := json.Unmarshal(body, &typeMeta); err != nil {
+		return admissionv1.AdmissionReview{}, "", err
+	}
+
+	switch typeMeta.APIVersion {
+	case admissionv1beta1.SchemeGroupVersion.String():
+		var review admissionv1beta1.AdmissionReview
+		if err := json.Unmarshal(body, &review); err != nil {
+			return admissionv1.AdmissionReview{}, typeMeta.APIVersion, err
+		}
+		return admissionv1.AdmissionReview{
+			TypeMeta: review.TypeMeta,
+			Request:  convertRequestFromV1beta1(review.Request),
+		}, typeMeta.APIVersion, nil
+	case admissionv1.SchemeGroupVersion.String(), "":
+		var review admissionv1.AdmissionReview
+		if err := json.Unmarshal(body, &review); err != nil {
+			return admissionv1.AdmissionReview{}, admissionv1.SchemeGroupVersion.String(), err
+		}
+		return review, admissionv1.SchemeGroupVersion.String(), nil
+	default:
+		return admissionv1.AdmissionReview{}, "", fmt.Errorf("unsupported AdmissionReview apiVersion %q", typeMeta.APIVersion)
+	}
+}
+
+// requestUID extracts request.uid from a review that could not be decoded, so
+// the denial can still be matched to its request. It is empty if there is none.
+func requestUID(body []byte) types.UID {
+	var review struct {
+		Request struct {
+			UID types.UID `json:"uid"`
+		} `json:"request"`
+	}
+	json.Unmarshal(body, &review)
+	return review.Request.UID
+}
+
+// encodeAdmissionReview wraps the response in an AdmissionReview of the given
+// apiVersion.
+func encodeAdmissionReview(apiVersion string, response *admissionv1.AdmissionResponse) ([]byte, error) {
+	typeMeta := metav1.TypeMeta{APIVersion: apiVersion, Kind: "AdmissionReview"}
+
+	if apiVersion == admissionv1beta1.SchemeGroupVersion.String() {
+		return json.Marshal(admissionv1beta1.AdmissionReview{
+			TypeMeta: typeMeta,
+			Response: convertResponseToV1beta1(response),
+		})
+	}
+
+	return json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: typeMeta,
+		Response: response,
+	})
+}
+
+func convertRequestFromV1beta1(request *admissionv1beta1.AdmissionRequest) *admissionv1.AdmissionRequest {
+	if request == nil {
+		return nil
+	}
+	return &admissionv1.AdmissionRequest{
+		UID:                request.UID,
+		Kind:               request.Kind,
+		Resource:           request.Resource,
+		SubResource:        request.SubResource,
+		RequestKind:        request.RequestKind,
+		RequestResource:    request.RequestResource,
+		RequestSubResource: request.RequestSubResource,
+		Name:               request.Name,
+		Namespace:          request.Namespace,
+		Operation:          admissionv1.Operation(request.Operation),
+		UserInfo:           request.UserInfo,
+		Object:             request.Object,
+		OldObject:          request.OldObject,
+		DryRun:             request.DryRun,
+		Options:            request.Options,
+	}
+}
+
+func convertResponseToV1beta1(response *admissionv1.AdmissionResponse) *admissionv1beta1.AdmissionResponse {
+	if response == nil {
+		return nil
+	}
+	converted := &admissionv1beta1.AdmissionResponse{
+		UID:              response.UID,
+		Allowed:          response.Allowed,
+		Result:           response.Result,
+		Patch:            response.Patch,
+		AuditAnnotations: response.AuditAnnotations,
+		Warnings:         response.Warnings,
+	}
+	if response.PatchType != nil {
+		patchType := admissionv1beta1.PatchType(*response.PatchType)
+		converted.PatchType = &patchType
+	}
+	return converted
+}
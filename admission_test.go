@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestHandleAdmissionVersions(t *testing.T) {
+	tests := []struct {
+		name       string
+		apiVersion string
+		pod        string
+		want       string
+		allowed    bool
+	}{
+		{"v1 within quota", "admission.k8s.io/v1", "1", "admission.k8s.io/v1", true},
+		{"v1 over quota", "admission.k8s.io/v1", "3", "admission.k8s.io/v1", false},
+		{"v1beta1 within quota", "admission.k8s.io/v1beta1", "1", "admission.k8s.io/v1beta1", true},
+		{"v1beta1 over quota", "admission.k8s.io/v1beta1", "3", "admission.k8s.io/v1beta1", false},
+		{"no apiVersion", "", "1", "admission.k8s.io/v1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newAPIServerController(t, servePods())
+			ctrl.setConfig(Config{LimitCPU: "2", LimitMemory: "2Gi", QuotaScope: quotaScopeLimits, TenantLabelKey: defaultTenantLabelKey, UsagePhases: defaultUsagePhases})
+			ar := podReview(t, admissionv1.Create, withResources(scopePod(), cpuMemory(tt.pod, "1Gi"), cpuMemory(tt.pod, "1Gi")), nil)
+			ar.TypeMeta = metav1.TypeMeta{APIVersion: tt.apiVersion, Kind: "AdmissionReview"}
+			body, err := json.Marshal(ar)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recorder := postReview(ctrl, string(body))
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", recorder.Code, http.StatusOK)
+			}
+			// Both versions share the response layout, so either one
+			// decodes into the v1beta1 type.
+			var review admissionv1beta1.AdmissionReview
+			if err := json.Unmarshal(recorder.Body.Bytes(), &review); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			if review.APIVersion != tt.want || review.Kind != "AdmissionReview" {
+				t.Errorf("response is a %s %s, want a %s AdmissionReview", review.APIVersion, review.Kind, tt.want)
+			}
+			if review.Response == nil {
+				t.Fatal("response carries no AdmissionResponse")
+			}
+			if review.Response.Allowed != tt.allowed || review.Response.UID != "review-uid" {
+				t.Errorf("response allowed = %v with UID %q, want %v with the request's", review.Response.Allowed, review.Response.UID, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestHandleAdmissionUnsupportedVersion(t *testing.T) {
+	ctrl := newTestController(map[string]string{"limitCPU": "2", "limitMemory": "2Gi"})
+	recorder := postReview(ctrl, `{"apiVersion": "admission.k8s.io/v2", "kind": "AdmissionReview", "request": {"uid": "review-uid"}}`)
+
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(recorder.Body.Bytes(), &review); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if review.APIVersion != admissionv1.SchemeGroupVersion.String() {
+		t.Errorf("apiVersion = %q, want %q", review.APIVersion, admissionv1.SchemeGroupVersion.String())
+	}
+	if review.Response == nil || review.Response.UID != "review-uid" {
+		t.Fatalf("response = %+v, want one for the request", review.Response)
+	}
+	if review.Response.Allowed || !strings.Contains(review.Response.Result.Message, "unsupported AdmissionReview apiVersion") {
+		t.Errorf("response = %+v, want a denial naming the unsupported apiVersion", review.Response)
+	}
+}
+
+func TestHandleAdmissionMalformedReviews(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		status  int
+		uid     string
+		message string
+	}{
+		{"request of the wrong type", `{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview", "request": "pod"}`, http.StatusOK, "", "could not decode admission review"},
+		{"uid of the wrong type", `{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview", "request": {"uid": 42}}`, http.StatusOK, "", "could not decode admission review"},
+		{"v1beta1 request of the wrong type", `{"apiVersion": "admission.k8s.io/v1beta1", "kind": "AdmissionReview", "request": {"uid": "review-uid", "operation": 7}}`, http.StatusOK, "review-uid", "could not decode admission review"},
+		{"undecodable pod", `{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview", "request": {"uid": "review-uid", "resource": {"version": "v1", "resource": "pods"}, "object": {"spec": []}}}`, http.StatusOK, "review-uid", ""},
+		{"truncated JSON", `{"apiVersion": "admission.k8s.io/v1", "request": {`, http.StatusBadRequest, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(map[string]string{"limitCPU": "2", "limitMemory": "2Gi"})
+			recorder := postReview(ctrl, tt.body)
+			if recorder.Code != tt.status {
+				t.Fatalf("status = %d, want %d", recorder.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			var review admissionv1.AdmissionReview
+			if err := json.Unmarshal(recorder.Body.Bytes(), &review); err != nil {
+				t.Fatalf("response is not an AdmissionReview: %v", err)
+			}
+			if review.Kind != "AdmissionReview" || review.Response == nil {
+				t.Fatalf("response = %s, want an AdmissionReview with a response", recorder.Body.String())
+			}
+			if review.Response.UID != types.UID(tt.uid) {
+				t.Errorf("UID = %q, want %q", review.Response.UID, tt.uid)
+			}
+			resp := review.Response
+			if resp.Allowed {
+				t.Fatalf("Allowed = true, want false")
+			}
+			if !strings.Contains(resp.Result.Message, tt.message) {
+				t.Errorf("message = %q, want it to contain %q", resp.Result.Message, tt.message)
+			}
+		})
+	}
+}
+
+func TestHandleAdmissionBodyLimit(t *testing.T) {
+	previous := maxRequestBodyBytes
+	maxRequestBodyBytes = 1 << 10
+	t.Cleanup(func() { maxRequestBodyBytes = previous })
+	ctrl := newTestController(map[string]string{"limitCPU": "2", "limitMemory": "2Gi"})
+
+	pod := testPod("new", "tenant-a", "1", "1Gi")
+	ar := podReview(t, admissionv1.Create, pod, nil)
+	ar.TypeMeta = metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"}
+	small, err := json.Marshal(ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recorder := postReview(ctrl, string(small)); recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d for a %d byte body, want %d", recorder.Code, len(small), http.StatusOK)
+	}
+
+	pod.Annotations = map[string]string{"padding": strings.Repeat("x", 2<<10)}
+	ar = podReview(t, admissionv1.Create, pod, nil)
+	large, err := json.Marshal(ar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := postReview(ctrl, string(large))
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d for a %d byte body, want %d", recorder.Code, len(large), http.StatusRequestEntityTooLarge)
+	}
+	if !strings.Contains(recorder.Body.String(), "request body exceeds 1024 bytes") {
+		t.Errorf("body = %q, want it to name the limit", recorder.Body.String())
+	}
+}
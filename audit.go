@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+// auditRecord is one line of the audit log.
+type auditRecord struct {
+	Timestamp time.Time     `json:"timestamp"`
+	UID       string        `json:"uid"`
+	User      string        `json:"user"`
+	Operation string        `json:"operation"`
+	Namespace string        `json:"namespace"`
+	Kind      string        `json:"kind,omitempty"`
+	Name      string        `json:"name,omitempty"`
+	Tenant    string        `json:"tenant,omitempty"`
+	Team      string        `json:"team,omitempty"`
+	Decision  string        `json:"decision"`
+	Reason    string        `json:"reason,omitempty"`
+	Message   string        `json:"message,omitempty"`
+	Requested *usageSummary `json:"requested,omitempty"`
+	Used      *usageSummary `json:"used,omitempty"`
+}
+
+// auditSink writes a JSON line for every admission decision, separate from the
+// regular logs so it can be kept and shipped on its own terms.
+type auditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// newAuditSink opens the audit log at path, appending to it, or writes to
+// stdout for "-" or "stdout".
+func newAuditSink(path string) (*auditSink, error) {
+	if path == "-" || path == "stdout" {
+		return &auditSink{w: os.Stdout}, nil
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &auditSink{w: file}, nil
+}
+
+// record writes the audit record of a decision. It does nothing on a nil sink.
+func (s *auditSink) record(request *admissionv1.AdmissionRequest, r *review, rejection error) {
+	if s == nil {
+		return
+	}
+
+	decision, rejection := decisionOf(r, rejection)
+	record := auditRecord{
+		Timestamp: time.Now().UTC(),
+		UID:       string(request.UID),
+		User:      request.UserInfo.Username,
+		Operation: string(request.Operation),
+		Namespace: request.Namespace,
+		Tenant:    r.tenant,
+		Team:      r.team,
+		Decision:  decision,
+	}
+	if rejection != nil {
+		record.Reason = rejectionReason(rejection)
+		record.Message = rejection.Error()
+	}
+	if r.target != nil {
+		record.Kind = r.target.ref.Kind
+		record.Name = r.target.ref.Name
+		if r.config != nil {
+			record.Requested = summarizeUsage(r.target.usage(*r.config))
+		}
+	}
+	if r.used != nil {
+		record.Used = summarizeUsage(*r.used)
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.Write(append(line, '\n'))
+}
+
+func summarizeUsage(usage Usage) *usageSummary {
+	return &usageSummary{Limits: usage.Limits, Requests: usage.Requests, Pods: usage.Pods}
+}
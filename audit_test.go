@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+// useAuditLog makes the controller write its audit log to a buffer.
+func useAuditLog(ctrl *Controller) *bytes.Buffer {
+	var buf bytes.Buffer
+	ctrl.auditLog = &auditSink{w: &buf}
+	return &buf
+}
+
+func TestAuditLog(t *testing.T) {
+	ctrl := newTestController(map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}, testPod("running", "tenant-a", "1", "1Gi"))
+	buf := useAuditLog(ctrl)
+
+	for _, pod := range []string{"500m", "3"} {
+		ar := podReview(t, admissionv1.Create, testPod("new-"+pod, "tenant-a", pod, "512Mi"), nil)
+		ar.Request.UserInfo = authenticationv1.UserInfo{Username: "system:serviceaccount:vcluster-a:vc-a"}
+		ctrl.processAdmissionReview(context.Background(), ar)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("audit log has %d lines, want one per decision:\n%s", len(lines), buf.String())
+	}
+	records := make([]auditRecord, len(lines))
+	for i, line := range lines {
+		if err := json.Unmarshal([]byte(line), &records[i]); err != nil {
+			t.Fatalf("line %d is not an audit record: %v", i, err)
+		}
+	}
+
+	allowed, denied := records[0], records[1]
+	for _, record := range records {
+		if record.Timestamp.IsZero() || record.UID != "review-uid" || record.User != "system:serviceaccount:vcluster-a:vc-a" ||
+			record.Operation != "CREATE" || record.Namespace != "tenant-a-ns" || record.Tenant != "tenant-a" || record.Kind != "Pod" {
+			t.Errorf("record = %+v, want the request's details", record)
+		}
+		if record.Used == nil || record.Requested == nil {
+			t.Fatalf("record = %+v, want a usage snapshot", record)
+		}
+	}
+
+	if allowed.Decision != "allowed" || allowed.Reason != "" || allowed.Name != "new-500m" {
+		t.Errorf("allowed record = %+v", allowed)
+	}
+	checkResources(t, allowed.Requested.Limits, "500m", "512Mi")
+	checkResources(t, allowed.Used.Limits, "1", "1Gi")
+	if denied.Decision != "denied" || denied.Reason != "cpu_exceeded" || !strings.Contains(denied.Message, "CPU limit exceeded") {
+		t.Errorf("denied record = %+v", denied)
+	}
+	checkResources(t, denied.Requested.Limits, "3", "512Mi")
+	// The admitted pod is charged before the second review.
+	checkResources(t, denied.Used.Limits, "1500m", "1536Mi")
+}
+
+func TestAuditLogSkipsDryRuns(t *testing.T) {
+	ctrl := newTestController(map[string]string{"limitCPU": "2", "limitMemory": "2Gi"})
+	buf := useAuditLog(ctrl)
+	ar := podReview(t, admissionv1.Create, testPod("new", "tenant-a", "1", "1Gi"), nil)
+	dryRun := true
+	ar.Request.DryRun = &dryRun
+
+	resp := ctrl.processAdmissionReview(context.Background(), ar)
+	if !resp.Allowed {
+		t.Fatalf("Allowed = false, want true (result: %v)", resp.Result)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("audit log = %q, want nothing for a dry run", buf.String())
+	}
+}
+
+func TestAuditLogDisabled(t *testing.T) {
+	ctrl := newTestController(map[string]string{"limitCPU": "2", "limitMemory": "2Gi"})
+	resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("new", "tenant-a", "1", "1Gi"), nil))
+	if !resp.Allowed {
+		t.Fatalf("Allowed = false, want true (result: %v)", resp.Result)
+	}
+}
+
+func TestNewAuditSinkAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := os.WriteFile(path, []byte("existing\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sink, err := newAuditSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.record(&admissionv1.AdmissionRequest{UID: "review-uid"}, &review{}, nil)
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 || lines[0] != "existing" || !strings.Contains(lines[1], `"uid":"review-uid"`) {
+		t.Errorf("audit log = %q, want the record appended", content)
+	}
+}
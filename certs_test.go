@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"testing"
+	"time"
+)
+
+// servedCommonName returns the common name of the certificate a TLS server
+// using getCertificate presents.
+func servedCommonName(t *testing.T, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) string {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: getCertificate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestCertReloaderServesRotatedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "before")
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := servedCommonName(t, reloader.GetCertificate); got != "before" {
+		t.Fatalf("served certificate %q, want before", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := reloader.watch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	writeTestCertificate(t, dir, "after")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for servedCommonName(t, reloader.GetCertificate) != "after" {
+		if time.Now().After(deadline) {
+			t.Fatal("rotated certificate was not served")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestCertReloaderKeepsCertificateOnInvalidFile(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "valid")
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloader.reload(); err == nil {
+		t.Fatal("reload() accepted an invalid certificate")
+	}
+	if got := servedCommonName(t, reloader.GetCertificate); got != "valid" {
+		t.Errorf("served certificate %q after a failed reload, want valid", got)
+	}
+}
+
+func TestNewCertReloaderMissingFiles(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := newCertReloader(dir+"/tls.crt", dir+"/tls.key"); err == nil {
+		t.Error("newCertReloader() succeeded without certificate files")
+	}
+}
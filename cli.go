@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// runValidateConfig implements the validate-config subcommand. It checks a
+// config file, in the format CONFIG_FILE takes or as a ConfigMap manifest,
+// with the same parsing the controller uses, and returns the exit code.
+func runValidateConfig(args []string, stdout, stderr io.Writer) int {
+	if len(args) != 1 {
+		fmt.Fprintln(stderr, "usage: admission-controller validate-config <file>")
+		return 2
+	}
+
+	content, err := os.ReadFile(args[0])
+	if err != nil {
+		fmt.Fprintf(stderr, "could not read config: %v\n", err)
+		return 1
+	}
+
+	var config Config
+	if cm, ok := configMapManifest(content); ok {
+		config, err = parseConfig(cm.Data)
+	} else {
+		config, err = readConfigFile(content)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: %v\n", args[0], err)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "%s: valid, limitCPU %s, limitMemory %s, scope %s\n", args[0], config.LimitCPU, config.LimitMemory, config.QuotaScope)
+	return 0
+}
+
+// configMapManifest returns the ConfigMap if content is a ConfigMap manifest,
+// as it would be kubectl applied.
+func configMapManifest(content []byte) (corev1.ConfigMap, bool) {
+	var cm corev1.ConfigMap
+	if err := yaml.Unmarshal(content, &cm); err != nil || cm.Kind != "ConfigMap" {
+		return corev1.ConfigMap{}, false
+	}
+	return cm, true
+}
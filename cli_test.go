@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunValidateConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		code    int
+		stdout  string
+		stderr  string
+	}{
+		{
+			name:    "valid config file",
+			content: "limitCPU: \"2\"\nlimitMemory: 2Gi\nmaxPods: 10\n",
+			stdout:  "valid, limitCPU 2, limitMemory 2Gi, scope Limits",
+		},
+		{
+			name:    "valid ConfigMap manifest",
+			content: "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: quota\ndata:\n  limitCPU: \"4\"\n  limitMemory: 8Gi\n  quotaScope: Requests\n",
+			stdout:  "valid, limitCPU 4, limitMemory 8Gi, scope Requests",
+		},
+		{name: "invalid value", content: "limitCPU: two\nlimitMemory: 2Gi\n", code: 1, stderr: "invalid limitCPU"},
+		{name: "invalid ConfigMap manifest", content: "kind: ConfigMap\ndata:\n  limitCPU: \"2\"\n  limitMemory: 2Gi\n  maxPods: lots\n", code: 1, stderr: "invalid maxPods"},
+		{name: "not YAML", content: "limitCPU: [2\n", code: 1, stderr: "invalid config file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			var stdout, stderr bytes.Buffer
+			if code := runValidateConfig([]string{path}, &stdout, &stderr); code != tt.code {
+				t.Errorf("exit code = %d, want %d (stderr %q)", code, tt.code, stderr.String())
+			}
+			if !strings.Contains(stdout.String(), tt.stdout) || (tt.stdout == "" && stdout.Len() > 0) {
+				t.Errorf("stdout = %q, want %q", stdout.String(), tt.stdout)
+			}
+			if !strings.Contains(stderr.String(), tt.stderr) || (tt.stderr == "" && stderr.Len() > 0) {
+				t.Errorf("stderr = %q, want %q", stderr.String(), tt.stderr)
+			}
+		})
+	}
+}
+
+func TestRunValidateConfigUsage(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		code int
+		want string
+	}{
+		{"no file", nil, 2, "usage:"},
+		{"two files", []string{"a.yaml", "b.yaml"}, 2, "usage:"},
+		{"missing file", []string{filepath.Join(t.TempDir(), "missing.yaml")}, 1, "could not read config"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if code := runValidateConfig(tt.args, &stdout, &stderr); code != tt.code {
+				t.Errorf("exit code = %d, want %d", code, tt.code)
+			}
+			if !strings.Contains(stderr.String(), tt.want) {
+				t.Errorf("stderr = %q, want %q", stderr.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,1248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// defaultTenantLabelKey is the label the vcluster syncer puts on the pods it
+// creates, naming the vcluster they belong to.
+const defaultTenantLabelKey = "vcluster.loft.sh/managed-by"
+
+const defaultConfigMapName = "vcluster-resource-quota-controller-config"
+const defaultConfigMapNamespace = "default"
+
+// configMapNames returns the ConfigMaps the config is merged from, in order
+// of precedence: keys of a later ConfigMap override those of earlier ones, so
+// a base config can be layered with per-environment overrides.
+func (ctrl *Controller) configMapNames() []string {
+	return splitList(ctrl.configMapName)
+}
+
+// mergeConfigMaps merges the data of the given ConfigMaps, later ones taking
+// precedence. Nil entries, ConfigMaps that do not exist, are skipped.
+func mergeConfigMaps(cms []*corev1.ConfigMap) map[string]string {
+	data := map[string]string{}
+	for _, cm := range cms {
+		if cm == nil {
+			continue
+		}
+		for key, value := range cm.Data {
+			data[key] = value
+		}
+	}
+	return data
+}
+
+const (
+	failurePolicyFail  = "Fail"
+	failurePolicyAllow = "Allow"
+)
+
+const defaultAPITimeout = 5 * time.Second
+
+const defaultTenantMetricsLimit = 100
+
+// defaultUsagePhases are the phases in which a pod holds its resources. The
+// finished phases cannot be counted: those pods are not even listed.
+var defaultUsagePhases = []corev1.PodPhase{corev1.PodPending, corev1.PodRunning, corev1.PodUnknown}
+
+// Missing resources modes select how containers without limits or requests are
+// handled.
+const (
+	missingResourcesReject = "Reject"
+	missingResourcesInject = "Inject"
+)
+
+// Quota scopes select whether container limits or requests are summed.
+const (
+	quotaScopeLimits   = "Limits"
+	quotaScopeRequests = "Requests"
+)
+
+type Config struct {
+	LimitCPU         string `json:"limitCPU"`
+	LimitMemory      string `json:"limitMemory"`
+	CountPodOverhead bool   `json:"countPodOverhead"`
+
+	// CountEphemeralContainers adds the resources of ephemeral (debug)
+	// containers to a pod's usage.
+	CountEphemeralContainers bool   `json:"countEphemeralContainers"`
+	QuotaScope               string `json:"quotaScope"`
+	RequestCPU               string `json:"requestCPU"`
+	RequestMemory            string `json:"requestMemory"`
+
+	LimitEphemeralStorage string `json:"limitEphemeralStorage"`
+
+	// LimitStorage caps the storage requested by a tenant's
+	// PersistentVolumeClaims. Empty means unbounded.
+	LimitStorage string `json:"limitStorage"`
+
+	// SoftLimitCPU and SoftLimitMemory add an admission warning when usage
+	// goes above them. The limits above them still deny.
+	SoftLimitCPU    string `json:"softLimitCPU"`
+	SoftLimitMemory string `json:"softLimitMemory"`
+
+	// MaxContainerCPU and MaxContainerMemory cap the limit of every single
+	// container, independently of the tenant's total.
+	MaxContainerCPU    string `json:"maxContainerCPU"`
+	MaxContainerMemory string `json:"maxContainerMemory"`
+
+	// MinContainerCPURequest and MinContainerMemoryRequest are the smallest
+	// requests a container may make, so tenants cannot pack pods with
+	// near-zero requests and huge limits.
+	MinContainerCPURequest    string `json:"minContainerCPURequest"`
+	MinContainerMemoryRequest string `json:"minContainerMemoryRequest"`
+
+	// LimitGuaranteedCPU, LimitGuaranteedMemory, LimitBurstableCPU and
+	// LimitBurstableMemory cap the summed CPU and memory of a tenant's pods of
+	// one QoS class, in addition to the tenant's total. Empty means no
+	// class-specific limit.
+	LimitGuaranteedCPU    string `json:"limitGuaranteedCPU"`
+	LimitGuaranteedMemory string `json:"limitGuaranteedMemory"`
+	LimitBurstableCPU     string `json:"limitBurstableCPU"`
+	LimitBurstableMemory  string `json:"limitBurstableMemory"`
+
+	// QuotaLimits holds limit ceilings for arbitrary resources. The flat
+	// fields, such as LimitCPU, take precedence for the resources they set.
+	QuotaLimits corev1.ResourceList `json:"quota"`
+
+	// ExtendedResources maps extended resource names, such as nvidia.com/gpu,
+	// to their quota.
+	ExtendedResources map[string]string `json:"extendedResources"`
+
+	// EnforcedResources selects the resources whose ceilings are enforced;
+	// each needs a limit from the fields above. If it is empty the CPU and
+	// memory limits are required and every configured ceiling is enforced.
+	EnforcedResources []corev1.ResourceName `json:"enforcedResources"`
+
+	// MaxPods caps the number of pods per tenant. Zero means unbounded.
+	MaxPods int `json:"maxPods"`
+
+	// MaxBestEffortPods caps the number of BestEffort pods per tenant, pods
+	// without any CPU or memory request or limit. They are admitted without
+	// being checked against the CPU and memory quota. Zero leaves them to the
+	// usual checks.
+	MaxBestEffortPods int `json:"maxBestEffortPods"`
+
+	// EmitEvents enables Warning Events on rejected pods.
+	EmitEvents bool `json:"emitEvents"`
+
+	// ExcludedNamespaces lists namespaces whose pods are never checked, as
+	// names or glob patterns such as "kube-*".
+	ExcludedNamespaces []string `json:"excludedNamespaces"`
+
+	// VerifyTenantIdentity rejects pods whose tenant label does not belong to
+	// the requesting user according to TenantUsers, so a tenant cannot be
+	// charged to another tenant's quota.
+	VerifyTenantIdentity bool                `json:"verifyTenantIdentity"`
+	TenantUsers          map[string][]string `json:"tenantUsers"`
+
+	// RequireTenantLabel rejects pods without the tenant label in
+	// TenantNamespaces, or in every namespace that is not excluded if that is
+	// empty, so tenants cannot escape the quota by dropping the label.
+	RequireTenantLabel bool     `json:"requireTenantLabel"`
+	TenantNamespaces   []string `json:"tenantNamespaces"`
+
+	// NamespaceTenants maps namespaces to a tenant. Pods without the tenant
+	// label in a mapped namespace are charged to that tenant.
+	NamespaceTenants map[string]string `json:"namespaceTenants"`
+
+	// BypassUsers lists the users and groups whose pods may skip the quota
+	// with the bypass annotation.
+	BypassUsers []string `json:"bypassUsers"`
+
+	// TenantLabelKey is the pod label whose value identifies the tenant.
+	TenantLabelKey string `json:"tenantLabelKey"`
+
+	// TeamLabelKey, if set, splits every tenant's quota by the value of this
+	// pod label, so each team of a tenant is charged separately. Pods without
+	// the label are charged together.
+	TeamLabelKey string `json:"teamLabelKey"`
+
+	// NodeAllocatablePercent replaces the CPU and memory limit ceilings with
+	// this share of the summed allocatable of all nodes. Zero disables it.
+	NodeAllocatablePercent int `json:"nodeAllocatablePercent"`
+
+	// ResourceQuotaName names a ResourceQuota in the pod's namespace whose hard
+	// limits replace the configured ceilings.
+	ResourceQuotaName string `json:"resourceQuotaName"`
+
+	// NamespaceQuotaAnnotations reads ceilings from annotations on the pod's
+	// namespace, which take precedence over the configured ones.
+	NamespaceQuotaAnnotations bool `json:"namespaceQuotaAnnotations"`
+
+	// TenantOverrides replaces the global ceilings for individual tenants,
+	// keyed by the value of the tenant label.
+	TenantOverrides map[string]TenantQuota `json:"tenantOverrides"`
+
+	// TeamOverrides replaces the ceilings for individual teams, keyed by
+	// teamKey. It applies on top of TenantOverrides.
+	TeamOverrides map[string]TenantQuota `json:"teamOverrides"`
+
+	// FailurePolicy decides whether requests are allowed or denied when pods
+	// cannot be listed. Empty means the FAILURE_POLICY environment variable.
+	FailurePolicy string `json:"failurePolicy"`
+
+	// MaxProcessingTime bounds how long a request may take to decide, so that
+	// the webhook answers before the API server's timeout. When it runs out the
+	// request is decided by TimeoutPolicy, which defaults to the failure
+	// policy. Zero disables the deadline.
+	MaxProcessingTime time.Duration `json:"maxProcessingTime"`
+	TimeoutPolicy     string        `json:"timeoutPolicy"`
+
+	// BurstPercent raises the limit ceilings by this percentage, whatever the
+	// quota scope, to tolerate a small overshoot at the boundary.
+	BurstPercent int `json:"burstPercent"`
+
+	// OvercommitRatio multiplies the ceilings that apply to requests.
+	OvercommitRatio float64 `json:"overcommitRatio"`
+
+	// EnforceRequestsLeqLimits rejects containers requesting more CPU or
+	// memory than their limit.
+	EnforceRequestsLeqLimits bool `json:"enforceRequestsLeqLimits"`
+
+	// RequireLimitsAndRequests rejects containers that do not set both limits
+	// and requests. Disable it when a LimitRange fills in defaults.
+	RequireLimitsAndRequests bool `json:"requireLimitsAndRequests"`
+
+	// MissingResourcesMode selects whether containers without limits or
+	// requests are rejected or get DefaultLimits and DefaultRequests injected
+	// by the mutating webhook.
+	MissingResourcesMode string              `json:"missingResourcesMode"`
+	DefaultLimits        corev1.ResourceList `json:"defaultLimits"`
+	DefaultRequests      corev1.ResourceList `json:"defaultRequests"`
+
+	// ClusterWideQuota sums a tenant's pods across all namespaces instead of
+	// only the namespace of the pod under review.
+	ClusterWideQuota bool `json:"clusterWideQuota"`
+
+	// UsagePhases lists the pod phases that count towards usage.
+	UsagePhases []corev1.PodPhase `json:"usagePhases"`
+
+	// AuditMode allows every request and only logs and counts the ones that
+	// would have been rejected.
+	AuditMode bool `json:"auditMode"`
+
+	// RejectionMessagePrefix and RejectionMessageURL are added to the message
+	// of denied requests, e.g. to point tenants at a runbook.
+	RejectionMessagePrefix string `json:"rejectionMessagePrefix"`
+	RejectionMessageURL    string `json:"rejectionMessageURL"`
+
+	// BlockOverQuota rejects every new pod of a tenant that is already over its
+	// quota, even pods that would not add to the exceeded resource.
+	BlockOverQuota bool `json:"blockOverQuota"`
+
+	// ReconcileInterval is how often the leader looks for tenants that are
+	// already over their quota. Zero disables the reconciler.
+	ReconcileInterval time.Duration `json:"reconcileInterval"`
+
+	// RejectionLogInterval, if set, logs at most one rejection per namespace,
+	// tenant and reason within the interval, with a count of the ones
+	// suppressed since the last line.
+	RejectionLogInterval time.Duration `json:"rejectionLogInterval"`
+
+	// TenantMetricsLimit caps the number of tenants with usage gauges, bounding
+	// their label cardinality. Zero disables the gauges.
+	TenantMetricsLimit int `json:"tenantMetricsLimit"`
+
+	// WarnThresholdPercent adds an admission warning when an allowed pod
+	// pushes usage above this share of a ceiling. Zero disables warnings.
+	WarnThresholdPercent int `json:"warnThresholdPercent"`
+}
+
+// failurePolicy returns the config's failure policy, or fallback, the
+// controller's, if it sets none.
+func (c Config) failurePolicy(fallback string) string {
+	if c.FailurePolicy != "" {
+		return c.FailurePolicy
+	}
+	return fallback
+}
+
+func (c Config) timeoutPolicy(fallback string) string {
+	if c.TimeoutPolicy != "" {
+		return c.TimeoutPolicy
+	}
+	return c.failurePolicy(fallback)
+}
+
+// TenantQuota overrides the global ceilings for a single tenant. Empty fields
+// fall back to the global value.
+type TenantQuota struct {
+	LimitCPU              string `json:"limitCPU,omitempty"`
+	LimitMemory           string `json:"limitMemory,omitempty"`
+	LimitEphemeralStorage string `json:"limitEphemeralStorage,omitempty"`
+	LimitStorage          string `json:"limitStorage,omitempty"`
+	RequestCPU            string `json:"requestCPU,omitempty"`
+	RequestMemory         string `json:"requestMemory,omitempty"`
+	MaxPods               int    `json:"maxPods,omitempty"`
+}
+
+// forTenant returns the config with the tenant's overrides applied.
+func (c Config) forTenant(tenant string) Config {
+	if override, ok := c.TenantOverrides[tenant]; ok {
+		return c.withOverride(override)
+	}
+	return c
+}
+
+// forTeam returns the config with the team's overrides applied. It is applied
+// after forTenant.
+func (c Config) forTeam(tenant, team string) Config {
+	if override, ok := c.TeamOverrides[teamKey(tenant, team)]; ok {
+		return c.withOverride(override)
+	}
+	return c
+}
+
+// teamKey identifies a team of a tenant as "tenant/team", which cannot be
+// ambiguous as label values contain no slash. Without a team it is the
+// tenant.
+func teamKey(tenant, team string) string {
+	if team == "" {
+		return tenant
+	}
+	return tenant + "/" + team
+}
+
+// podTeam returns the team of a pod with the given labels, or "" if teams are
+// not configured or the pod has none.
+func (c Config) podTeam(podLabels map[string]string) string {
+	if c.TeamLabelKey == "" {
+		return ""
+	}
+	return podLabels[c.TeamLabelKey]
+}
+
+// tenantSelector selects the pods that share a quota with a pod of the tenant
+// and team: the tenant's pods of the same team, or without a team label if
+// team is empty and teams are configured. An empty tenant selects the pods
+// without the tenant label, which belong to the tenant their namespace is
+// mapped to.
+func (c Config) tenantSelector(tenant, team string) (labels.Selector, error) {
+	set := labels.Set{}
+	var absent []string
+	if tenant != "" {
+		set[c.TenantLabelKey] = tenant
+	} else {
+		absent = append(absent, c.TenantLabelKey)
+	}
+	if c.TeamLabelKey != "" && team != "" {
+		set[c.TeamLabelKey] = team
+	} else if c.TeamLabelKey != "" {
+		absent = append(absent, c.TeamLabelKey)
+	}
+
+	selector, err := labels.ValidatedSelectorFromSet(set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenant label %s: %v", set, err)
+	}
+	for _, key := range absent {
+		requirement, err := labels.NewRequirement(key, selection.DoesNotExist, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label %s: %v", key, err)
+		}
+		selector = selector.Add(*requirement)
+	}
+	return selector, nil
+}
+
+// podTenant returns the tenant of a pod with the given labels in namespace:
+// the value of the tenant label or, without one, the tenant the namespace is
+// mapped to by NamespaceTenants.
+func (c Config) podTenant(namespace string, podLabels map[string]string) (string, bool) {
+	if tenant, ok := podLabels[c.TenantLabelKey]; ok {
+		return tenant, true
+	}
+	tenant, ok := c.NamespaceTenants[namespace]
+	return tenant, ok
+}
+
+// mappedNamespaces returns the namespaces NamespaceTenants maps to the tenant.
+func (c Config) mappedNamespaces(tenant string) []string {
+	var namespaces []string
+	for namespace, mapped := range c.NamespaceTenants {
+		if mapped == tenant {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// withOverride replaces the ceilings the override sets.
+func (c Config) withOverride(override TenantQuota) Config {
+	overrideString := func(field *string, value string) {
+		if value != "" {
+			*field = value
+		}
+	}
+	overrideString(&c.LimitCPU, override.LimitCPU)
+	overrideString(&c.LimitMemory, override.LimitMemory)
+	overrideString(&c.LimitEphemeralStorage, override.LimitEphemeralStorage)
+	overrideString(&c.LimitStorage, override.LimitStorage)
+	overrideString(&c.RequestCPU, override.RequestCPU)
+	overrideString(&c.RequestMemory, override.RequestMemory)
+	if override.MaxPods > 0 {
+		c.MaxPods = override.MaxPods
+	}
+	return c
+}
+
+// Quota holds the parsed ceilings of a Config. Resources missing from a list
+// are not limited.
+type Quota struct {
+	// Scope selects whether Limits caps the summed limits or requests.
+	Scope    string
+	Limits   corev1.ResourceList
+	Requests corev1.ResourceList
+
+	// SoftLimits only warn. They are compared against the same sum as Limits.
+	SoftLimits corev1.ResourceList
+
+	// ContainerMax caps the limit of every single container.
+	ContainerMax corev1.ResourceList
+
+	// ContainerMinRequests is the smallest request every container must make.
+	ContainerMinRequests corev1.ResourceList
+
+	// QOSClassLimits caps the usage of the pods of a QoS class. They are
+	// compared against the same sum as Limits.
+	QOSClassLimits map[corev1.PodQOSClass]corev1.ResourceList
+
+	// Storage caps the storage requested by PersistentVolumeClaims. Zero
+	// means unbounded.
+	Storage resource.Quantity
+}
+
+func parseQuota(config Config) (Quota, error) {
+	quota := Quota{
+		Scope:      config.QuotaScope,
+		Limits:     corev1.ResourceList{},
+		Requests:   corev1.ResourceList{},
+		SoftLimits: corev1.ResourceList{},
+
+		ContainerMax:         corev1.ResourceList{},
+		ContainerMinRequests: corev1.ResourceList{},
+
+		QOSClassLimits: map[corev1.PodQOSClass]corev1.ResourceList{
+			corev1.PodQOSGuaranteed: {},
+			corev1.PodQOSBurstable:  {},
+		},
+	}
+	guaranteed, burstable := quota.QOSClassLimits[corev1.PodQOSGuaranteed], quota.QOSClassLimits[corev1.PodQOSBurstable]
+
+	fields := []struct {
+		key      string
+		value    string
+		list     corev1.ResourceList
+		name     corev1.ResourceName
+		required bool
+	}{
+		{"limitCPU", config.LimitCPU, quota.Limits, corev1.ResourceCPU, true},
+		{"limitMemory", config.LimitMemory, quota.Limits, corev1.ResourceMemory, true},
+		{"limitEphemeralStorage", config.LimitEphemeralStorage, quota.Limits, corev1.ResourceEphemeralStorage, false},
+		{"requestCPU", config.RequestCPU, quota.Requests, corev1.ResourceCPU, false},
+		{"requestMemory", config.RequestMemory, quota.Requests, corev1.ResourceMemory, false},
+		{"softLimitCPU", config.SoftLimitCPU, quota.SoftLimits, corev1.ResourceCPU, false},
+		{"softLimitMemory", config.SoftLimitMemory, quota.SoftLimits, corev1.ResourceMemory, false},
+		{"maxContainerCPU", config.MaxContainerCPU, quota.ContainerMax, corev1.ResourceCPU, false},
+		{"maxContainerMemory", config.MaxContainerMemory, quota.ContainerMax, corev1.ResourceMemory, false},
+		{"minContainerCPURequest", config.MinContainerCPURequest, quota.ContainerMinRequests, corev1.ResourceCPU, false},
+		{"minContainerMemoryRequest", config.MinContainerMemoryRequest, quota.ContainerMinRequests, corev1.ResourceMemory, false},
+		{"limitGuaranteedCPU", config.LimitGuaranteedCPU, guaranteed, corev1.ResourceCPU, false},
+		{"limitGuaranteedMemory", config.LimitGuaranteedMemory, guaranteed, corev1.ResourceMemory, false},
+		{"limitBurstableCPU", config.LimitBurstableCPU, burstable, corev1.ResourceCPU, false},
+		{"limitBurstableMemory", config.LimitBurstableMemory, burstable, corev1.ResourceMemory, false},
+	}
+	for name, quantity := range config.QuotaLimits {
+		if err := checkUnits(name, quantity); err != nil {
+			return Quota{}, fmt.Errorf("invalid quota for %s %q: %v", name, quantity.String(), err)
+		}
+		quota.Limits[name] = quantity.DeepCopy()
+	}
+
+	// Required fields may be left empty when the quota map sets the resource,
+	// or when enforcedResources decides which limits are required.
+	for _, field := range fields {
+		required := field.required && len(config.EnforcedResources) == 0
+		if _, set := field.list[field.name]; field.value == "" && (!required || set) {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(field.value)
+		if err == nil {
+			err = checkUnits(field.name, quantity)
+		}
+		if err != nil {
+			return Quota{}, fmt.Errorf("invalid %s %q: %v", field.key, field.value, err)
+		}
+		field.list[field.name] = quantity
+	}
+
+	for name, value := range config.ExtendedResources {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return Quota{}, fmt.Errorf("invalid extendedResources limit %q for %s: %v", value, name, err)
+		}
+		quota.Limits[corev1.ResourceName(name)] = quantity
+	}
+
+	if len(config.EnforcedResources) > 0 {
+		enforced := map[corev1.ResourceName]bool{}
+		for _, name := range config.EnforcedResources {
+			if _, ok := quota.Limits[name]; !ok {
+				return Quota{}, fmt.Errorf("enforcedResources lists %s but no limit is configured for it", name)
+			}
+			enforced[name] = true
+		}
+		for _, list := range []corev1.ResourceList{quota.Limits, quota.Requests, quota.SoftLimits, guaranteed, burstable} {
+			for name := range list {
+				if !enforced[name] {
+					delete(list, name)
+				}
+			}
+		}
+	}
+
+	if config.LimitStorage != "" {
+		storage, err := resource.ParseQuantity(config.LimitStorage)
+		if err == nil {
+			err = checkUnits(corev1.ResourceStorage, storage)
+		}
+		if err != nil {
+			return Quota{}, fmt.Errorf("invalid limitStorage %q: %v", config.LimitStorage, err)
+		}
+		quota.Storage = storage
+	}
+
+	// The overcommit ratio stretches every ceiling that is compared against
+	// requests, leaving limit ceilings strict.
+	if config.OvercommitRatio > 0 && config.OvercommitRatio != 1 {
+		scaleResourceList(quota.Requests, config.OvercommitRatio)
+		if quota.Scope == quotaScopeRequests {
+			scaleResourceList(quota.Limits, config.OvercommitRatio)
+			scaleResourceList(quota.SoftLimits, config.OvercommitRatio)
+			scaleResourceList(guaranteed, config.OvercommitRatio)
+			scaleResourceList(burstable, config.OvercommitRatio)
+		}
+	}
+
+	// Unlike the overcommit ratio, the burst allowance only applies to the
+	// limit ceilings and does so in either scope.
+	if config.BurstPercent > 0 {
+		for _, list := range []corev1.ResourceList{quota.Limits, guaranteed, burstable} {
+			scaleResourceList(list, 1+float64(config.BurstPercent)/100)
+		}
+	}
+
+	// A soft limit above the limit could never warn. The quota of a tenant
+	// or namespace can lower the limit below the global soft limit, which
+	// then no longer applies to it.
+	for name, soft := range quota.SoftLimits {
+		if limit := quota.Limits[name]; soft.Cmp(limit) > 0 {
+			delete(quota.SoftLimits, name)
+		}
+	}
+
+	return quota, nil
+}
+
+// without returns a copy of the quota that leaves the named resources
+// unbounded.
+func (q Quota) without(names ...corev1.ResourceName) Quota {
+	strip := func(list corev1.ResourceList) corev1.ResourceList {
+		stripped := list.DeepCopy()
+		for _, name := range names {
+			delete(stripped, name)
+		}
+		return stripped
+	}
+	result := q
+	result.Limits = strip(q.Limits)
+	result.Requests = strip(q.Requests)
+	result.SoftLimits = strip(q.SoftLimits)
+	result.ContainerMax = strip(q.ContainerMax)
+	result.ContainerMinRequests = strip(q.ContainerMinRequests)
+	result.QOSClassLimits = make(map[corev1.PodQOSClass]corev1.ResourceList, len(q.QOSClassLimits))
+	for class, list := range q.QOSClassLimits {
+		result.QOSClassLimits[class] = strip(list)
+	}
+	return result
+}
+
+// checkUnits rejects quantities whose suffix cannot have been meant for the
+// resource. Binary and decimal suffixes, e.g. "1Gi" and "1000M", are both
+// fine and compare by their value, but "500m" of memory is half a byte and
+// "1Gi" of CPU is over a billion cores.
+func checkUnits(name corev1.ResourceName, quantity resource.Quantity) error {
+	switch name {
+	case corev1.ResourceMemory, corev1.ResourceEphemeralStorage, corev1.ResourceStorage:
+		if quantity.MilliValue()%1000 != 0 {
+			return fmt.Errorf("%s must be a whole number of bytes, use e.g. Mi or M instead of m", name)
+		}
+	case corev1.ResourceCPU:
+		if quantity.Format == resource.BinarySI {
+			return fmt.Errorf("binary suffixes such as Ki, Mi or Gi are not valid for %s, use e.g. 500m or 2", name)
+		}
+	}
+	return nil
+}
+
+// loadConfig returns the cached config. The ConfigMap is only fetched on the
+// hot path if no config has been loaded successfully yet.
+func (ctrl *Controller) loadConfig(ctx context.Context) (Config, error) {
+	ctrl.configMu.RLock()
+	config := ctrl.config
+	ctrl.configMu.RUnlock()
+
+	if config != nil {
+		return *config, nil
+	}
+
+	if err := ctrl.refreshConfig(ctx); err != nil {
+		return Config{}, err
+	}
+
+	ctrl.configMu.RLock()
+	defer ctrl.configMu.RUnlock()
+	return *ctrl.config, nil
+}
+
+// configLoaded reports whether a valid config has been loaded at least once.
+func (ctrl *Controller) configLoaded() bool {
+	ctrl.configMu.RLock()
+	defer ctrl.configMu.RUnlock()
+	return ctrl.config != nil
+}
+
+// refreshConfig fetches the ConfigMap and replaces the cached config. On error
+// the previously cached config is left untouched.
+func (ctrl *Controller) refreshConfig(ctx context.Context) error {
+	config, err := ctrl.fetchConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctrl.setConfig(config)
+	return nil
+}
+
+func (ctrl *Controller) setConfig(config Config) {
+	ctrl.configMu.Lock()
+	ctrl.config = &config
+	ctrl.configMu.Unlock()
+}
+
+// watchConfig starts an informer on each of the controller's ConfigMaps that
+// keeps the cached config up to date. Invalid updates are logged and ignored
+// so that the last known good config stays in effect.
+func (ctrl *Controller) watchConfig(stopCh <-chan struct{}) error {
+	if ctrl.configFile != "" {
+		return ctrl.watchConfigFile(ctrl.configFile, stopCh)
+	}
+	if ctrl.configSource == configSourceCRD {
+		return ctrl.watchQuotaObject(stopCh)
+	}
+	if ctrl.client == nil {
+		return errNoClient
+	}
+
+	// A field selector matches a single name, so every ConfigMap gets its
+	// own informer. Events are only applied once all of them have synced, so
+	// that an override is never left out of the merge while starting up.
+	names := ctrl.configMapNames()
+	listers := make([]corelisters.ConfigMapNamespaceLister, len(names))
+	synced := make([]cache.InformerSynced, len(names))
+	// Every informer runs its handlers on its own goroutine, so merges are
+	// serialized to keep an older one from being applied last.
+	var applyMu sync.Mutex
+	apply := func() {
+		applyMu.Lock()
+		defer applyMu.Unlock()
+		for _, hasSynced := range synced {
+			if !hasSynced() {
+				return
+			}
+		}
+		ctrl.applyConfigMaps(names, listers)
+	}
+
+	for i, name := range names {
+		factory := informers.NewSharedInformerFactoryWithOptions(ctrl.client, 0,
+			informers.WithNamespace(ctrl.configMapNamespace),
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+			}),
+		)
+
+		configMaps := factory.Core().V1().ConfigMaps()
+		informer := configMaps.Informer()
+		listers[i] = configMaps.Lister().ConfigMaps(ctrl.configMapNamespace)
+		synced[i] = informer.HasSynced
+		_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(interface{}) {
+				apply()
+			},
+			UpdateFunc: func(_, _ interface{}) {
+				apply()
+			},
+			DeleteFunc: func(interface{}) {
+				slog.Warn("ConfigMap was deleted", "namespace", ctrl.configMapNamespace, "name", name)
+				apply()
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		factory.Start(stopCh)
+	}
+
+	go func() {
+		if cache.WaitForCacheSync(stopCh, synced...) {
+			apply()
+		}
+	}()
+	return nil
+}
+
+// applyConfigMaps merges the cached ConfigMaps and replaces the config. If
+// none of them exists the last known good config stays in effect.
+func (ctrl *Controller) applyConfigMaps(names []string, listers []corelisters.ConfigMapNamespaceLister) {
+	cms := make([]*corev1.ConfigMap, len(names))
+	found := false
+	for i, name := range names {
+		cm, err := listers[i].Get(name)
+		if err != nil {
+			slog.Warn("Skipping missing ConfigMap", "namespace", ctrl.configMapNamespace, "name", name)
+			continue
+		}
+		cms[i] = cm
+		found = true
+	}
+	if !found {
+		slog.Warn("No ConfigMap found, keeping last known good config", "namespace", ctrl.configMapNamespace, "names", names)
+		return
+	}
+
+	config, err := parseConfig(mergeConfigMaps(cms))
+	if err != nil {
+		slog.Error("Ignoring invalid config in ConfigMaps", "namespace", ctrl.configMapNamespace, "names", names, "error", err)
+		return
+	}
+
+	ctrl.setConfig(config)
+	slog.Info("Applied config from ConfigMaps", "namespace", ctrl.configMapNamespace, "names", names, "limitCPU", config.LimitCPU, "limitMemory", config.LimitMemory)
+}
+
+func (ctrl *Controller) fetchConfig(ctx context.Context) (Config, error) {
+	if ctrl.configFile != "" {
+		return fetchConfigFile(ctrl.configFile)
+	}
+	if ctrl.configSource == configSourceCRD {
+		return ctrl.fetchQuotaObject(ctx)
+	}
+	if ctrl.client == nil {
+		return Config{}, errNoClient
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ctrl.apiTimeout)
+	defer cancel()
+
+	names := ctrl.configMapNames()
+	cms := make([]*corev1.ConfigMap, len(names))
+	var missing error
+	found := false
+	for i, name := range names {
+		err := retryTransient(ctx, func() (err error) {
+			cms[i], err = ctrl.client.CoreV1().ConfigMaps(ctrl.configMapNamespace).Get(ctx, name, metav1.GetOptions{})
+			return err
+		})
+		if apierrors.IsNotFound(err) && len(names) > 1 {
+			slog.Warn("Skipping missing ConfigMap", "namespace", ctrl.configMapNamespace, "name", name)
+			cms[i], missing = nil, err
+			continue
+		}
+		if err != nil {
+			return Config{}, err
+		}
+		found = true
+	}
+	if !found {
+		return Config{}, missing
+	}
+
+	config, err := parseConfig(mergeConfigMaps(cms))
+	if err != nil {
+		return Config{}, invalidConfig(err)
+	}
+	return config, nil
+}
+
+func parseFailurePolicy(value string) (string, error) {
+	switch value {
+	case failurePolicyFail, failurePolicyAllow:
+		return value, nil
+	default:
+		return "", fmt.Errorf("unknown failure policy %q, must be %s or %s", value, failurePolicyFail, failurePolicyAllow)
+	}
+}
+
+// parseConfig builds a Config from the data of the controller's ConfigMap.
+func parseConfig(data map[string]string) (Config, error) {
+	config := Config{
+		LimitCPU:      data["limitCPU"],
+		LimitMemory:   data["limitMemory"],
+		QuotaScope:    quotaScopeLimits,
+		RequestCPU:    data["requestCPU"],
+		RequestMemory: data["requestMemory"],
+
+		LimitEphemeralStorage: data["limitEphemeralStorage"],
+		LimitStorage:          data["limitStorage"],
+		SoftLimitCPU:          data["softLimitCPU"],
+		SoftLimitMemory:       data["softLimitMemory"],
+
+		MaxContainerCPU:           data["maxContainerCPU"],
+		MaxContainerMemory:        data["maxContainerMemory"],
+		MinContainerCPURequest:    data["minContainerCPURequest"],
+		MinContainerMemoryRequest: data["minContainerMemoryRequest"],
+
+		LimitGuaranteedCPU:    data["limitGuaranteedCPU"],
+		LimitGuaranteedMemory: data["limitGuaranteedMemory"],
+		LimitBurstableCPU:     data["limitBurstableCPU"],
+		LimitBurstableMemory:  data["limitBurstableMemory"],
+
+		TenantLabelKey:       defaultTenantLabelKey,
+		OvercommitRatio:      1,
+		MissingResourcesMode: missingResourcesReject,
+
+		RequireLimitsAndRequests: true,
+		UsagePhases:              defaultUsagePhases,
+		TenantMetricsLimit:       defaultTenantMetricsLimit,
+	}
+
+	if value, ok := data["extendedResources"]; ok {
+		if err := json.Unmarshal([]byte(value), &config.ExtendedResources); err != nil {
+			return Config{}, fmt.Errorf("invalid extendedResources: %v", err)
+		}
+	}
+
+	if value, ok := data["tenantOverrides"]; ok {
+		if err := json.Unmarshal([]byte(value), &config.TenantOverrides); err != nil {
+			return Config{}, fmt.Errorf("invalid tenantOverrides: %v", err)
+		}
+	}
+
+	if value, ok := data["teamOverrides"]; ok {
+		if err := json.Unmarshal([]byte(value), &config.TeamOverrides); err != nil {
+			return Config{}, fmt.Errorf("invalid teamOverrides: %v", err)
+		}
+	}
+
+	if value, ok := data["tenantUsers"]; ok {
+		if err := json.Unmarshal([]byte(value), &config.TenantUsers); err != nil {
+			return Config{}, fmt.Errorf("invalid tenantUsers: %v", err)
+		}
+	}
+
+	if value, ok := data["maxPods"]; ok {
+		maxPods, err := strconv.Atoi(value)
+		if err != nil || maxPods < 0 {
+			return Config{}, fmt.Errorf("invalid maxPods %q: must be a non-negative integer", value)
+		}
+		config.MaxPods = maxPods
+	}
+
+	if value, ok := data["maxBestEffortPods"]; ok {
+		maxBestEffortPods, err := strconv.Atoi(value)
+		if err != nil || maxBestEffortPods < 0 {
+			return Config{}, fmt.Errorf("invalid maxBestEffortPods %q: must be a non-negative integer", value)
+		}
+		config.MaxBestEffortPods = maxBestEffortPods
+	}
+
+	if value, ok := data["reconcileInterval"]; ok {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval < 0 {
+			return Config{}, fmt.Errorf("invalid reconcileInterval %q: must be a non-negative duration", value)
+		}
+		config.ReconcileInterval = interval
+	}
+
+	if value, ok := data["rejectionLogInterval"]; ok {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval < 0 {
+			return Config{}, fmt.Errorf("invalid rejectionLogInterval %q: must be a non-negative duration", value)
+		}
+		config.RejectionLogInterval = interval
+	}
+
+	if value, ok := data["tenantMetricsLimit"]; ok {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			return Config{}, fmt.Errorf("invalid tenantMetricsLimit %q: must be a non-negative integer", value)
+		}
+		config.TenantMetricsLimit = limit
+	}
+
+	if value, ok := data["warnThresholdPercent"]; ok {
+		percent, err := strconv.Atoi(value)
+		if err != nil || percent < 0 || percent > 100 {
+			return Config{}, fmt.Errorf("invalid warnThresholdPercent %q: must be an integer between 0 and 100", value)
+		}
+		config.WarnThresholdPercent = percent
+	}
+
+	if value, ok := data["nodeAllocatablePercent"]; ok {
+		percent, err := strconv.Atoi(value)
+		if err != nil || percent < 0 || percent > 100 {
+			return Config{}, fmt.Errorf("invalid nodeAllocatablePercent %q: must be an integer between 0 and 100", value)
+		}
+		config.NodeAllocatablePercent = percent
+	}
+
+	if value, ok := data["failurePolicy"]; ok {
+		policy, err := parseFailurePolicy(value)
+		if err != nil {
+			return Config{}, err
+		}
+		config.FailurePolicy = policy
+	}
+
+	if value, ok := data["maxProcessingTime"]; ok {
+		limit, err := time.ParseDuration(value)
+		if err != nil || limit < 0 {
+			return Config{}, fmt.Errorf("invalid maxProcessingTime %q: must be a non-negative duration", value)
+		}
+		config.MaxProcessingTime = limit
+	}
+
+	if value, ok := data["timeoutPolicy"]; ok {
+		policy, err := parseFailurePolicy(value)
+		if err != nil {
+			return Config{}, err
+		}
+		config.TimeoutPolicy = policy
+	}
+
+	if value, ok := data["burstPercent"]; ok {
+		percent, err := strconv.Atoi(value)
+		if err != nil || percent < 0 || percent > 100 {
+			return Config{}, fmt.Errorf("invalid burstPercent %q: must be an integer between 0 and 100", value)
+		}
+		config.BurstPercent = percent
+	}
+
+	if value, ok := data["overcommitRatio"]; ok {
+		ratio, err := strconv.ParseFloat(value, 64)
+		if err != nil || ratio <= 0 {
+			return Config{}, fmt.Errorf("invalid overcommitRatio %q: must be a positive number", value)
+		}
+		config.OvercommitRatio = ratio
+	}
+
+	if value, ok := data["quotaScope"]; ok {
+		if value != quotaScopeLimits && value != quotaScopeRequests {
+			return Config{}, fmt.Errorf("invalid quotaScope %q, must be %s or %s", value, quotaScopeLimits, quotaScopeRequests)
+		}
+		config.QuotaScope = value
+	}
+
+	if value, ok := data["resourceQuotaName"]; ok {
+		if errs := validation.IsDNS1123Subdomain(value); len(errs) > 0 {
+			return Config{}, fmt.Errorf("invalid resourceQuotaName %q: %s", value, strings.Join(errs, "; "))
+		}
+		config.ResourceQuotaName = value
+	}
+
+	if value, ok := data["tenantLabelKey"]; ok {
+		if errs := validation.IsQualifiedName(value); len(errs) > 0 {
+			return Config{}, fmt.Errorf("invalid tenantLabelKey %q: %s", value, strings.Join(errs, "; "))
+		}
+		config.TenantLabelKey = value
+	}
+
+	if value, ok := data["teamLabelKey"]; ok {
+		if errs := validation.IsQualifiedName(value); len(errs) > 0 {
+			return Config{}, fmt.Errorf("invalid teamLabelKey %q: %s", value, strings.Join(errs, "; "))
+		}
+		config.TeamLabelKey = value
+	}
+
+	if value, ok := data["excludedNamespaces"]; ok {
+		config.ExcludedNamespaces = splitList(value)
+		for _, pattern := range config.ExcludedNamespaces {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return Config{}, fmt.Errorf("invalid excludedNamespaces pattern %q: %v", pattern, err)
+			}
+		}
+	}
+
+	if value, ok := data["enforcedResources"]; ok {
+		for _, name := range splitList(value) {
+			if errs := validation.IsQualifiedName(name); len(errs) > 0 {
+				return Config{}, fmt.Errorf("invalid enforcedResources entry %q: %s", name, strings.Join(errs, "; "))
+			}
+			config.EnforcedResources = append(config.EnforcedResources, corev1.ResourceName(name))
+		}
+	}
+
+	if value, ok := data["usagePhases"]; ok {
+		phases, err := parseUsagePhases(value)
+		if err != nil {
+			return Config{}, err
+		}
+		config.UsagePhases = phases
+	}
+
+	if value, ok := data["namespaceTenants"]; ok {
+		if err := json.Unmarshal([]byte(value), &config.NamespaceTenants); err != nil {
+			return Config{}, fmt.Errorf("invalid namespaceTenants: %v", err)
+		}
+		for namespace, tenant := range config.NamespaceTenants {
+			if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+				return Config{}, fmt.Errorf("invalid namespaceTenants namespace %q: %s", namespace, strings.Join(errs, "; "))
+			}
+			if errs := validation.IsValidLabelValue(tenant); len(errs) > 0 || tenant == "" {
+				return Config{}, fmt.Errorf("invalid namespaceTenants tenant %q for namespace %s: %s", tenant, namespace, strings.Join(errs, "; "))
+			}
+		}
+	}
+
+	if value, ok := data["tenantNamespaces"]; ok {
+		config.TenantNamespaces = splitList(value)
+	}
+
+	config.RejectionMessagePrefix = data["rejectionMessagePrefix"]
+	if value, ok := data["rejectionMessageURL"]; ok {
+		if u, err := url.Parse(value); err != nil || !u.IsAbs() {
+			return Config{}, fmt.Errorf("invalid rejectionMessageURL %q: must be an absolute URL", value)
+		}
+		config.RejectionMessageURL = value
+	}
+
+	if value, ok := data["bypassUsers"]; ok {
+		config.BypassUsers = splitList(value)
+	}
+
+	if value, ok := data["missingResourcesMode"]; ok {
+		if value != missingResourcesReject && value != missingResourcesInject {
+			return Config{}, fmt.Errorf("invalid missingResourcesMode %q, must be %s or %s", value, missingResourcesReject, missingResourcesInject)
+		}
+		config.MissingResourcesMode = value
+	}
+
+	if value, ok := data["quota"]; ok {
+		if err := json.Unmarshal([]byte(value), &config.QuotaLimits); err != nil {
+			return Config{}, fmt.Errorf("invalid quota: %v", err)
+		}
+	}
+
+	if value, ok := data["defaultLimits"]; ok {
+		if err := json.Unmarshal([]byte(value), &config.DefaultLimits); err != nil {
+			return Config{}, fmt.Errorf("invalid defaultLimits: %v", err)
+		}
+	}
+
+	if value, ok := data["defaultRequests"]; ok {
+		if err := json.Unmarshal([]byte(value), &config.DefaultRequests); err != nil {
+			return Config{}, fmt.Errorf("invalid defaultRequests: %v", err)
+		}
+	}
+
+	bools := []struct {
+		key   string
+		field *bool
+	}{
+		{"requireLimitsAndRequests", &config.RequireLimitsAndRequests},
+		{"enforceRequestsLeqLimits", &config.EnforceRequestsLeqLimits},
+		{"auditMode", &config.AuditMode},
+		{"blockOverQuota", &config.BlockOverQuota},
+		{"clusterWideQuota", &config.ClusterWideQuota},
+		{"requireTenantLabel", &config.RequireTenantLabel},
+		{"emitEvents", &config.EmitEvents},
+		{"verifyTenantIdentity", &config.VerifyTenantIdentity},
+		{"countPodOverhead", &config.CountPodOverhead},
+		{"countEphemeralContainers", &config.CountEphemeralContainers},
+		{"namespaceQuotaAnnotations", &config.NamespaceQuotaAnnotations},
+	}
+	for _, b := range bools {
+		value, ok := data[b.key]
+		if !ok {
+			continue
+		}
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid %s %q: %v", b.key, value, err)
+		}
+		*b.field = parsed
+	}
+
+	quota, err := parseQuota(config)
+	if err != nil {
+		return Config{}, err
+	}
+	// Derived quotas drop a soft limit above their limit, but above the
+	// limit set next to it in the config it is a mistake.
+	for _, soft := range []struct {
+		key   string
+		value string
+		name  corev1.ResourceName
+	}{
+		{"softLimitCPU", config.SoftLimitCPU, corev1.ResourceCPU},
+		{"softLimitMemory", config.SoftLimitMemory, corev1.ResourceMemory},
+	} {
+		limit, limited := quota.Limits[soft.name]
+		if _, kept := quota.SoftLimits[soft.name]; soft.value != "" && limited && !kept {
+			return Config{}, fmt.Errorf("invalid %s %q: above the limit %s", soft.key, soft.value, limit.String())
+		}
+	}
+	for tenant := range config.TenantOverrides {
+		if _, err := parseQuota(config.forTenant(tenant)); err != nil {
+			return Config{}, fmt.Errorf("tenantOverrides[%s]: %v", tenant, err)
+		}
+	}
+	for key := range config.TeamOverrides {
+		tenant, team, ok := strings.Cut(key, "/")
+		if !ok || tenant == "" || team == "" {
+			return Config{}, fmt.Errorf("invalid teamOverrides key %q, must be tenant/team", key)
+		}
+		if _, err := parseQuota(config.forTenant(tenant).forTeam(tenant, team)); err != nil {
+			return Config{}, fmt.Errorf("teamOverrides[%s]: %v", key, err)
+		}
+	}
+
+	return config, nil
+}
+
+// splitList parses a comma separated ConfigMap value, ignoring blanks.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (c Config) namespaceExcluded(namespace string) bool {
+	for _, pattern := range c.ExcludedNamespaces {
+		// Patterns are validated when the config is parsed.
+		if matched, _ := path.Match(pattern, namespace); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func parseUsagePhases(value string) ([]corev1.PodPhase, error) {
+	var phases []corev1.PodPhase
+	for _, phase := range splitList(value) {
+		valid := false
+		for _, allowed := range defaultUsagePhases {
+			valid = valid || corev1.PodPhase(phase) == allowed
+		}
+		if !valid {
+			return nil, fmt.Errorf("invalid usagePhases entry %q, must be one of %s, %s or %s", phase, corev1.PodPending, corev1.PodRunning, corev1.PodUnknown)
+		}
+		phases = append(phases, corev1.PodPhase(phase))
+	}
+	if len(phases) == 0 {
+		return nil, fmt.Errorf("invalid usagePhases %q: must list at least one phase", value)
+	}
+	return phases, nil
+}
+
+// phaseCounted reports whether pods in the phase count towards usage. Pods
+// that have not been given a phase yet are Pending.
+func (c Config) phaseCounted(phase corev1.PodPhase) bool {
+	if phase == "" {
+		phase = corev1.PodPending
+	}
+	for _, counted := range c.UsagePhases {
+		if counted == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectionMessage decorates the message of a denied request with the
+// configured prefix and URL.
+func (c Config) rejectionMessage(message string) string {
+	if c.RejectionMessagePrefix != "" {
+		message = c.RejectionMessagePrefix + " " + message
+	}
+	if c.RejectionMessageURL != "" {
+		message += " (see " + c.RejectionMessageURL + ")"
+	}
+	return message
+}
+
+// tenantLabelRequired reports whether pods in the namespace must carry the
+// tenant label.
+func (c Config) tenantLabelRequired(namespace string) bool {
+	if !c.RequireTenantLabel {
+		return false
+	}
+	if len(c.TenantNamespaces) == 0 {
+		return true
+	}
+	for _, tenantNamespace := range c.TenantNamespaces {
+		if tenantNamespace == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// bypassAllowed reports whether the requesting user, or one of its groups, may
+// exempt pods from the quota with the bypass annotation.
+func (c Config) bypassAllowed(user authenticationv1.UserInfo) bool {
+	return userListed(c.BypassUsers, user)
+}
+
+// tenantIdentityValid reports whether the requesting user may create pods for
+// the tenant. It always holds unless VerifyTenantIdentity is set.
+func (c Config) tenantIdentityValid(tenant string, user authenticationv1.UserInfo) bool {
+	return !c.VerifyTenantIdentity || userListed(c.TenantUsers[tenant], user)
+}
+
+// userListed reports whether the user's name or one of its groups is in list.
+func userListed(list []string, user authenticationv1.UserInfo) bool {
+	for _, allowed := range list {
+		if allowed == user.Username {
+			return true
+		}
+		for _, group := range user.Groups {
+			if allowed == group {
+				return true
+			}
+		}
+	}
+	return false
+}
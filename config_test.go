@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+)
+
+func TestParseSoftLimits(t *testing.T) {
+	data := map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "softLimitCPU": "1500m", "softLimitMemory": "1536Mi"}
+
+	tests := []struct {
+		name   string
+		data   map[string]string
+		tenant string
+		err    string
+
+		// soft is the cpu soft limit of the tenant's quota, empty if it has
+		// none.
+		soft string
+	}{
+		{name: "below the limit", data: data, soft: "1500m"},
+		{name: "at the limit", data: withData(data, map[string]string{"softLimitCPU": "2"}), soft: "2"},
+		{name: "above the limit", data: withData(data, map[string]string{"softLimitCPU": "3"}), err: "invalid softLimitCPU"},
+		{name: "memory above the limit", data: withData(data, map[string]string{"softLimitMemory": "3Gi"}), err: "invalid softLimitMemory"},
+		{name: "within the burst allowance", data: withData(data, map[string]string{"softLimitCPU": "2200m", "burstPercent": "20"}), soft: "2200m"},
+		{name: "tenant limit below the soft limit", data: withData(data, map[string]string{"tenantOverrides": `{"tenant-a": {"limitCPU": "1"}}`}), tenant: "tenant-a"},
+		{name: "tenant limit above the soft limit", data: withData(data, map[string]string{"tenantOverrides": `{"tenant-a": {"limitCPU": "4"}}`}), tenant: "tenant-a", soft: "1500m"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := parseConfig(tt.data)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("parseConfig() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseConfig() error = %v", err)
+			}
+			quota, err := parseQuota(config.forTenant(tt.tenant))
+			if err != nil {
+				t.Fatalf("parseQuota() error = %v", err)
+			}
+			soft, ok := quota.SoftLimits[corev1.ResourceCPU]
+			if tt.soft == "" {
+				if ok {
+					t.Fatalf("soft limit = %s, want none", soft.String())
+				}
+				return
+			}
+			if want := resource.MustParse(tt.soft); !ok || soft.Cmp(want) != 0 {
+				t.Fatalf("soft limit = %s, want %s", soft.String(), tt.soft)
+			}
+		})
+	}
+}
+
+func TestSoftLimitAboveResourceQuota(t *testing.T) {
+	// The ResourceQuota lowers the limit below the configured soft limit,
+	// which must not make the quota invalid.
+	data := map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "softLimitCPU": "1500m", "resourceQuotaName": "compute"}
+	resourceQuota := &corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "compute", Namespace: testNamespace},
+		Spec:       corev1.ResourceQuotaSpec{Hard: corev1.ResourceList{corev1.ResourceLimitsCPU: resource.MustParse("1")}},
+	}
+	ctrl := newTestController(data, resourceQuota)
+
+	resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("new", "tenant-a", "1", "1Gi"), nil))
+	checkResponse(t, resp, true, "")
+	if len(resp.Warnings) > 0 {
+		t.Errorf("warnings = %v, want none", resp.Warnings)
+	}
+	resp = ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("more", "tenant-a", "500m", "512Mi"), nil))
+	checkResponse(t, resp, false, "CPU limit exceeded")
+}
+
+// newAPIServerController returns a controller whose client talks to a test
+// server run by handler.
+func newAPIServerController(t *testing.T, handler http.Handler) *Controller {
+	t.Helper()
+	ctrl, _ := newAPIServer(t, handler)
+	return ctrl
+}
+
+// newAPIServer is newAPIServerController that also returns the server, for
+// tests that stop it.
+func newAPIServer(t *testing.T, handler http.Handler) (*Controller, *httptest.Server) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newController(client), server
+}
+
+// serveConfigMap answers every request with the controller's ConfigMap.
+func serveConfigMap(data map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&corev1.ConfigMap{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+			ObjectMeta: metav1.ObjectMeta{Name: defaultConfigMapName, Namespace: defaultConfigMapNamespace},
+			Data:       data,
+		})
+	}
+}
+
+// servePods answers pod lists with the given pods that match the namespace,
+// label and field selectors of the request. Pods without a namespace are
+// served in every namespace.
+func servePods(pods ...corev1.Pod) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		namespace := ""
+		if path, ok := strings.CutPrefix(r.URL.Path, "/api/v1/namespaces/"); ok {
+			namespace = strings.TrimSuffix(path, "/pods")
+		}
+		labelSelector, err := labels.Parse(r.URL.Query().Get("labelSelector"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fieldSelector, err := fields.ParseSelector(r.URL.Query().Get("fieldSelector"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		list := &corev1.PodList{TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "PodList"}}
+		for _, pod := range pods {
+			if namespace != "" && pod.Namespace != "" && pod.Namespace != namespace {
+				continue
+			}
+			if labelSelector.Matches(labels.Set(pod.Labels)) && fieldSelector.Matches(fields.Set{"status.phase": string(pod.Status.Phase)}) {
+				list.Items = append(list.Items, pod)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	}
+}
+
+// serveConfig answers ConfigMap requests with serveConfigMap and all others
+// with servePods.
+func serveConfig(data map[string]string, pods ...corev1.Pod) http.HandlerFunc {
+	configMap, podList := serveConfigMap(data), servePods(pods...)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/configmaps/") {
+			configMap(w, r)
+			return
+		}
+		podList(w, r)
+	}
+}
+
+func TestConfigCachedWhenAPIUnreachable(t *testing.T) {
+	ctrl, server := newAPIServer(t, serveConfigMap(map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}))
+	if err := ctrl.refreshConfig(context.Background()); err != nil {
+		t.Fatalf("refreshConfig(context.Background()) error = %v", err)
+	}
+	server.Close()
+
+	// A failed refresh keeps the last good config.
+	if err := ctrl.refreshConfig(context.Background()); err == nil {
+		t.Fatal("refreshConfig(context.Background()) succeeded against an unreachable API server")
+	}
+	if config, err := ctrl.loadConfig(context.Background()); err != nil || config.LimitCPU != "2" {
+		t.Errorf("loadConfig(context.Background()) = limitCPU %q, %v, want the cached 2", config.LimitCPU, err)
+	}
+
+	// Admission keeps using the cached config.
+	resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "new"}}, nil))
+	if !resp.Allowed {
+		t.Errorf("admission denied with the cached config: %v", resp.Result)
+	}
+}
+
+func TestParseConfigLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		data map[string]string
+		err  string
+	}{
+		{"valid", map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}, ""},
+		{"garbage limitCPU", map[string]string{"limitCPU": "two cores", "limitMemory": "2Gi"}, `invalid limitCPU "two cores"`},
+		{"empty limitCPU", map[string]string{"limitCPU": "", "limitMemory": "2Gi"}, `invalid limitCPU ""`},
+		{"missing limitCPU", map[string]string{"limitMemory": "2Gi"}, "invalid limitCPU"},
+		{"garbage limitMemory", map[string]string{"limitCPU": "2", "limitMemory": "2 gigs"}, "invalid limitMemory"},
+		{"memory in millibytes", map[string]string{"limitCPU": "2", "limitMemory": "500m"}, "whole number of bytes"},
+		{"cpu with a binary suffix", map[string]string{"limitCPU": "1Gi", "limitMemory": "2Gi"}, "binary suffixes"},
+		{"quota not a JSON object", map[string]string{"quota": `cpu=2`}, "invalid quota"},
+		{"quota not a quantity", map[string]string{"quota": `{"cpu": "two", "memory": "2Gi"}`}, "invalid quota"},
+		{"quota memory in millibytes", map[string]string{"quota": `{"cpu": "2", "memory": "2500m"}`}, "whole number of bytes"},
+		{"invalid minContainerCPURequest", map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "minContainerCPURequest": "tiny"}, `invalid minContainerCPURequest "tiny"`},
+		{"decimal and binary memory", map[string]string{"limitCPU": "2", "limitMemory": "2G", "requestMemory": "1500Mi"}, ""},
+		{"ephemeral storage in millibytes", map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "limitEphemeralStorage": "10m"}, "whole number of bytes"},
+		{"storage in millibytes", map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "limitStorage": "100m"}, "whole number of bytes"},
+		{"garbage requestCPU", map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "requestCPU": "x"}, "invalid requestCPU"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig(tt.data)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("parseConfig() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("parseConfig() error = %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestInvalidConfigFailurePolicy(t *testing.T) {
+	for _, tt := range []struct {
+		policy  string
+		allowed bool
+	}{
+		{failurePolicyFail, false},
+		{failurePolicyAllow, true},
+	} {
+		t.Run(tt.policy, func(t *testing.T) {
+			ctrl := newAPIServerController(t, servePods())
+			ctrl.failurePolicy = tt.policy
+			// parseConfig rejects such a ConfigMap; this is the check for a
+			// config that got into the cache some other way.
+			ctrl.setConfig(Config{LimitCPU: "garbage", LimitMemory: "2Gi", TenantLabelKey: defaultTenantLabelKey, UsagePhases: defaultUsagePhases})
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "new", Labels: map[string]string{"vcluster.loft.sh/managed-by": "tenant-a"}},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{testContainer("app", "1", "1Gi")}},
+			}, nil))
+			if resp.Allowed != tt.allowed {
+				t.Fatalf("allowed = %v, want %v (%v)", resp.Allowed, tt.allowed, resp.Result)
+			}
+			if !tt.allowed && !strings.Contains(resp.Result.Message, "invalid limitCPU") {
+				t.Errorf("message = %q, want it to name limitCPU", resp.Result.Message)
+			}
+		})
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	client := fake.NewSimpleClientset(testConfigMap(defaultConfigMapName, map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}))
+	ctrl := newController(client)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err := ctrl.watchConfig(stopCh); err != nil {
+		t.Fatalf("watchConfig() error = %v", err)
+	}
+	waitForLimitCPU(t, ctrl, "2")
+
+	update := func(data map[string]string) {
+		t.Helper()
+		if _, err := client.CoreV1().ConfigMaps(defaultConfigMapNamespace).Update(context.Background(), testConfigMap(defaultConfigMapName, data), metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	update(map[string]string{"limitCPU": "4", "limitMemory": "2Gi"})
+	waitForLimitCPU(t, ctrl, "4")
+
+	// An unparseable value is ignored; the valid update after it shows that
+	// it has been seen.
+	update(map[string]string{"limitCPU": "lots", "limitMemory": "2Gi"})
+	update(map[string]string{"limitCPU": "4", "limitMemory": "3Gi"})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		config, _ := ctrl.loadConfig(context.Background())
+		if config.LimitCPU != "4" {
+			t.Fatalf("limitCPU = %q after an invalid update, want the previous 4", config.LimitCPU)
+		}
+		if config.LimitMemory == "3Gi" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the valid update was not applied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFetchConfigMerged(t *testing.T) {
+	base := testConfigMap("quota-base", map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "maxPods": "10"})
+	prod := testConfigMap("quota-prod", map[string]string{"limitCPU": "8"})
+
+	tests := []struct {
+		name        string
+		names       string
+		limitCPU    string
+		limitMemory string
+		maxPods     int
+	}{
+		{"override wins", "quota-base,quota-prod", "8", "2Gi", 10},
+		{"missing ConfigMaps are skipped", "quota-base,quota-missing,quota-prod", "8", "2Gi", 10},
+		{"later base wins", "quota-prod,quota-base", "2", "2Gi", 10},
+		{"base alone", "quota-missing,quota-base", "2", "2Gi", 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newController(fake.NewSimpleClientset(base.DeepCopy(), prod.DeepCopy()))
+			ctrl.configMapName = tt.names
+			config, err := ctrl.fetchConfig(context.Background())
+			if err != nil {
+				t.Fatalf("fetchConfig() error = %v", err)
+			}
+			if config.LimitCPU != tt.limitCPU || config.LimitMemory != tt.limitMemory || config.MaxPods != tt.maxPods {
+				t.Errorf("merged config has limitCPU %q, limitMemory %q, maxPods %d, want %s, %s and %d",
+					config.LimitCPU, config.LimitMemory, config.MaxPods, tt.limitCPU, tt.limitMemory, tt.maxPods)
+			}
+		})
+	}
+}
+
+func TestFetchConfigAllMissing(t *testing.T) {
+	ctrl := newController(fake.NewSimpleClientset())
+	ctrl.configMapName = "quota-base,quota-prod"
+	if _, err := ctrl.fetchConfig(context.Background()); err == nil {
+		t.Fatal("fetchConfig() succeeded without any ConfigMap")
+	}
+}
+
+func TestFetchConfigNamespace(t *testing.T) {
+	var queried []string
+	serve := serveConfigMap(map[string]string{"limitCPU": "3", "limitMemory": "2Gi"})
+	ctrl := newAPIServerController(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queried = append(queried, r.URL.Path)
+		serve(w, r)
+	}))
+	ctrl.configMapName, ctrl.configMapNamespace = "quota", "quota-system"
+
+	config, err := ctrl.fetchConfig(context.Background())
+	if err != nil {
+		t.Fatalf("fetchConfig(context.Background()) error = %v", err)
+	}
+	if config.LimitCPU != "3" {
+		t.Errorf("limitCPU = %q, want 3", config.LimitCPU)
+	}
+	if want := "/api/v1/namespaces/quota-system/configmaps/quota"; len(queried) != 1 || queried[0] != want {
+		t.Errorf("fetchConfig(context.Background()) queried %v, want [%s]", queried, want)
+	}
+}
+
+func TestWatchConfigMerged(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		testConfigMap("quota-base", map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}),
+		testConfigMap("quota-prod", map[string]string{"limitCPU": "8"}),
+	)
+	ctrl := newController(client)
+	ctrl.configMapName = "quota-base,quota-prod"
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err := ctrl.watchConfig(stopCh); err != nil {
+		t.Fatalf("watchConfig() error = %v", err)
+	}
+
+	waitForLimitCPU(t, ctrl, "8")
+
+	// Dropping the override falls back to the base.
+	if _, err := client.CoreV1().ConfigMaps(defaultConfigMapNamespace).Update(context.Background(),
+		testConfigMap("quota-prod", map[string]string{"limitMemory": "4Gi"}), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	waitForLimitCPU(t, ctrl, "2")
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// configCheckInterval is how often the config source is read and parsed again
+// to catch a config that became invalid. It can be set with
+// CONFIG_CHECK_INTERVAL; zero disables the check.
+var configCheckInterval = time.Minute
+
+// errInvalidConfig marks fetch errors caused by the config itself rather than
+// by reading it.
+var errInvalidConfig = errors.New("invalid config")
+
+var configValid = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "config_valid",
+	Help: "Whether the config source held a valid config at the last check (1) or not (0), in which case the last known good config is still in effect.",
+})
+
+func init() {
+	prometheus.MustRegister(configValid)
+}
+
+func invalidConfig(err error) error {
+	return fmt.Errorf("%w: %v", errInvalidConfig, err)
+}
+
+// watchConfigValidity periodically fetches and parses the config. Invalid
+// updates are otherwise only logged once by the watch, so this keeps
+// reporting a broken config until it is fixed, before an admission depends
+// on a value that never took effect.
+func (ctrl *Controller) watchConfigValidity(ctx context.Context) {
+	if configCheckInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(configCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		ctrl.checkConfig(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (ctrl *Controller) checkConfig(ctx context.Context) {
+	_, err := ctrl.fetchConfig(ctx)
+	switch {
+	case errors.Is(err, errInvalidConfig):
+		configValid.Set(0)
+		slog.Error("Config source holds an invalid config, the last known good config stays in effect", "error", err)
+	case err != nil:
+		slog.Warn("Could not check config", "error", err)
+	default:
+		configValid.Set(1)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// updateConfigMap replaces the data of the controller's ConfigMap.
+func updateConfigMap(t *testing.T, ctrl *Controller, data map[string]string) {
+	t.Helper()
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: ctrl.configMapName, Namespace: ctrl.configMapNamespace},
+		Data:       data,
+	}
+	if _, err := ctrl.client.CoreV1().ConfigMaps(ctrl.configMapNamespace).Update(context.Background(), cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	valid := map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}
+	ctrl := newTestController(valid)
+	configValid.Set(-1)
+
+	steps := []struct {
+		name string
+		data map[string]string
+		want float64
+	}{
+		{"valid config", valid, 1},
+		{"config becomes invalid", map[string]string{"limitCPU": "two", "limitMemory": "2Gi"}, 0},
+		{"config is fixed", map[string]string{"limitCPU": "4", "limitMemory": "2Gi"}, 1},
+	}
+	for _, step := range steps {
+		updateConfigMap(t, ctrl, step.data)
+		ctrl.checkConfig(context.Background())
+		if got := testutil.ToFloat64(configValid); got != step.want {
+			t.Errorf("%s: config_valid = %v, want %v", step.name, got, step.want)
+		}
+	}
+
+	// An unreachable API server says nothing about the config.
+	ctrl.client.(*fake.Clientset).PrependReactor("get", "configmaps", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("connection refused")
+	})
+	configValid.Set(0)
+	ctrl.checkConfig(context.Background())
+	if got := testutil.ToFloat64(configValid); got != 0 {
+		t.Errorf("config_valid = %v after an API error, want it unchanged", got)
+	}
+}
+
+func TestWatchConfigValidity(t *testing.T) {
+	previous := configCheckInterval
+	configCheckInterval = 10 * time.Millisecond
+	t.Cleanup(func() { configCheckInterval = previous })
+
+	valid := map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}
+	ctrl := newTestController(valid)
+	if _, err := ctrl.loadConfig(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	configValid.Set(-1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ctrl.watchConfigValidity(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	waitForGauge := func(want float64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if testutil.ToFloat64(configValid) == want {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("config_valid did not become %v", want)
+	}
+	waitForGauge(1)
+
+	updateConfigMap(t, ctrl, map[string]string{"limitCPU": "2", "limitMemory": "lots"})
+	waitForGauge(0)
+	// The controller keeps deciding with the last good config.
+	if config, err := ctrl.loadConfig(context.Background()); err != nil || config.LimitMemory != "2Gi" {
+		t.Errorf("loadConfig() = %q, %v, want the last good config", config.LimitMemory, err)
+	}
+
+	updateConfigMap(t, ctrl, valid)
+	waitForGauge(1)
+}
+
+func TestWatchConfigValidityDisabled(t *testing.T) {
+	previous := configCheckInterval
+	configCheckInterval = 0
+	t.Cleanup(func() { configCheckInterval = previous })
+
+	done := make(chan struct{})
+	go func() {
+		newTestController(nil).watchConfigValidity(context.Background())
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchConfigValidity() kept running with the check disabled")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"sigs.k8s.io/yaml"
+)
+
+// watchConfigFile is the file counterpart of the ConfigMap informer in
+// watchConfig. Like certReloader.watch it watches the directory, as mounted
+// ConfigMaps and Secrets are updated by swapping a symlink.
+func (ctrl *Controller) watchConfigFile(path string, stopCh <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	ctrl.applyConfigFile(path)
+
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op == fsnotify.Chmod {
+					continue
+				}
+				ctrl.applyConfigFile(path)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("Error watching config file", "file", path, "error", err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (ctrl *Controller) applyConfigFile(path string) {
+	config, err := fetchConfigFile(path)
+	if err != nil {
+		slog.Error("Ignoring invalid config file", "file", path, "error", err)
+		return
+	}
+
+	ctrl.setConfig(config)
+	slog.Info("Applied config from file", "file", path, "limitCPU", config.LimitCPU, "limitMemory", config.LimitMemory)
+}
+
+func fetchConfigFile(path string) (Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	return readConfigFile(content)
+}
+
+// readConfigFile parses the content of a config file. Errors are marked with
+// errInvalidConfig.
+func readConfigFile(content []byte) (Config, error) {
+	data, err := parseConfigFile(content)
+	if err != nil {
+		return Config{}, invalidConfig(err)
+	}
+	config, err := parseConfig(data)
+	if err != nil {
+		return Config{}, invalidConfig(err)
+	}
+	return config, nil
+}
+
+// parseConfigFile turns a YAML or JSON object into ConfigMap data. Strings are
+// taken as they are and any other value as its JSON encoding, so maxPods: 10
+// and quota: {cpu: "4"} can be written without quoting.
+func parseConfigFile(content []byte) (map[string]string, error) {
+	var values map[string]json.RawMessage
+	if err := yaml.Unmarshal(content, &values); err != nil {
+		return nil, fmt.Errorf("invalid config file: %v", err)
+	}
+
+	data := make(map[string]string, len(values))
+	for key, raw := range values {
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			value = string(raw)
+		}
+		data[key] = value
+	}
+	return data, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes content to a config file in a temporary directory
+// and returns its path.
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func waitForLimitCPU(t *testing.T, ctrl *Controller, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if ctrl.configLoaded() {
+			if config, _ := ctrl.loadConfig(context.Background()); config.LimitCPU == want {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("limitCPU did not become %s", want)
+}
+
+func TestParseConfigFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "YAML", content: "limitCPU: \"2\"\nlimitMemory: 2Gi\n", want: map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}},
+		{name: "JSON", content: `{"limitCPU": "2", "limitMemory": "2Gi"}`, want: map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}},
+		{name: "unquoted values", content: "maxPods: 10\nauditMode: true\n", want: map[string]string{"maxPods": "10", "auditMode": "true"}},
+		{name: "nested object", content: "quota:\n  cpu: \"4\"\n", want: map[string]string{"quota": `{"cpu":"4"}`}},
+		{name: "empty file", content: "", want: map[string]string{}},
+		{name: "not an object", content: "- limitCPU\n", wantErr: true},
+		{name: "invalid YAML", content: "limitCPU: [2\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseConfigFile([]byte(tt.content))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseConfigFile() = %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseConfigFile() error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseConfigFile() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFromFile(t *testing.T) {
+	// Without a client any API call would fail.
+	ctrl := newController(nil)
+	ctrl.configFile = writeConfigFile(t, "limitCPU: \"3\"\nlimitMemory: 2Gi\nmaxPods: 5\n")
+	config, err := ctrl.loadConfig(context.Background())
+	if err != nil {
+		t.Fatalf("loadConfig() error: %v", err)
+	}
+	if config.LimitCPU != "3" || config.LimitMemory != "2Gi" || config.MaxPods != 5 {
+		t.Errorf("config = %+v, want the file's values", config)
+	}
+
+	ctrl = newController(nil)
+	ctrl.configFile = writeConfigFile(t, "limitCPU: lots\nlimitMemory: 2Gi\n")
+	if _, err := ctrl.loadConfig(context.Background()); err == nil {
+		t.Error("loadConfig() accepted an invalid config file")
+	}
+}
+
+func TestWatchConfigFile(t *testing.T) {
+	path := writeConfigFile(t, "limitCPU: \"2\"\nlimitMemory: 2Gi\n")
+	ctrl := newController(nil)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err := ctrl.watchConfigFile(path, stopCh); err != nil {
+		t.Fatalf("watchConfigFile() error: %v", err)
+	}
+	waitForLimitCPU(t, ctrl, "2")
+
+	if err := os.WriteFile(path, []byte("limitCPU: \"4\"\nlimitMemory: 2Gi\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	waitForLimitCPU(t, ctrl, "4")
+
+	// Mounted ConfigMaps are updated by replacing the file.
+	replacement := filepath.Join(filepath.Dir(path), "config.yaml.new")
+	if err := os.WriteFile(replacement, []byte("limitCPU: \"6\"\nlimitMemory: 2Gi\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(replacement, path); err != nil {
+		t.Fatal(err)
+	}
+	waitForLimitCPU(t, ctrl, "6")
+
+	// An invalid change leaves the last good config in effect.
+	if err := os.WriteFile(path, []byte("limitCPU: lots\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if config, _ := ctrl.loadConfig(context.Background()); config.LimitCPU != "6" {
+		t.Errorf("limitCPU = %s after an invalid change, want 6", config.LimitCPU)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func (ctrl *Controller) handleValidateConfig(w http.ResponseWriter, r *http.Request) {
+	serveAdmissionReview(w, r, ctrl.processConfigReview)
+}
+
+// processConfigReview rejects changes to the controller's own ConfigMaps that
+// parseConfig would refuse, so a broken config fails at apply time instead of
+// being ignored by the running controller. Other ConfigMaps are allowed. When
+// the config is merged from several ConfigMaps each one may be partial, so
+// the changed one is merged with the current others and the result checked.
+func (ctrl *Controller) processConfigReview(ctx context.Context, ar admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
+	if ar.Request == nil {
+		admissionResponse, _ := deny(&admissionv1.AdmissionResponse{}, newRejection(reasonInvalidObject, "admission review contains no request"))
+		return admissionResponse
+	}
+	admissionResponse := &admissionv1.AdmissionResponse{UID: ar.Request.UID, Allowed: true}
+
+	names := ctrl.configMapNames()
+	listed := false
+	for _, name := range names {
+		listed = listed || name == ar.Request.Name
+	}
+	if schema.GroupVersionResource(ar.Request.Resource) != corev1.SchemeGroupVersion.WithResource("configmaps") || ar.Request.Namespace != ctrl.configMapNamespace || !listed {
+		return admissionResponse
+	}
+
+	var cm corev1.ConfigMap
+	if err := json.Unmarshal(ar.Request.Object.Raw, &cm); err != nil {
+		return ctrl.denyConfig(admissionResponse, ar.Request.Name, fmt.Errorf("could not unmarshal configmap object: %v", err))
+	}
+
+	cms := make([]*corev1.ConfigMap, len(names))
+	for i, name := range names {
+		if name == ar.Request.Name {
+			cms[i] = &cm
+			continue
+		}
+		other, err := ctrl.getConfigMap(ctx, name)
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		// The controller keeps its last good config if the merge turns out
+		// to be invalid, so an unreadable ConfigMap does not block changes.
+		if err != nil {
+			slog.Warn("Not validating config: could not get ConfigMap", "namespace", ctrl.configMapNamespace, "name", name, "error", err)
+			admissionResponse.Warnings = append(admissionResponse.Warnings, fmt.Sprintf("config not validated, could not get ConfigMap %s/%s: %v", ctrl.configMapNamespace, name, err))
+			return admissionResponse
+		}
+		cms[i] = other
+	}
+	if _, err := parseConfig(mergeConfigMaps(cms)); err != nil {
+		return ctrl.denyConfig(admissionResponse, ar.Request.Name, err)
+	}
+	return admissionResponse
+}
+
+// getConfigMap gets one of the controller's ConfigMaps from the API server.
+func (ctrl *Controller) getConfigMap(ctx context.Context, name string) (*corev1.ConfigMap, error) {
+	if ctrl.client == nil {
+		return nil, errNoClient
+	}
+	ctx, cancel := context.WithTimeout(ctx, ctrl.apiTimeout)
+	defer cancel()
+
+	var cm *corev1.ConfigMap
+	err := retryTransient(ctx, func() (err error) {
+		cm, err = ctrl.client.CoreV1().ConfigMaps(ctrl.configMapNamespace).Get(ctx, name, metav1.GetOptions{})
+		return err
+	})
+	return cm, err
+}
+
+func (ctrl *Controller) denyConfig(admissionResponse *admissionv1.AdmissionResponse, name string, err error) *admissionv1.AdmissionResponse {
+	admissionResponse.Allowed = false
+	admissionResponse.Result = &metav1.Status{Message: fmt.Sprintf("invalid config in ConfigMap %s/%s: %v", ctrl.configMapNamespace, name, err)}
+	return admissionResponse
+}
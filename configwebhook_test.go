@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testConfigMap(name string, data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: defaultConfigMapNamespace}, Data: data}
+}
+
+func configReview(t *testing.T, cm *corev1.ConfigMap) admissionv1.AdmissionReview {
+	ar := admissionReview(t, metav1.GroupVersionResource(corev1.SchemeGroupVersion.WithResource("configmaps")), admissionv1.Update, cm, nil)
+	ar.Request.Namespace = cm.Namespace
+	ar.Request.Name = cm.Name
+	return ar
+}
+
+func TestValidateConfigEndpoint(t *testing.T) {
+	mux := http.NewServeMux()
+	newController(fake.NewSimpleClientset()).registerHandlers(mux)
+
+	tests := []struct {
+		name    string
+		data    map[string]string
+		allowed bool
+		message string
+	}{
+		{"parseable limits", map[string]string{"limitCPU": "500m", "limitMemory": "1Gi"}, true, ""},
+		{"unparseable CPU limit", map[string]string{"limitCPU": "lots", "limitMemory": "1Gi"}, false, "invalid limitCPU"},
+		{"unparseable memory limit", map[string]string{"limitCPU": "500m", "limitMemory": "1 GB"}, false, "invalid limitMemory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := json.Marshal(configReview(t, testConfigMap(defaultConfigMapName, tt.data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			recorder := httptest.NewRecorder()
+			mux.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/validate-config", bytes.NewReader(body)))
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", recorder.Code, http.StatusOK)
+			}
+
+			var review admissionv1.AdmissionReview
+			if err := json.Unmarshal(recorder.Body.Bytes(), &review); err != nil {
+				t.Fatalf("response is not an AdmissionReview: %v", err)
+			}
+			if review.Response == nil || review.Response.UID != "review-uid" {
+				t.Fatalf("response = %+v, want one for the review", review.Response)
+			}
+			checkResponse(t, review.Response, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestProcessConfigReview(t *testing.T) {
+	base := testConfigMap("quota-base", map[string]string{"limitCPU": "2", "limitMemory": "2Gi"})
+
+	tests := []struct {
+		name     string
+		names    string
+		existing []runtime.Object
+		cm       *corev1.ConfigMap
+		allowed  bool
+		message  string
+	}{
+		{"valid config", defaultConfigMapName, nil, testConfigMap(defaultConfigMapName, map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}), true, ""},
+		{"invalid config", defaultConfigMapName, nil, testConfigMap(defaultConfigMapName, map[string]string{"limitCPU": "two", "limitMemory": "2Gi"}), false, "invalid limitCPU"},
+		{"other ConfigMap", defaultConfigMapName, nil, testConfigMap("unrelated", map[string]string{"limitCPU": "two"}), true, ""},
+		{"partial override of a valid base", "quota-base,quota-prod", []runtime.Object{base}, testConfigMap("quota-prod", map[string]string{"limitCPU": "4"}), true, ""},
+		{"invalid override", "quota-base,quota-prod", []runtime.Object{base}, testConfigMap("quota-prod", map[string]string{"limitCPU": "four"}), false, "invalid limitCPU"},
+		{"override that breaks the base", "quota-base,quota-prod", []runtime.Object{base}, testConfigMap("quota-prod", map[string]string{"softLimitCPU": "3"}), false, "invalid softLimitCPU"},
+		{"partial override without its base", "quota-base,quota-prod", nil, testConfigMap("quota-prod", map[string]string{"limitCPU": "4"}), false, "limitMemory"},
+		{"base with an existing override", "quota-base,quota-prod", []runtime.Object{testConfigMap("quota-prod", map[string]string{"limitMemory": "4Gi"})},
+			testConfigMap("quota-base", map[string]string{"limitCPU": "2"}), true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newController(fake.NewSimpleClientset(tt.existing...))
+			ctrl.configMapName = tt.names
+			resp := ctrl.processConfigReview(context.Background(), configReview(t, tt.cm))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestReviewWithoutRequest(t *testing.T) {
+	ctrl := newTestController(map[string]string{"limitCPU": "2", "limitMemory": "2Gi"})
+	tests := []struct {
+		name    string
+		process func(context.Context, admissionv1.AdmissionReview) *admissionv1.AdmissionResponse
+	}{
+		{"pod admission", ctrl.processAdmissionReview},
+		{"config validation", ctrl.processConfigReview},
+		{"mutation", ctrl.processMutation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := tt.process(context.Background(), admissionv1.AdmissionReview{})
+			checkResponse(t, resp, false, "admission review contains no request")
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// Controller holds the API client and the state built from it: the cached
+// config, the pod, namespace and ResourceQuota caches, the recently admitted
+// pods and the summed node allocatable. Everything that reads from the API
+// server goes through it, so any kubernetes.Interface, such as a fake
+// clientset, can back a Controller. It also holds the settings read from the
+// environment at startup, which newController sets to their defaults.
+type Controller struct {
+	client kubernetes.Interface
+
+	// dynamicClient reads VClusterResourceQuota objects. It is only set when
+	// they are the config source.
+	dynamicClient dynamic.Interface
+	eventRecorder record.EventRecorder
+
+	// configMapName and configMapNamespace locate the controller's
+	// ConfigMap, or its VClusterResourceQuota when that is the config
+	// source. They can be overridden with CONFIG_MAP_NAME and
+	// CONFIG_MAP_NAMESPACE. For ConfigMaps the name may be a comma-separated
+	// list, see configMapNames.
+	configMapName      string
+	configMapNamespace string
+	// configFile is the path of a YAML or JSON config file, set with
+	// CONFIG_FILE. When set it replaces the ConfigMap and no API calls are
+	// made for the config.
+	configFile   string
+	configSource string
+
+	// failurePolicy decides whether requests are allowed or denied when no
+	// valid config is available. It defaults to failing closed and is
+	// overridden by the failurePolicy key of the config once one is loaded.
+	failurePolicy string
+	// apiTimeout bounds each call to the API server made while deciding a
+	// request. It can be overridden with API_TIMEOUT.
+	apiTimeout time.Duration
+
+	// auditLog is nil unless AUDIT_LOG is set.
+	auditLog      *auditSink
+	rejectionLogs *rejectionLogLimiter
+
+	configMu sync.RWMutex
+	config   *Config
+
+	podLister        corelisters.PodLister
+	podsSynced       cache.InformerSynced
+	podCacheLabelKey string
+	admissions       *admissionTracker
+
+	namespaceLister  corelisters.NamespaceLister
+	namespacesSynced cache.InformerSynced
+
+	resourceQuotaLister  corelisters.ResourceQuotaLister
+	resourceQuotasSynced cache.InformerSynced
+
+	nodeAllocatableMu sync.RWMutex
+	nodeAllocatable   corev1.ResourceList
+}
+
+// errNoClient is returned instead of calling the API server when a controller
+// has no client, so a partially initialized controller fails requests rather
+// than panicking.
+var errNoClient = errors.New("no Kubernetes client configured")
+
+func newController(client kubernetes.Interface) *Controller {
+	return &Controller{
+		client:             client,
+		configMapName:      defaultConfigMapName,
+		configMapNamespace: defaultConfigMapNamespace,
+		configSource:       configSourceConfigMap,
+		failurePolicy:      failurePolicyFail,
+		apiTimeout:         defaultAPITimeout,
+		rejectionLogs:      newRejectionLogLimiter(),
+		admissions:         newAdmissionTracker(),
+	}
+}
+
+// registerHandlers registers the endpoints that are served from the
+// controller's state.
+func (ctrl *Controller) registerHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/validate", ctrl.handleAdmission)
+	mux.HandleFunc("/mutate", ctrl.handleMutate)
+	mux.HandleFunc("/validate-config", ctrl.handleValidateConfig)
+	mux.HandleFunc("/readyz", ctrl.handleReadyz)
+	mux.HandleFunc("/usage", ctrl.handleUsage)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestControllersAreIndependent(t *testing.T) {
+	small := newTestController(map[string]string{"limitCPU": "1", "limitMemory": "1Gi"})
+	large := newTestController(map[string]string{"limitCPU": "4", "limitMemory": "4Gi"}, testPod("running", "tenant-a", "1", "1Gi"))
+
+	tests := []struct {
+		name    string
+		ctrl    *Controller
+		allowed bool
+		message string
+	}{
+		{"controller with the small quota", small, false, "CPU limit exceeded: requested 2 on top of 0 used, limit is 1"},
+		{"controller with the large quota", large, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := tt.ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("new", "tenant-a", "2", "1Gi"), nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+
+	// Each controller keeps its own config and admissions.
+	for _, ctrl := range []*Controller{small, large} {
+		if !ctrl.configLoaded() {
+			t.Error("controller did not cache its config")
+		}
+	}
+	usage, err := small.calculateResourceUsage(context.Background(), testNamespace, "tenant-a", "", mustLoadConfig(t, small), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Pods != 0 {
+		t.Errorf("small controller counts %d pods, want none of the other controller's", usage.Pods)
+	}
+}
+
+func mustLoadConfig(t *testing.T, ctrl *Controller) Config {
+	t.Helper()
+	config, err := ctrl.loadConfig(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestControllerWithoutClient(t *testing.T) {
+	ctrl := newController(nil)
+	if _, err := ctrl.loadConfig(context.Background()); !errors.Is(err, errNoClient) {
+		t.Errorf("loadConfig() error = %v, want %v", err, errNoClient)
+	}
+	if _, err := ctrl.getPodsWithLabel(context.Background(), testNamespace, nil); !errors.Is(err, errNoClient) {
+		t.Errorf("getPodsWithLabel() error = %v, want %v", err, errNoClient)
+	}
+	resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("new", "tenant-a", "1", "1Gi"), nil))
+	checkResponse(t, resp, false, "controller is not initialized")
+}
+
+func TestNilClient(t *testing.T) {
+	tests := []struct {
+		name    string
+		ctrl    func() *Controller
+		policy  string
+		allowed bool
+	}{
+		{"zero controller, failing closed", func() *Controller { return &Controller{} }, failurePolicyFail, false},
+		{"zero controller, failing open", func() *Controller { return &Controller{} }, failurePolicyAllow, true},
+		{"controller without a client, failing closed", func() *Controller { return newController(nil) }, failurePolicyFail, false},
+		{"controller without a client, failing open", func() *Controller { return newController(nil) }, failurePolicyAllow, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := tt.ctrl()
+			ctrl.failurePolicy = tt.policy
+
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("new", "tenant-a", "1", "1Gi"), nil))
+			checkResponse(t, resp, tt.allowed, "controller is not initialized")
+			ar := admissionReview(t, metav1.GroupVersionResource(pvcResource), admissionv1.Create, testPVC("new", "tenant-a", "1Gi"), nil)
+			checkResponse(t, ctrl.processAdmissionReview(context.Background(), ar), tt.allowed, "controller is not initialized")
+
+			if resp := ctrl.processMutation(context.Background(), podReview(t, admissionv1.Create, testPod("new", "tenant-a", "1", "1Gi"), nil)); !resp.Allowed || resp.Patch != nil {
+				t.Errorf("mutation = %+v, want the pod allowed unchanged", resp)
+			}
+
+			recorder := httptest.NewRecorder()
+			ctrl.handleUsage(recorder, httptest.NewRequest(http.MethodGet, "/usage?namespace="+testNamespace+"&tenant=tenant-a", nil))
+			if recorder.Code != http.StatusServiceUnavailable {
+				t.Errorf("/usage = %d, want %d", recorder.Code, http.StatusServiceUnavailable)
+			}
+		})
+	}
+}
+
+func TestRegisterHandlers(t *testing.T) {
+	mux := http.NewServeMux()
+	newTestController(map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}).registerHandlers(mux)
+
+	for _, path := range []string{"/validate", "/mutate", "/validate-config", "/readyz", "/usage"} {
+		if _, pattern := mux.Handler(httptest.NewRequest(http.MethodPost, path, strings.NewReader(""))); pattern != path {
+			t.Errorf("%s is not registered, matched %q", path, pattern)
+		}
+	}
+}
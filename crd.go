@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Config sources select where the config is read from. They can be chosen
+// with CONFIG_SOURCE.
+const (
+	configSourceConfigMap = "ConfigMap"
+	configSourceCRD       = "VClusterResourceQuota"
+)
+
+var quotaGVR = schema.GroupVersionResource{
+	Group:    "quota.preparesh.com",
+	Version:  "v1alpha1",
+	Resource: "vclusterresourcequotas",
+}
+
+// VClusterResourceQuota is a typed alternative to the ConfigMap, defined by
+// k8s-manifests/crd.yaml.
+type VClusterResourceQuota struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec VClusterResourceQuotaSpec `json:"spec"`
+}
+
+type VClusterResourceQuotaSpec struct {
+	LimitCPU    string `json:"limitCPU"`
+	LimitMemory string `json:"limitMemory"`
+	MaxPods     int    `json:"maxPods,omitempty"`
+}
+
+// data renders the spec as ConfigMap data, so both sources share parseConfig
+// and its validation.
+func (s VClusterResourceQuotaSpec) data() map[string]string {
+	data := map[string]string{
+		"limitCPU":    s.LimitCPU,
+		"limitMemory": s.LimitMemory,
+	}
+	if s.MaxPods > 0 {
+		data["maxPods"] = strconv.Itoa(s.MaxPods)
+	}
+	return data
+}
+
+func parseConfigSource(value string) (string, error) {
+	if value != configSourceConfigMap && value != configSourceCRD {
+		return "", fmt.Errorf("invalid config source %q, must be %s or %s", value, configSourceConfigMap, configSourceCRD)
+	}
+	return value, nil
+}
+
+// watchQuotaObject is the VClusterResourceQuota counterpart of the ConfigMap
+// informer in watchConfig.
+func (ctrl *Controller) watchQuotaObject(stopCh <-chan struct{}) error {
+	if ctrl.dynamicClient == nil {
+		return errNoClient
+	}
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(ctrl.dynamicClient, 0, ctrl.configMapNamespace, func(options *metav1.ListOptions) {
+		options.FieldSelector = fields.OneTermEqualSelector("metadata.name", ctrl.configMapName).String()
+	})
+
+	informer := factory.ForResource(quotaGVR).Informer()
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			ctrl.applyQuotaObject(obj)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			ctrl.applyQuotaObject(obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			slog.Warn("VClusterResourceQuota was deleted, keeping last known good config", "namespace", ctrl.configMapNamespace, "name", ctrl.configMapName)
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	factory.Start(stopCh)
+	return nil
+}
+
+func (ctrl *Controller) applyQuotaObject(obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	config, err := parseQuotaObject(u)
+	if err != nil {
+		slog.Error("Ignoring invalid config in VClusterResourceQuota", "namespace", u.GetNamespace(), "name", u.GetName(), "error", err)
+		return
+	}
+
+	ctrl.setConfig(config)
+	slog.Info("Applied config from VClusterResourceQuota", "namespace", u.GetNamespace(), "name", u.GetName(), "limitCPU", config.LimitCPU, "limitMemory", config.LimitMemory)
+}
+
+func (ctrl *Controller) fetchQuotaObject(ctx context.Context) (Config, error) {
+	if ctrl.dynamicClient == nil {
+		return Config{}, errNoClient
+	}
+	ctx, cancel := context.WithTimeout(ctx, ctrl.apiTimeout)
+	defer cancel()
+
+	var u *unstructured.Unstructured
+	err := retryTransient(ctx, func() (err error) {
+		u, err = ctrl.dynamicClient.Resource(quotaGVR).Namespace(ctrl.configMapNamespace).Get(ctx, ctrl.configMapName, metav1.GetOptions{})
+		return err
+	})
+	if err != nil {
+		return Config{}, err
+	}
+
+	config, err := parseQuotaObject(u)
+	if err != nil {
+		return Config{}, invalidConfig(err)
+	}
+	return config, nil
+}
+
+func parseQuotaObject(u *unstructured.Unstructured) (Config, error) {
+	var quota VClusterResourceQuota
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &quota); err != nil {
+		return Config{}, fmt.Errorf("invalid VClusterResourceQuota: %v", err)
+	}
+	return parseConfig(quota.Spec.data())
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+// useQuotaObjects makes VClusterResourceQuota objects the controller's config
+// source, served by a fake dynamic client.
+func useQuotaObjects(ctrl *Controller, objects ...runtime.Object) {
+	ctrl.configSource = configSourceCRD
+	ctrl.dynamicClient = dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{quotaGVR: "VClusterResourceQuotaList"}, objects...)
+}
+
+func testQuotaObject(name string, spec map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": quotaGVR.GroupVersion().String(),
+		"kind":       "VClusterResourceQuota",
+		"metadata":   map[string]interface{}{"name": name, "namespace": defaultConfigMapNamespace},
+		"spec":       spec,
+	}}
+}
+
+func TestFetchQuotaObject(t *testing.T) {
+	tests := []struct {
+		name    string
+		objects []runtime.Object
+		cpu     string
+		maxPods int
+		wantErr bool
+	}{
+		{"quota object", []runtime.Object{testQuotaObject(defaultConfigMapName, map[string]interface{}{"limitCPU": "3", "limitMemory": "3Gi", "maxPods": int64(5)})}, "3", 5, false},
+		{"other quota objects are ignored", []runtime.Object{testQuotaObject("other", map[string]interface{}{"limitCPU": "3", "limitMemory": "3Gi"})}, "", 0, true},
+		{"invalid limits", []runtime.Object{testQuotaObject(defaultConfigMapName, map[string]interface{}{"limitCPU": "lots", "limitMemory": "3Gi"})}, "", 0, true},
+		{"wrongly typed spec", []runtime.Object{testQuotaObject(defaultConfigMapName, map[string]interface{}{"limitCPU": "3", "limitMemory": "3Gi", "maxPods": "many"})}, "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The ConfigMap is there too, to tell which source was read.
+			ctrl := newAPIServerController(t, serveConfigMap(map[string]string{"limitCPU": "1", "limitMemory": "1Gi"}))
+			useQuotaObjects(ctrl, tt.objects...)
+
+			config, err := ctrl.fetchConfig(context.Background())
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("fetchConfig() = %+v, want an error", config)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fetchConfig() error = %v", err)
+			}
+			if config.LimitCPU != tt.cpu || config.MaxPods != tt.maxPods {
+				t.Errorf("config has limitCPU %q and maxPods %d, want %q and %d", config.LimitCPU, config.MaxPods, tt.cpu, tt.maxPods)
+			}
+		})
+	}
+}
+
+func TestQuotaObjectEnforced(t *testing.T) {
+	ctrl := newAPIServerController(t, servePods(*testPod("running", "tenant-a", "1", "1Gi")))
+	useQuotaObjects(ctrl, testQuotaObject(defaultConfigMapName, map[string]interface{}{"limitCPU": "2", "limitMemory": "2Gi"}))
+
+	resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("small", "tenant-a", "1", "512Mi"), nil))
+	if !resp.Allowed {
+		t.Fatalf("first pod denied: %v", resp.Result)
+	}
+	resp = ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("big", "tenant-a", "1", "512Mi"), nil))
+	if resp.Allowed {
+		t.Fatal("second pod allowed, want it denied by the quota object")
+	}
+	if want := "CPU limit exceeded: requested 1 on top of 2 used, limit is 2"; !strings.Contains(resp.Result.Message, want) {
+		t.Errorf("message = %q, want it to contain %q", resp.Result.Message, want)
+	}
+}
+
+func TestParseConfigSource(t *testing.T) {
+	for _, value := range []string{configSourceConfigMap, configSourceCRD} {
+		if got, err := parseConfigSource(value); err != nil || got != value {
+			t.Errorf("parseConfigSource(%q) = %q, %v", value, got, err)
+		}
+	}
+	if _, err := parseConfigSource("Secret"); err == nil {
+		t.Error("parseConfigSource() accepted Secret")
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const eventComponent = "vcluster-resource-quota-controller"
+
+func newEventRecorder(client kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent})
+}
+
+// emitRejectionEvent records a Warning Event in the object's namespace so
+// tenants can see why their pod or workload was rejected without access to the
+// webhook's logs.
+func (ctrl *Controller) emitRejectionEvent(namespace string, r *review, rejection error) {
+	if ctrl.eventRecorder == nil || r.target == nil || r.config == nil || !r.config.EmitEvents {
+		return
+	}
+
+	// The object does not exist yet, so the event references it by name.
+	ref := r.target.ref
+	ref.Namespace = namespace
+
+	ctrl.eventRecorder.Eventf(&ref, corev1.EventTypeWarning, "QuotaExceeded",
+		"%s rejected for tenant %q in namespace %s (%s): %v", ref.Kind, r.tenant, namespace, rejectionReason(rejection), rejection)
+}
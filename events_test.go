@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+)
+
+func TestEmitRejectionEvent(t *testing.T) {
+	config := Config{LimitCPU: "2", LimitMemory: "2Gi", QuotaScope: quotaScopeLimits, TenantLabelKey: defaultTenantLabelKey, UsagePhases: defaultUsagePhases, EmitEvents: true}
+	disabled := config
+	disabled.EmitEvents = false
+
+	tests := []struct {
+		name   string
+		config Config
+		cpu    string
+		event  string
+	}{
+		{"rejected pod", config, "3", `Warning QuotaExceeded Pod rejected for tenant "tenant-a" in namespace tenant-a-ns (cpu_exceeded): CPU limit exceeded`},
+		{"admitted pod", config, "1", ""},
+		{"events disabled", disabled, "3", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newAPIServerController(t, servePods())
+			recorder := useFakeRecorder(ctrl)
+			ctrl.setConfig(tt.config)
+			ar := podReview(t, admissionv1.Create, withResources(scopePod(), cpuMemory(tt.cpu, "1Gi"), cpuMemory(tt.cpu, "1Gi")), nil)
+			ctrl.processAdmissionReview(context.Background(), ar)
+
+			select {
+			case event := <-recorder.Events:
+				if tt.event == "" || !strings.HasPrefix(event, tt.event) {
+					t.Errorf("recorded event %q, want %q", event, tt.event)
+				}
+			default:
+				if tt.event != "" {
+					t.Errorf("no event recorded, want %q", tt.event)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+)
+
+// handleHealthz reports liveness. It never talks to the API server so that an
+// API outage does not get the webhook restarted.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// handleReadyz reports readiness once the client is initialized and a valid
+// config has been loaded at least once, so the webhook only receives traffic
+// when it can make correct decisions.
+func (ctrl *Controller) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if ctrl.client == nil || !ctrl.configLoaded() {
+		http.Error(w, "config not loaded", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleReadyz(t *testing.T) {
+	readyz := func(ctrl *Controller) int {
+		recorder := httptest.NewRecorder()
+		ctrl.handleReadyz(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return recorder.Code
+	}
+
+	if code := readyz(&Controller{}); code != http.StatusServiceUnavailable {
+		t.Errorf("without a client /readyz = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	ctrl := newTestController(map[string]string{"limitCPU": "2", "limitMemory": "2Gi"})
+	if code := readyz(ctrl); code != http.StatusServiceUnavailable {
+		t.Errorf("before the config is loaded /readyz = %d, want %d", code, http.StatusServiceUnavailable)
+	}
+	if _, err := ctrl.loadConfig(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if code := readyz(ctrl); code != http.StatusOK {
+		t.Errorf("after the config is loaded /readyz = %d, want %d", code, http.StatusOK)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	defaultLeaseName = "vcluster-resource-quota-controller"
+
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// leading reports whether this replica currently runs the leader tasks.
+var leading atomic.Bool
+
+var leaderGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "leader",
+	Help: "Whether this replica is the leader and runs background tasks.",
+})
+
+func init() {
+	prometheus.MustRegister(leaderGauge)
+}
+
+// runLeaderTasks runs the background tasks that must only run on one replica.
+// Without leader election every replica leads. With it, the tasks run while
+// the Lease is held and stop when it is lost, after which the replica tries to
+// acquire it again, backing off if it keeps losing it. Admission is served by
+// all replicas regardless. The Lease is kept in POD_NAMESPACE, or in namespace
+// if that is unset.
+func runLeaderTasks(ctx context.Context, client kubernetes.Interface, enabled bool, namespace string, tasks ...func(context.Context)) {
+	if !enabled {
+		setLeading(true)
+		for _, task := range tasks {
+			go task(ctx)
+		}
+		return
+	}
+
+	identity := os.Getenv("POD_NAME")
+	if identity == "" {
+		identity, _ = os.Hostname()
+	}
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      getEnv("LEASE_NAME", defaultLeaseName),
+			Namespace: getEnv("POD_NAMESPACE", namespace),
+		},
+		Client:     client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+
+	electionConfig := leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				slog.Info("Acquired leadership", "identity", identity)
+				setLeading(true)
+				for _, task := range tasks {
+					go task(ctx)
+				}
+			},
+			OnStoppedLeading: func() {
+				slog.Info("Lost leadership", "identity", identity)
+				setLeading(false)
+			},
+		},
+	}
+
+	go newBackoffLoop(reconnectBackoff).run(ctx, func(ctx context.Context) {
+		leaderelection.RunOrDie(ctx, electionConfig)
+	})
+}
+
+func setLeading(value bool) {
+	leading.Store(value)
+	if value {
+		leaderGauge.Set(1)
+	} else {
+		leaderGauge.Set(0)
+	}
+}
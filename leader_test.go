@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// startedTask returns a task that reports its context on the channel.
+func startedTask() (func(context.Context), chan context.Context) {
+	started := make(chan context.Context, 1)
+	return func(ctx context.Context) { started <- ctx }, started
+}
+
+func waitForLeading(t *testing.T, want bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for leading.Load() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("leading = %v, want %v", !want, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunLeaderTasksWithoutElection(t *testing.T) {
+	t.Cleanup(func() { setLeading(false) })
+	task, started := startedTask()
+
+	runLeaderTasks(context.Background(), nil, false, defaultConfigMapNamespace, task)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("task did not start without leader election")
+	}
+	if !leading.Load() {
+		t.Error("replica does not lead without leader election")
+	}
+}
+
+func TestRunLeaderTasksWithElection(t *testing.T) {
+	t.Cleanup(func() { setLeading(false) })
+	t.Setenv("POD_NAME", "replica-1")
+	t.Setenv("POD_NAMESPACE", "quota-system")
+	client := fake.NewSimpleClientset()
+	task, started := startedTask()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runLeaderTasks(ctx, client, true, defaultConfigMapNamespace, task)
+
+	var taskCtx context.Context
+	select {
+	case taskCtx = <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("task did not start after acquiring the Lease")
+	}
+	waitForLeading(t, true)
+	lease, err := client.CoordinationV1().Leases("quota-system").Get(context.Background(), defaultLeaseName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("get Lease: %v", err)
+	}
+	if holder := lease.Spec.HolderIdentity; holder == nil || *holder != "replica-1" {
+		t.Errorf("Lease is held by %v, want replica-1", holder)
+	}
+
+	// Stopping releases the Lease and the tasks' context.
+	cancel()
+	select {
+	case <-taskCtx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("task context was not cancelled")
+	}
+	waitForLeading(t, false)
+}
+
+func TestRunLeaderTasksLeaseHeldElsewhere(t *testing.T) {
+	t.Cleanup(func() { setLeading(false) })
+	t.Setenv("POD_NAME", "replica-2")
+	t.Setenv("POD_NAMESPACE", "quota-system")
+	holder, duration := "replica-1", int32(60)
+	now := metav1.NewMicroTime(time.Now())
+	client := fake.NewSimpleClientset(&coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: defaultLeaseName, Namespace: "quota-system"},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &duration,
+			AcquireTime:          &now,
+			RenewTime:            &now,
+		},
+	})
+	task, started := startedTask()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runLeaderTasks(ctx, client, true, defaultConfigMapNamespace, task)
+
+	select {
+	case <-started:
+		t.Fatal("task started while another replica holds the Lease")
+	case <-time.After(500 * time.Millisecond):
+	}
+	if leading.Load() {
+		t.Error("replica leads while another replica holds the Lease")
+	}
+}
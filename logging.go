@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+)
+
+// setupLogging installs the default slog logger from LOG_LEVEL and LOG_FORMAT.
+// JSON is the default so rejections can be queried in log aggregation; text
+// is easier to read for local runs.
+func setupLogging() error {
+	var level slog.Level
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		if err := level.UnmarshalText([]byte(value)); err != nil {
+			return fmt.Errorf("invalid LOG_LEVEL %q: %v", value, err)
+		}
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch format := strings.ToLower(getEnv("LOG_FORMAT", logFormatJSON)); format {
+	case logFormatJSON:
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	case logFormatText:
+		handler = slog.NewTextHandler(os.Stderr, options)
+	default:
+		return fmt.Errorf("invalid LOG_FORMAT %q, must be %s or %s", format, logFormatJSON, logFormatText)
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// fatal logs an error and exits, the slog counterpart of log.Fatal.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// logDecision records the outcome of an admission request in one line naming
+// the object, so that a single apply can be traced. Rejections are logged at
+// info level, allowed requests only at debug level.
+func (ctrl *Controller) logDecision(ctx context.Context, namespace string, r *review, rejection error) {
+	decision, rejection := decisionOf(r, rejection)
+	level := slog.LevelDebug
+	if rejection != nil {
+		level = slog.LevelInfo
+	}
+	if !slog.Default().Enabled(ctx, level) {
+		return
+	}
+
+	suppressed := 0
+	if rejection != nil && r.config != nil && r.config.RejectionLogInterval > 0 {
+		key := namespace + "/" + r.tenant + "/" + rejectionReason(rejection)
+		var ok bool
+		if ok, suppressed = ctrl.rejectionLogs.allow(key, r.config.RejectionLogInterval, time.Now()); !ok {
+			return
+		}
+	}
+
+	attrs := []slog.Attr{
+		slog.String("namespace", namespace),
+	}
+	// Pods created from a generateName are named after the prefix.
+	if r.target != nil {
+		attrs = append(attrs, slog.String("kind", r.target.ref.Kind), slog.String("name", r.target.ref.Name))
+	}
+	attrs = append(attrs, slog.String("tenant", r.tenant))
+	if r.team != "" {
+		attrs = append(attrs, slog.String("team", r.team))
+	}
+	attrs = append(attrs, slog.String("decision", decision))
+	if rejection != nil {
+		attrs = append(attrs, slog.String("reason", rejectionReason(rejection)), slog.String("message", rejection.Error()))
+	}
+	if suppressed > 0 {
+		attrs = append(attrs, slog.Int("suppressed", suppressed))
+	}
+	if r.target != nil && r.config != nil {
+		usage := r.target.usage(*r.config)
+		attrs = append(attrs, slog.Group("usage",
+			slog.Any("limits", resourceListStrings(usage.Limits)),
+			slog.Any("requests", resourceListStrings(usage.Requests)),
+			slog.Int("pods", usage.Pods)))
+	}
+	slog.LogAttrs(ctx, level, "admission decision", attrs...)
+}
+
+// rejectionLogLimiter holds one token per key that refills once per interval,
+// counting the rejections that found it empty.
+type rejectionLogLimiter struct {
+	mu      sync.Mutex
+	entries map[string]*rejectionLogEntry
+}
+
+type rejectionLogEntry struct {
+	next       time.Time
+	suppressed int
+}
+
+// rejectionLogMaxEntries bounds the limiter; once reached, entries whose
+// interval has passed are dropped, and the oldest one if none has.
+const rejectionLogMaxEntries = 1000
+
+func newRejectionLogLimiter() *rejectionLogLimiter {
+	return &rejectionLogLimiter{entries: map[string]*rejectionLogEntry{}}
+}
+
+// allow reports whether a rejection for key may be logged at now and, if so,
+// how many were suppressed since the last one that was.
+func (l *rejectionLogLimiter) allow(key string, interval time.Duration, now time.Time) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.entries[key]
+	if ok && now.Before(entry.next) {
+		entry.suppressed++
+		return false, 0
+	}
+	if !ok {
+		if len(l.entries) >= rejectionLogMaxEntries {
+			oldest := ""
+			for k, e := range l.entries {
+				if !now.Before(e.next) {
+					delete(l.entries, k)
+				} else if oldest == "" || e.next.Before(l.entries[oldest].next) {
+					oldest = k
+				}
+			}
+			if len(l.entries) >= rejectionLogMaxEntries {
+				delete(l.entries, oldest)
+			}
+		}
+		entry = &rejectionLogEntry{}
+		l.entries[key] = entry
+	}
+
+	suppressed := entry.suppressed
+	entry.next = now.Add(interval)
+	entry.suppressed = 0
+	return true, suppressed
+}
+
+// decisionOf names the outcome of a request: "allowed", "denied", or
+// "would_deny" for a rejection that audit mode let through. It also returns
+// the rejection behind a "denied" or "would_deny".
+func decisionOf(r *review, rejection error) (string, error) {
+	if rejection != nil {
+		return "denied", rejection
+	}
+	if r.audited != nil {
+		return "would_deny", r.audited
+	}
+	return "allowed", nil
+}
+
+// resourceListStrings renders quantities in their canonical form, which both
+// handlers print the same way.
+func resourceListStrings(list corev1.ResourceList) map[string]string {
+	values := make(map[string]string, len(list))
+	for name, quantity := range list {
+		values[string(name)] = quantity.String()
+	}
+	return values
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestRejectionLogLimiter(t *testing.T) {
+	limiter := &rejectionLogLimiter{entries: map[string]*rejectionLogEntry{}}
+	start := time.Now()
+
+	steps := []struct {
+		key        string
+		at         time.Duration
+		allowed    bool
+		suppressed int
+	}{
+		{"ns/tenant-a/cpu_exceeded", 0, true, 0},
+		{"ns/tenant-a/cpu_exceeded", time.Second, false, 0},
+		{"ns/tenant-a/cpu_exceeded", 2 * time.Second, false, 0},
+		{"ns/tenant-a/memory_exceeded", 3 * time.Second, true, 0},
+		{"ns/tenant-b/cpu_exceeded", 3 * time.Second, true, 0},
+		{"ns/tenant-a/cpu_exceeded", time.Minute, true, 2},
+		{"ns/tenant-a/cpu_exceeded", time.Minute + time.Second, false, 0},
+	}
+	for _, step := range steps {
+		allowed, suppressed := limiter.allow(step.key, time.Minute, start.Add(step.at))
+		if allowed != step.allowed || suppressed != step.suppressed {
+			t.Errorf("allow(%s) at %s = %v, %d, want %v, %d", step.key, step.at, allowed, suppressed, step.allowed, step.suppressed)
+		}
+	}
+}
+
+func TestRejectionLogLimiterBounded(t *testing.T) {
+	limiter := &rejectionLogLimiter{entries: map[string]*rejectionLogEntry{}}
+	start := time.Now()
+
+	// None of the entries expires while the limiter fills up and overflows.
+	for i := 0; i < 2*rejectionLogMaxEntries; i++ {
+		if allowed, _ := limiter.allow(fmt.Sprintf("key-%d", i), time.Hour, start.Add(time.Duration(i)*time.Millisecond)); !allowed {
+			t.Fatalf("first rejection for key-%d was suppressed", i)
+		}
+		if len(limiter.entries) > rejectionLogMaxEntries {
+			t.Fatalf("limiter holds %d entries, more than %d", len(limiter.entries), rejectionLogMaxEntries)
+		}
+	}
+	if _, ok := limiter.entries["key-0"]; ok {
+		t.Error("the oldest entry was kept")
+	}
+	if _, ok := limiter.entries[fmt.Sprintf("key-%d", 2*rejectionLogMaxEntries-1)]; !ok {
+		t.Error("the newest entry was dropped")
+	}
+}
+
+func TestLogDecisionCoalescesRejections(t *testing.T) {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	ctrl := newController(nil)
+
+	config := Config{RejectionLogInterval: time.Hour}
+	r := &review{tenant: "tenant-coalesced", config: &config}
+	for i := 0; i < 3; i++ {
+		ctrl.logDecision(context.Background(), testNamespace, r, newRejection(reasonMaxPods, "pod limit exceeded"))
+	}
+	if lines := strings.Count(buf.String(), "admission decision"); lines != 1 {
+		t.Errorf("logged %d rejections, want 1:\n%s", lines, buf.String())
+	}
+}
+
+func TestLogDecisionFields(t *testing.T) {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	generated := testPod("", "tenant-log", "3", "1Gi")
+	generated.GenerateName = "web-"
+	tests := []struct {
+		name     string
+		pod      *corev1.Pod
+		wantName string
+		decision string
+		reason   string
+	}{
+		{"named pod", testPod("api", "tenant-log", "500m", "512Mi"), "api", "allowed", ""},
+		{"pod named by generateName", generated, "web", "denied", "cpu_exceeded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			ctrl := newTestController(map[string]string{"limitCPU": "2", "limitMemory": "2Gi"})
+			ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+
+			var lines []map[string]interface{}
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				var entry map[string]interface{}
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatalf("log line %q is not JSON: %v", line, err)
+				}
+				if entry["msg"] == "admission decision" {
+					lines = append(lines, entry)
+				}
+			}
+			if len(lines) != 1 {
+				t.Fatalf("logged %d decisions, want 1:\n%s", len(lines), buf.String())
+			}
+
+			entry := lines[0]
+			want := map[string]interface{}{"namespace": testNamespace, "kind": "Pod", "name": tt.wantName, "tenant": "tenant-log", "decision": tt.decision}
+			if tt.reason != "" {
+				want["reason"] = tt.reason
+			}
+			for key, value := range want {
+				if entry[key] != value {
+					t.Errorf("%s = %v, want %v", key, entry[key], value)
+				}
+			}
+		})
+	}
+}
@@ -3,12 +3,22 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -16,34 +26,149 @@ import (
 
 	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
-const configMapName = "vcluster-resource-quota-controller-config"
-const configMapNamespace = "default"
+// bypassAnnotation exempts a pod from the quota when set to "true" by a user
+// listed in bypassUsers.
+const bypassAnnotation = "vcluster-resource-quota-controller/bypass"
 
-var clientset *kubernetes.Clientset
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate-config" {
+		os.Exit(runValidateConfig(os.Args[2:], os.Stdout, os.Stderr))
+	}
 
-type Config struct {
-	LimitCPU    string `json:"limitCPU"`
-	LimitMemory string `json:"limitMemory"`
-}
+	if err := setupLogging(); err != nil {
+		fatal("Error configuring logging", err)
+	}
+	slog.Info("Starting vcluster-resource-quota-controller", "version", version, "commit", gitCommit)
 
-func main() {
 	// Initialize the Kubernetes client
-	var err error
-	clientset, err = initKubernetesClient()
+	restConfig, err := loadRestConfig()
 	if err != nil {
-		log.Fatalf("Error initializing Kubernetes client: %v", err)
+		fatal("Error loading Kubernetes client config", err)
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		fatal("Error initializing Kubernetes client", err)
+	}
+	controller := newController(client)
+	controller.eventRecorder = newEventRecorder(client)
+
+	if value := os.Getenv("API_TIMEOUT"); value != "" {
+		controller.apiTimeout, err = time.ParseDuration(value)
+		if err != nil {
+			fatal("Error reading API_TIMEOUT", err)
+		}
+	}
+
+	if value := os.Getenv("CONFIG_CHECK_INTERVAL"); value != "" {
+		configCheckInterval, err = time.ParseDuration(value)
+		if err != nil {
+			fatal("Error reading CONFIG_CHECK_INTERVAL", err)
+		}
+	}
+
+	if value := os.Getenv("FAILURE_POLICY"); value != "" {
+		controller.failurePolicy, err = parseFailurePolicy(value)
+		if err != nil {
+			fatal("Error reading FAILURE_POLICY", err)
+		}
 	}
 
-	http.HandleFunc("/validate", handleAdmission)
-	log.Println("Starting server on :8443...")
-	log.Fatal(http.ListenAndServeTLS(":8443", "/etc/webhook/certs/tls.crt", "/etc/webhook/certs/tls.key", nil))
+	if value := os.Getenv("MAX_REQUEST_BODY_BYTES"); value != "" {
+		maxRequestBodyBytes, err = strconv.ParseInt(value, 10, 64)
+		if err == nil && maxRequestBodyBytes <= 0 {
+			err = fmt.Errorf("must be positive, got %d", maxRequestBodyBytes)
+		}
+		if err != nil {
+			fatal("Error reading MAX_REQUEST_BODY_BYTES", err)
+		}
+	}
+
+	if path := os.Getenv("AUDIT_LOG"); path != "" {
+		controller.auditLog, err = newAuditSink(path)
+		if err != nil {
+			fatal("Error opening AUDIT_LOG", err)
+		}
+	}
+
+	leaderElection := false
+	if value := os.Getenv("ENABLE_LEADER_ELECTION"); value != "" {
+		leaderElection, err = strconv.ParseBool(value)
+		if err != nil {
+			fatal("Error reading ENABLE_LEADER_ELECTION", err)
+		}
+	}
+
+	if value := os.Getenv("CONFIG_SOURCE"); value != "" {
+		controller.configSource, err = parseConfigSource(value)
+		if err != nil {
+			fatal("Error reading CONFIG_SOURCE", err)
+		}
+	}
+	controller.configFile = os.Getenv("CONFIG_FILE")
+	if controller.configFile == "" && controller.configSource == configSourceCRD {
+		controller.dynamicClient, err = dynamic.NewForConfig(restConfig)
+		if err != nil {
+			fatal("Error initializing dynamic client", err)
+		}
+	}
+
+	controller.configMapName = getEnv("CONFIG_MAP_NAME", defaultConfigMapName)
+	controller.configMapNamespace = getEnv("CONFIG_MAP_NAMESPACE", defaultConfigMapNamespace)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	if err := controller.watchConfig(ctx.Done()); err != nil {
+		fatal("Error watching config", err)
+	}
+	tenantLabelKey := defaultTenantLabelKey
+	if config, err := controller.loadConfig(ctx); err == nil {
+		tenantLabelKey = config.TenantLabelKey
+	}
+	controller.startPodInformer(tenantLabelKey, ctx.Done())
+	controller.startNamespaceInformers(ctx.Done())
+	go controller.watchNodeAllocatable(ctx)
+	go controller.watchConfigValidity(ctx)
+	runLeaderTasks(ctx, client, leaderElection, controller.configMapNamespace, controller.runReconciler)
+
+	controller.registerHandlers(http.DefaultServeMux)
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/version", handleVersion)
+	http.Handle("/metrics", promhttp.Handler())
+
+	serverConfig, err := loadServerConfig()
+	if err != nil {
+		fatal("Error reading server config", err)
+	}
+	certs, err := newCertReloader(serverConfig.CertFile, serverConfig.KeyFile)
+	if err != nil {
+		fatal("Error loading TLS certificate", err)
+	}
+	if err := certs.watch(ctx); err != nil {
+		fatal("Error watching TLS certificate", err)
+	}
+
+	tlsConfig, err := serverConfig.tlsConfig(certs.GetCertificate)
+	if err != nil {
+		fatal("Error loading TLS client CA", err)
+	}
+
+	server := &http.Server{
+		Addr:      serverConfig.ListenAddr,
+		TLSConfig: tlsConfig,
+	}
+	slog.Info("Starting server", "addr", serverConfig.ListenAddr)
+	if err := serve(ctx, server, shutdownTimeout); err != nil {
+		fatal("Server failed", err)
+	}
 }
 
-func initKubernetesClient() (*kubernetes.Clientset, error) {
+func loadRestConfig() (*rest.Config, error) {
 	var config *rest.Config
 	var err error
 
@@ -58,43 +183,55 @@ func initKubernetesClient() (*kubernetes.Clientset, error) {
 		}
 	}
 
-	return kubernetes.NewForConfig(config)
+	return config, nil
 }
 
-func loadConfig() (Config, error) {
-	cm, err := clientset.CoreV1().ConfigMaps(configMapNamespace).Get(context.TODO(), configMapName, metav1.GetOptions{})
-	if err != nil {
-		return Config{}, err
-	}
-
-	config := Config{
-		LimitCPU:    cm.Data["limitCPU"],
-		LimitMemory: cm.Data["limitMemory"],
-	}
-
-	return config, nil
+func (ctrl *Controller) handleAdmission(w http.ResponseWriter, r *http.Request) {
+	serveAdmissionReview(w, r, ctrl.processAdmissionReview)
 }
 
-func handleAdmission(w http.ResponseWriter, r *http.Request) {
-	var admissionReviewRequest admissionv1.AdmissionReview
-	body, err := ioutil.ReadAll(r.Body)
+// serveAdmissionReview decodes the AdmissionReview in the request, hands it to
+// process and writes the response in the version the request was sent in.
+// Only bodies that cannot be read or are not JSON at all get an HTTP error;
+// any other malformed review is answered with a denying AdmissionReview, which
+// the API server reports to the user instead of a generic webhook failure.
+func serveAdmissionReview(w http.ResponseWriter, r *http.Request, process func(context.Context, admissionv1.AdmissionReview) *admissionv1.AdmissionResponse) {
+	start := time.Now()
+	defer func() {
+		admissionDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodyBytes))
 	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("request body exceeds %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "could not read request body", http.StatusBadRequest)
 		return
 	}
 
-	if err := json.Unmarshal(body, &admissionReviewRequest); err != nil {
-		http.Error(w, "could not unmarshal request", http.StatusBadRequest)
+	if !json.Valid(body) {
+		http.Error(w, "request body is not valid JSON", http.StatusBadRequest)
 		return
 	}
 
-	admissionResponse := processAdmissionReview(admissionReviewRequest)
-	admissionReviewResponse := admissionv1.AdmissionReview{
-		TypeMeta: admissionReviewRequest.TypeMeta,
-		Response: admissionResponse,
+	var admissionResponse *admissionv1.AdmissionResponse
+	admissionReviewRequest, apiVersion, err := decodeAdmissionReview(body)
+	if err != nil {
+		var rejection error
+		admissionResponse, rejection = deny(&admissionv1.AdmissionResponse{UID: requestUID(body)},
+			newRejection(reasonInvalidObject, "could not decode admission review: %v", err))
+		recordDecision(rejection)
+		if apiVersion == "" {
+			apiVersion = admissionv1.SchemeGroupVersion.String()
+		}
+	} else {
+		admissionResponse = process(r.Context(), admissionReviewRequest)
 	}
 
-	respBytes, err := json.Marshal(admissionReviewResponse)
+	respBytes, err := encodeAdmissionReview(apiVersion, admissionResponse)
 	if err != nil {
 		http.Error(w, "could not marshal response", http.StatusInternalServerError)
 		return
@@ -104,94 +241,595 @@ func handleAdmission(w http.ResponseWriter, r *http.Request) {
 	w.Write(respBytes)
 }
 
-func processAdmissionReview(ar admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
-	podResource := "pods"
-	if ar.Request.Resource.Resource != podResource {
-		return &admissionv1.AdmissionResponse{Allowed: true}
+func (ctrl *Controller) processAdmissionReview(ctx context.Context, ar admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
+	if ar.Request == nil {
+		admissionResponse, rejection := deny(&admissionv1.AdmissionResponse{}, newRejection(reasonInvalidObject, "admission review contains no request"))
+		recordDecision(rejection)
+		return admissionResponse
+	}
+
+	var r review
+	admissionResponse, rejection := ctrl.reviewWithDeadline(ctx, ar, &r)
+
+	if rejection != nil && r.config != nil && admissionResponse.Result != nil {
+		admissionResponse.Result.Message = r.config.rejectionMessage(admissionResponse.Result.Message)
+	}
+
+	// In audit mode rejections are only reported and the request goes through
+	// with the warnings it would have got had it been allowed.
+	if rejection != nil && r.config != nil && r.config.AuditMode {
+		r.audited = rejection
+		var warnings []string
+		if r.target != nil && r.used != nil && r.quota != nil {
+			warnings = quotaWarnings(r.target.usage(*r.config), *r.used, *r.quota, r.config.WarnThresholdPercent)
+		}
+		warnings = append(warnings, fmt.Sprintf("would have been rejected: %v", rejection))
+		admissionResponse = &admissionv1.AdmissionResponse{Allowed: true, Warnings: warnings}
+		rejection = nil
+	}
+	admissionResponse.UID = ar.Request.UID
+	if r.target != nil {
+		admissionResponse.AuditAnnotations = auditAnnotations(&r, rejection)
+	}
+
+	// Dry-run requests get the same decision but must not have side effects.
+	if !isDryRun(ar.Request) {
+		recordDecision(rejection)
+		recordAudit(r.audited)
+		ctrl.auditLog.record(ar.Request, &r, rejection)
+		recordTenantUsage(ar.Request.Namespace, &r, admissionResponse.Allowed, ar.Request.Operation == admissionv1.Update)
+		ctrl.logDecision(ctx, ar.Request.Namespace, &r, rejection)
+		if rejection != nil {
+			ctrl.emitRejectionEvent(ar.Request.Namespace, &r, rejection)
+		} else if r.tenant != "" && r.target != nil && ar.Request.Operation != admissionv1.Update && !r.target.workload() {
+			ctrl.admissions.add(ar.Request.Namespace, teamKey(r.tenant, r.team), r.target.pod.Name, podUsage(r.target.pod, *r.config))
+		}
+	}
+
+	return admissionResponse
+}
+
+// review collects what is learned about a request while it is decided, for use
+// by the side effects that follow the decision.
+type review struct {
+	target  *admissionTarget
+	tenant  string
+	team    string
+	config  *Config
+	audited error
+
+	// used is the tenant's usage before the request and quota its quota, once
+	// they are known.
+	used  *Usage
+	quota *Quota
+}
+
+// reviewWithDeadline runs reviewPod within the config's maxProcessingTime. If
+// the deadline passes first the request is decided by the timeout policy, so
+// the outcome does not depend on whether the API server times out first.
+func (ctrl *Controller) reviewWithDeadline(ctx context.Context, ar admissionv1.AdmissionReview, r *review) (*admissionv1.AdmissionResponse, error) {
+	config, err := ctrl.loadConfig(ctx)
+	if err != nil || config.MaxProcessingTime <= 0 {
+		return ctrl.reviewPod(ctx, ar, r)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.MaxProcessingTime)
+	defer cancel()
+
+	// The review runs on its own copy, which is only handed over when it
+	// completes in time.
+	type result struct {
+		response  *admissionv1.AdmissionResponse
+		rejection error
+		review    review
+	}
+	done := make(chan result, 1)
+	go func() {
+		var inner review
+		response, rejection := ctrl.reviewPod(ctx, ar, &inner)
+		done <- result{response, rejection, inner}
+	}()
+
+	select {
+	case res := <-done:
+		*r = res.review
+		return res.response, res.rejection
+	case <-ctx.Done():
+		r.config = &config
+		return failureResponse(config.timeoutPolicy(ctrl.failurePolicy), reasonTimeout, fmt.Sprintf("could not decide within maxProcessingTime of %s", config.MaxProcessingTime))
+	}
+}
+
+// reviewPod decides whether the pod, or the workload whose pod template is in
+// the review, is admitted. The returned error is the reason for a denial and
+// is nil when the object is allowed.
+func (ctrl *Controller) reviewPod(ctx context.Context, ar admissionv1.AdmissionReview, r *review) (*admissionv1.AdmissionResponse, error) {
+	pvc := schema.GroupVersionResource(ar.Request.Resource) == pvcResource
+	if !reviewedSubresource(ar.Request.Resource, ar.Request.SubResource) || !(pvc || reviewedResource(ar.Request.Resource)) {
+		return &admissionv1.AdmissionResponse{Allowed: true}, nil
 	}
 
-	var pod corev1.Pod
-	if err := json.Unmarshal(ar.Request.Object.Raw, &pod); err != nil {
-		return &admissionv1.AdmissionResponse{Result: &metav1.Status{Message: "could not unmarshal pod object"}, Allowed: false}
+	if ctrl.client == nil {
+		slog.Error("Cannot review request, the controller has no Kubernetes client", "namespace", ar.Request.Namespace, "name", ar.Request.Name)
+		return failureResponse(ctrl.failurePolicy, reasonConfigError, "controller is not initialized")
+	}
+	if pvc {
+		return ctrl.reviewPVC(ctx, ar, r)
 	}
 
-	config, err := loadConfig()
+	resource := ar.Request.Resource.Resource
+
+	target, err := decodeTarget(resource, ar.Request.Object.Raw)
 	if err != nil {
-		return &admissionv1.AdmissionResponse{Result: &metav1.Status{Message: fmt.Sprintf("could not load config: %v", err)}, Allowed: false}
+		return deny(&admissionv1.AdmissionResponse{}, newRejection(reasonInvalidObject, "%v", err))
 	}
+	r.target = &target
+	pod := target.pod
 
-	admissionResponse := &admissionv1.AdmissionResponse{UID: ar.Request.UID}
+	config, err := ctrl.loadConfig(ctx)
+	if err != nil {
+		return failureResponse(ctrl.failurePolicy, reasonConfigError, fmt.Sprintf("could not load config: %v", err))
+	}
+	r.config = &config
+
+	if config.namespaceExcluded(ar.Request.Namespace) {
+		return &admissionv1.AdmissionResponse{Allowed: true}, nil
+	}
 
-	if managedBy, ok := pod.Labels["vcluster.loft.sh/managed-by"]; ok {
-		totalCPUUsage, totalMemoryUsage, err := calculateResourceUsage(ar.Request.Namespace, managedBy)
+	// The annotation alone is ignored so tenants cannot exempt themselves.
+	if pod.Annotations[bypassAnnotation] == "true" && config.bypassAllowed(ar.Request.UserInfo) {
+		slog.Info("Bypassing quota", "namespace", ar.Request.Namespace, "user", ar.Request.UserInfo.Username)
+		return &admissionv1.AdmissionResponse{Allowed: true}, nil
+	}
+
+	admissionResponse := &admissionv1.AdmissionResponse{}
+
+	managedBy, ok, err := resolveTenant(ar.Request, config, pod.Labels, "pods")
+	r.tenant = managedBy
+	if err != nil {
+		return deny(admissionResponse, err)
+	}
+	if ok {
+		team := config.podTeam(pod.Labels)
+		r.team = team
+		config = config.forTenant(managedBy).forTeam(managedBy, team)
+		config, err = config.withNamespaceQuota(ctx, ctrl, ar.Request.Namespace)
+		if err != nil {
+			return failureResponse(config.failurePolicy(ctrl.failurePolicy), reasonConfigError, fmt.Sprintf("could not get namespace quota: %v", err))
+		}
+		config, err = config.withResourceQuota(ctx, ctrl, ar.Request.Namespace)
 		if err != nil {
-			admissionResponse.Result = &metav1.Status{Message: fmt.Sprintf("could not list pods: %v", err)}
-			admissionResponse.Allowed = false
-			return admissionResponse
+			return failureResponse(config.failurePolicy(ctrl.failurePolicy), reasonListFailed, fmt.Sprintf("could not get ResourceQuota: %v", err))
+		}
+		config, err = config.withNodeAllocatable(ctx, ctrl)
+		if err != nil {
+			return failureResponse(config.failurePolicy(ctrl.failurePolicy), reasonListFailed, fmt.Sprintf("could not get node allocatable: %v", err))
 		}
 
-		cpuLimit := resource.MustParse(config.LimitCPU)
-		memLimit := resource.MustParse(config.LimitMemory)
+		// On update the old object is already part of the tenant's usage, so
+		// it is left out of the sum and replaced by the new spec. Updates that
+		// leave the resources untouched, such as label changes, are not
+		// validated again.
+		update := ar.Request.Operation == admissionv1.Update
+		var old admissionTarget
+		if update {
+			old, err = decodeTarget(resource, ar.Request.OldObject.Raw)
+			if err != nil {
+				return deny(admissionResponse, newRejection(reasonInvalidObject, "old object: %v", err))
+			}
+			if target.usage(config).equal(old.usage(config)) {
+				admissionResponse.Allowed = true
+				return admissionResponse, nil
+			}
+		}
 
+		quota, err := parseQuota(config)
+		if err != nil {
+			return failureResponse(config.failurePolicy(ctrl.failurePolicy), reasonConfigError, fmt.Sprintf("invalid quota in config: %v", err))
+		}
+		r.quota = &quota
+
+		// A workload's pods are not matched one by one, so on update the old
+		// template's share is taken off the listed usage instead.
+		var replaced *corev1.Pod
+		if update && !target.workload() {
+			replaced = old.pod
+		}
+		usage, err := ctrl.calculateResourceUsage(ctx, ar.Request.Namespace, managedBy, team, config, replaced)
+		if err != nil {
+			return failureResponse(config.failurePolicy(ctrl.failurePolicy), reasonListFailed, fmt.Sprintf("could not list pods: %v", err))
+		}
+		if update && target.workload() {
+			usage.sub(old.usage(config))
+		}
+		used := usage.clone()
+		r.used = &used
+
+		// A pod update never adds a pod, but a workload update is charged
+		// its new replicas on top of the usage without the old ones, unless
+		// it only shrinks the workload.
+		shrinks := update && target.usage(config).within(old.usage(config))
+		if (!update || target.workload()) && !shrinks && config.MaxPods > 0 && usage.Pods+target.replicas > config.MaxPods {
+			return deny(admissionResponse, newRejection(reasonMaxPods, "pod limit exceeded: tenant already has %d pods, %d more would exceed the limit of %d", usage.Pods, target.replicas, config.MaxPods))
+		}
+
+		// BestEffort pods reserve no CPU or memory, so with a cap configured
+		// they are counted against it instead of the CPU and memory quota.
+		// Everything else they use, such as GPUs or ephemeral storage, is
+		// still checked. The full quota stays in r.quota for the metrics.
+		if config.MaxBestEffortPods > 0 && podQOSClass(pod) == corev1.PodQOSBestEffort {
+			if usage.BestEffortPods+target.replicas > config.MaxBestEffortPods {
+				return deny(admissionResponse, newRejection(reasonMaxBestEffortPods, "BestEffort pod limit exceeded: tenant already has %d BestEffort pods, %d more would exceed the limit of %d",
+					usage.BestEffortPods, target.replicas, config.MaxBestEffortPods))
+			}
+			full := quota
+			r.quota = &full
+			quota = quota.without(corev1.ResourceCPU, corev1.ResourceMemory)
+			config.RequireLimitsAndRequests = false
+		}
+
+		if !update && config.BlockOverQuota {
+			if exceeded := overQuota(usage, quota, config.MaxPods); len(exceeded) > 0 {
+				return deny(admissionResponse, newRejection(reasonOverQuota, "tenant %q is already over quota (%s), new pods are rejected until its usage drops below the quota",
+					managedBy, strings.Join(exceeded, "; ")))
+			}
+		}
+
+		// Init containers, sidecars among them, are only held to the maximum
+		// and to their own limits, as they do not need to set resources.
+		// Ephemeral containers cannot set resources in the API server, so
+		// when they are counted they are only held to the maximum.
+		for _, container := range pod.Spec.InitContainers {
+			if err := validateInitContainer(container, config, quota); err != nil {
+				return deny(admissionResponse, err)
+			}
+		}
 		for _, container := range pod.Spec.Containers {
-			if err := validateResource(container.Resources, totalCPUUsage, totalMemoryUsage, cpuLimit, memLimit); err != nil {
-				admissionResponse.Result = &metav1.Status{Message: err.Error()}
-				admissionResponse.Allowed = false
-				return admissionResponse
+			if err := validateContainer(container, config, quota); err != nil {
+				return deny(admissionResponse, err)
+			}
+		}
+		if config.CountEphemeralContainers {
+			for _, ephemeral := range pod.Spec.EphemeralContainers {
+				container := corev1.Container{Name: ephemeral.Name, Resources: ephemeral.Resources}
+				if err := validateContainerMax(container, quota); err != nil {
+					return deny(admissionResponse, err)
+				}
+			}
+		}
+
+		// An update that only shrinks the object passes even if the tenant
+		// is over quota, so that it can recover by scaling down.
+		charge := target.usage(config)
+		warnings := quotaWarnings(charge, usage, quota, config.WarnThresholdPercent)
+		if !shrinks {
+			if err := validateResource(charge, &usage, quota); err != nil {
+				return deny(admissionResponse, err)
 			}
 		}
+		admissionResponse.Warnings = warnings
 	}
 
 	admissionResponse.Allowed = true
-	return admissionResponse
+	return admissionResponse, nil
+}
+
+// resolveTenant returns the tenant an object of the given kind belongs to, by
+// its tenant label or by its namespace, and whether it belongs to one at all.
+// The error rejects objects that lack a required tenant label and objects the
+// user may not create for their tenant.
+func resolveTenant(request *admissionv1.AdmissionRequest, config Config, objectLabels map[string]string, kind string) (string, bool, error) {
+	tenant, ok := config.podTenant(request.Namespace, objectLabels)
+	if !ok && config.tenantLabelRequired(request.Namespace) {
+		return "", false, newRejection(reasonMissingTenantLabel, "%s in namespace %s must carry the %s label", kind, request.Namespace, config.TenantLabelKey)
+	}
+	if ok && !config.tenantIdentityValid(tenant, request.UserInfo) {
+		return tenant, true, newRejection(reasonTenantMismatch, "user %q may not create %s for tenant %q", request.UserInfo.Username, kind, tenant)
+	}
+	return tenant, ok, nil
+}
+
+// auditAnnotations records the decision in the API server's audit log, which
+// prefixes the keys with the webhook name. Only the decision and the reason
+// are recorded, not the message, to keep the values small.
+func auditAnnotations(r *review, rejection error) map[string]string {
+	decision, rejection := decisionOf(r, rejection)
+	annotations := map[string]string{"quota.decision": decision}
+	if rejection != nil {
+		annotations["quota.reason"] = rejectionReason(rejection)
+	}
+	return annotations
+}
+
+func isDryRun(request *admissionv1.AdmissionRequest) bool {
+	return request.DryRun != nil && *request.DryRun
+}
+
+// failureResponse answers a request that could not be decided, because no
+// usable config is available or pods could not be listed, allowing or denying
+// it according to the failure policy. Quota violations never go through here.
+func failureResponse(policy, reason, message string) (*admissionv1.AdmissionResponse, error) {
+	if policy == failurePolicyAllow {
+		slog.Warn("Allowing request due to failure policy", "policy", policy, "reason", reason, "message", message)
+		return &admissionv1.AdmissionResponse{Allowed: true}, nil
+	}
+	return deny(&admissionv1.AdmissionResponse{}, newRejection(reason, "%s", message))
 }
 
-func calculateResourceUsage(namespace, managedBy string) (resource.Quantity, resource.Quantity, error) {
-	pods, err := getPodsWithLabel(namespace, "vcluster.loft.sh/managed-by", managedBy)
+// deny marks the response as rejected with the error's message.
+func deny(admissionResponse *admissionv1.AdmissionResponse, err error) (*admissionv1.AdmissionResponse, error) {
+	admissionResponse.Result = &metav1.Status{Message: err.Error()}
+	admissionResponse.Allowed = false
+	return admissionResponse, err
+}
+
+// calculateResourceUsage sums the usage of the tenant's pods in namespace, or in
+// all namespaces if the config asks for a cluster-wide quota. With teams
+// configured only the pods of the given team count. Pods without the tenant
+// label count too in namespaces that namespaceTenants maps to the tenant. The
+// replaced pod, if any, is left out so that an update is not counted twice.
+//
+// It runs concurrently for parallel admissions. The pods come from the shared
+// informer cache and are only read; the returned usage is freshly allocated
+// and owned by the caller, and the only shared mutable state involved, the
+// recent admissions, is guarded by its own lock.
+func (ctrl *Controller) calculateResourceUsage(ctx context.Context, namespace, managedBy, team string, config Config, replaced *corev1.Pod) (Usage, error) {
+	if config.ClusterWideQuota {
+		namespace = metav1.NamespaceAll
+	}
+
+	selector, err := config.tenantSelector(managedBy, team)
 	if err != nil {
-		return resource.Quantity{}, resource.Quantity{}, err
+		return Usage{}, err
+	}
+	pods, err := ctrl.listTenantPods(ctx, namespace, selector)
+	if err != nil {
+		return Usage{}, err
+	}
+	for _, mapped := range config.mappedNamespaces(managedBy) {
+		if namespace != metav1.NamespaceAll && mapped != namespace {
+			continue
+		}
+		unlabeled, err := config.tenantSelector("", team)
+		if err != nil {
+			return Usage{}, err
+		}
+		more, err := ctrl.listTenantPods(ctx, mapped, unlabeled)
+		if err != nil {
+			return Usage{}, err
+		}
+		pods = append(pods, more...)
+	}
+
+	total := newUsage()
+	known := make(map[string]bool, len(pods))
+	for i := range pods {
+		known[podKey(pods[i].Namespace, pods[i].Name)] = true
+		if !countsTowardUsage(pods[i], config) || (replaced != nil && samePod(pods[i], *replaced)) {
+			continue
+		}
+		total.add(podUsage(&pods[i], config))
+	}
+	// Recently admitted pods have not been scheduled yet.
+	if config.phaseCounted(corev1.PodPending) {
+		total.add(ctrl.admissions.pending(namespace, teamKey(managedBy, team), known))
+	}
+
+	return total, nil
+}
+
+// samePod reports whether a and b are the same pod, by UID if both have one
+// and by name otherwise.
+func samePod(a, b corev1.Pod) bool {
+	if a.UID != "" && b.UID != "" {
+		return a.UID == b.UID
+	}
+	return a.Name == b.Name
+}
+
+// countsTowardUsage reports whether a pod is charged against the quota.
+// Finished pods, pods that are being deleted and pods in a phase left out of
+// the config's usage phases are not.
+func countsTowardUsage(pod corev1.Pod, config Config) bool {
+	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		return false
+	}
+	return pod.DeletionTimestamp == nil && config.phaseCounted(pod.Status.Phase)
+}
+
+func validateContainer(container corev1.Container, config Config, quota Quota) error {
+	resources := container.Resources
+	if config.RequireLimitsAndRequests && (resources.Limits == nil || resources.Requests == nil) {
+		return newRejection(reasonMissingLimits, "container %q must specify both resource limits and requests", container.Name)
+	}
+
+	if err := validateInitContainer(container, config, quota); err != nil {
+		return err
 	}
 
-	totalCPUUsage := resource.Quantity{}
-	totalMemoryUsage := resource.Quantity{}
+	// A missing request defaults to the limit in the API server, and to zero
+	// without a limit.
+	for _, name := range sortedResourceNames(quota.ContainerMinRequests) {
+		minimum := quota.ContainerMinRequests[name]
+		request, ok := resources.Requests[name]
+		if !ok {
+			request = resources.Limits[name]
+		}
+		if request.Cmp(minimum) < 0 {
+			return newRejection(reasonRequestBelowMinimum, "container %q requests %s %s which is below the per-container minimum of %s",
+				container.Name, request.String(), resourceDisplayName(name), minimum.String())
+		}
+	}
+
+	return nil
+}
 
-	for _, p := range pods {
-		for _, container := range p.Spec.Containers {
-			if container.Resources.Limits != nil {
-				totalCPUUsage.Add(container.Resources.Limits[corev1.ResourceCPU])
-				totalMemoryUsage.Add(container.Resources.Limits[corev1.ResourceMemory])
+// validateInitContainer checks the container against its own limits and the
+// per-container maximum, the subset of validateContainer that init containers
+// are held to.
+func validateInitContainer(container corev1.Container, config Config, quota Quota) error {
+	resources := container.Resources
+	if config.EnforceRequestsLeqLimits {
+		for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+			request, hasRequest := resources.Requests[name]
+			limit, hasLimit := resources.Limits[name]
+			if hasRequest && hasLimit && request.Cmp(limit) > 0 {
+				return newRejection(reasonRequestsExceedLimits, "container %q requests %s %s which exceeds its limit of %s",
+					container.Name, request.String(), resourceDisplayName(name), limit.String())
 			}
 		}
 	}
 
-	return totalCPUUsage, totalMemoryUsage, nil
+	return validateContainerMax(container, quota)
 }
 
-func validateResource(resources corev1.ResourceRequirements, totalCPUUsage, totalMemoryUsage, cpuLimit, memLimit resource.Quantity) error {
-	if resources.Limits == nil || resources.Requests == nil {
-		return fmt.Errorf("container must specify both resource limits and requests")
+// validateContainerMax checks the container against the per-container maximum.
+// Containers without a limit are held to it by their request.
+func validateContainerMax(container corev1.Container, quota Quota) error {
+	resources := container.Resources
+	for _, name := range sortedResourceNames(quota.ContainerMax) {
+		maximum := quota.ContainerMax[name]
+		value, ok := resources.Limits[name]
+		if !ok {
+			value, ok = resources.Requests[name]
+		}
+		if ok && value.Cmp(maximum) > 0 {
+			return newRejection(reasonContainerMaxExceeded, "container %q uses %s %s which exceeds the per-container maximum of %s",
+				container.Name, value.String(), resourceDisplayName(name), maximum.String())
+		}
 	}
+	return nil
+}
 
-	totalCPUUsage.Add(resources.Limits[corev1.ResourceCPU])
-	totalMemoryUsage.Add(resources.Limits[corev1.ResourceMemory])
+// validateResource checks the pod's usage on top of the running total against
+// the quota and adds it to the total if it fits. The limit quota is compared
+// against the sum selected by the quota scope, the request quota always
+// against requests.
+func validateResource(pod Usage, total *Usage, quota Quota) error {
+	scopedPod, scopedTotal := pod.Limits, total.Limits
+	if quota.Scope == quotaScopeRequests {
+		scopedPod, scopedTotal = pod.Requests, total.Requests
+	}
 
-	if totalCPUUsage.Cmp(cpuLimit) > 0 {
-		return fmt.Errorf("CPU limit exceeded")
+	if err := checkQuota(scopedTotal, scopedPod, quota.Limits, ""); err != nil {
+		return err
+	}
+	if err := checkQuota(total.Requests, pod.Requests, quota.Requests, "request"); err != nil {
+		return err
 	}
+	for _, class := range []corev1.PodQOSClass{corev1.PodQOSGuaranteed, corev1.PodQOSBurstable} {
+		if _, ok := pod.QOSClasses[class]; !ok {
+			continue
+		}
+		if err := checkQuota(total.QOSClasses[class], pod.QOSClasses[class], quota.QOSClassLimits[class], strings.ToLower(string(class))); err != nil {
+			return err
+		}
+	}
+
+	total.add(pod)
+	return nil
+}
 
-	if totalMemoryUsage.Cmp(memLimit) > 0 {
-		return fmt.Errorf("Memory limit exceeded")
+// checkQuota returns a rejection naming the first resource for which used plus
+// requested exceeds its ceiling. kind distinguishes the request quota from the
+// limit quota in the message and the rejection reason.
+func checkQuota(used, requested, ceilings corev1.ResourceList, kind string) error {
+	description := "limit"
+	if kind != "" {
+		description = kind + " quota"
 	}
 
+	for _, name := range sortedResourceNames(ceilings) {
+		usedQuantity := used[name]
+		requestedQuantity := requested[name]
+		ceiling := ceilings[name]
+
+		sum := usedQuantity.DeepCopy()
+		sum.Add(requestedQuantity)
+		if sum.Cmp(ceiling) > 0 {
+			return newRejection(exceededReason(name, kind), "%s %s exceeded: requested %s on top of %s used, %s is %s",
+				resourceDisplayName(name), description, requestedQuantity.String(), usedQuantity.String(), description, ceiling.String())
+		}
+	}
 	return nil
 }
 
-func getPodsWithLabel(namespace, key, value string) ([]corev1.Pod, error) {
-	podList, err := clientset.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{
-		LabelSelector: fmt.Sprintf("%s=%s", key, value),
-	})
-	if err != nil {
-		return nil, err
+// quotaWarnings describes every soft limit the pod pushes usage above and,
+// unless percent is zero, every ceiling it pushes usage above the given
+// percentage of without exceeding it.
+func quotaWarnings(pod, total Usage, quota Quota, percent int) []string {
+	scopedPod, scopedTotal := pod.Limits, total.Limits
+	if quota.Scope == quotaScopeRequests {
+		scopedPod, scopedTotal = pod.Requests, total.Requests
+	}
+
+	var warnings []string
+	for _, name := range sortedResourceNames(quota.SoftLimits) {
+		soft := quota.SoftLimits[name]
+		sum := scopedTotal[name].DeepCopy()
+		sum.Add(scopedPod[name])
+		if sum.Cmp(soft) > 0 {
+			warnings = append(warnings, fmt.Sprintf("%s usage of %s is above the soft limit of %s", resourceDisplayName(name), sum.String(), soft.String()))
+		}
+	}
+
+	if percent > 0 {
+		warnings = append(warnings, thresholdWarnings(scopedTotal, scopedPod, quota.Limits, "limit", percent)...)
+		warnings = append(warnings, thresholdWarnings(total.Requests, pod.Requests, quota.Requests, "request quota", percent)...)
+	}
+	return warnings
+}
+
+func thresholdWarnings(used, requested, ceilings corev1.ResourceList, description string, percent int) []string {
+	var warnings []string
+	for _, name := range sortedResourceNames(ceilings) {
+		ceiling := ceilings[name]
+		if ceiling.IsZero() {
+			continue
+		}
+
+		sum := used[name].DeepCopy()
+		sum.Add(requested[name])
+		share := float64(sum.MilliValue()) / float64(ceiling.MilliValue()) * 100
+		if share > float64(percent) && sum.Cmp(ceiling) <= 0 {
+			warnings = append(warnings, fmt.Sprintf("%s %s is %.0f%% used: %s of %s",
+				resourceDisplayName(name), description, share, sum.String(), ceiling.String()))
+		}
+	}
+	return warnings
+}
+
+// podListPageSize bounds the number of pods fetched per List call.
+const podListPageSize = 500
+
+func (ctrl *Controller) getPodsWithLabel(ctx context.Context, namespace string, selector labels.Selector) ([]corev1.Pod, error) {
+	if ctrl.client == nil {
+		return nil, errNoClient
+	}
+	ctx, cancel := context.WithTimeout(ctx, ctrl.apiTimeout)
+	defer cancel()
+
+	options := metav1.ListOptions{
+		LabelSelector: selector.String(),
+		FieldSelector: activePodsFieldSelector,
+		Limit:         podListPageSize,
+	}
+
+	var pods []corev1.Pod
+	for {
+		var podList *corev1.PodList
+		err := retryTransient(ctx, func() (err error) {
+			podList, err = ctrl.client.CoreV1().Pods(namespace).List(ctx, options)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		pods = append(pods, podList.Items...)
+
+		if podList.Continue == "" {
+			return pods, nil
+		}
+		options.Continue = podList.Continue
 	}
-	return podList.Items, nil
 }
@@ -0,0 +1,2080 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+const testNamespace = "tenant-a-ns"
+
+func TestMain(m *testing.M) {
+	// Every decision is logged, which would bury the test output.
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// newTestController returns a controller backed by a fake clientset that holds
+// the given objects and a ConfigMap with the given data.
+func newTestController(data map[string]string, objects ...runtime.Object) *Controller {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: defaultConfigMapName, Namespace: defaultConfigMapNamespace},
+		Data:       data,
+	}
+	return newController(fake.NewSimpleClientset(append(objects, cm)...))
+}
+
+// withData returns a copy of base with the keys of extra added.
+func withData(base, extra map[string]string) map[string]string {
+	data := map[string]string{}
+	for key, value := range base {
+		data[key] = value
+	}
+	for key, value := range extra {
+		data[key] = value
+	}
+	return data
+}
+
+// testContainer returns a container whose limits and requests are both cpu
+// and memory.
+func testContainer(name, cpu, memory string) corev1.Container {
+	resources := corev1.ResourceList{
+		corev1.ResourceCPU:    resource.MustParse(cpu),
+		corev1.ResourceMemory: resource.MustParse(memory),
+	}
+	return corev1.Container{
+		Name:      name,
+		Resources: corev1.ResourceRequirements{Limits: resources, Requests: resources.DeepCopy()},
+	}
+}
+
+// testPod returns a running pod of the tenant with one testContainer.
+func testPod(name, tenant, cpu, memory string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: testNamespace,
+			UID:       types.UID(name),
+			Labels:    map[string]string{defaultTenantLabelKey: tenant},
+		},
+		Spec:   corev1.PodSpec{Containers: []corev1.Container{testContainer("app", cpu, memory)}},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning},
+	}
+}
+
+// admissionReview returns a review of the object, and of old on update, for
+// the given resource.
+func admissionReview(t *testing.T, resource metav1.GroupVersionResource, operation admissionv1.Operation, object, old interface{}) admissionv1.AdmissionReview {
+	t.Helper()
+	request := &admissionv1.AdmissionRequest{
+		UID:       "review-uid",
+		Namespace: testNamespace,
+		Resource:  resource,
+		Operation: operation,
+	}
+	raw, err := json.Marshal(object)
+	if err != nil {
+		t.Fatalf("marshal object: %v", err)
+	}
+	request.Object.Raw = raw
+	if old != nil {
+		if request.OldObject.Raw, err = json.Marshal(old); err != nil {
+			t.Fatalf("marshal old object: %v", err)
+		}
+	}
+	return admissionv1.AdmissionReview{Request: request}
+}
+
+func podReview(t *testing.T, operation admissionv1.Operation, pod, old *corev1.Pod) admissionv1.AdmissionReview {
+	t.Helper()
+	if old == nil {
+		return admissionReview(t, metav1.GroupVersionResource(podsResource), operation, pod, nil)
+	}
+	return admissionReview(t, metav1.GroupVersionResource(podsResource), operation, pod, old)
+}
+
+// checkResponse fails the test unless the response has the expected decision
+// and, for a denial, a message containing want.
+func checkResponse(t *testing.T, resp *admissionv1.AdmissionResponse, allowed bool, want string) {
+	t.Helper()
+	if resp.Allowed != allowed {
+		message := ""
+		if resp.Result != nil {
+			message = resp.Result.Message
+		}
+		t.Fatalf("allowed = %v, want %v (message %q)", resp.Allowed, allowed, message)
+	}
+	if !allowed && (resp.Result == nil || !strings.Contains(resp.Result.Message, want)) {
+		t.Fatalf("message = %v, want it to contain %q", resp.Result, want)
+	}
+}
+
+func TestProcessAdmissionReview(t *testing.T) {
+	data := map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}
+	running := testPod("running", "tenant-a", "1", "1Gi")
+	other := testPod("other", "tenant-b", "2", "2Gi")
+
+	tests := []struct {
+		name    string
+		pod     *corev1.Pod
+		allowed bool
+		message string
+	}{
+		{"within quota", testPod("new", "tenant-a", "500m", "512Mi"), true, ""},
+		{"fills the quota exactly", testPod("new", "tenant-a", "1", "1Gi"), true, ""},
+		{"cpu over quota", testPod("new", "tenant-a", "1500m", "512Mi"), false, "CPU limit exceeded"},
+		{"memory over quota", testPod("new", "tenant-a", "500m", "1536Mi"), false, "Memory limit exceeded"},
+		{"other tenant is not counted", testPod("new", "tenant-c", "2", "2Gi"), true, ""},
+		{"unlabeled pod is allowed", func() *corev1.Pod {
+			pod := testPod("new", "", "8", "8Gi")
+			pod.Labels = nil
+			return pod
+		}(), true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(data, running, other)
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+			if resp.UID != "review-uid" {
+				t.Errorf("UID = %q, want the request's", resp.UID)
+			}
+		})
+	}
+}
+
+func TestProcessAdmissionReviewCountsAdmittedPods(t *testing.T) {
+	// Admitted pods count before the API server has stored them.
+	ctrl := newTestController(map[string]string{"limitCPU": "2", "limitMemory": "2Gi"})
+	for i, allowed := range []bool{true, true, false} {
+		pod := testPod("pod-"+string(rune('a'+i)), "tenant-a", "1", "1Gi")
+		resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, pod, nil))
+		checkResponse(t, resp, allowed, "limit exceeded")
+	}
+}
+
+func TestProcessAdmissionReviewWithoutConfig(t *testing.T) {
+	ctrl := newController(fake.NewSimpleClientset())
+	resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("new", "tenant-a", "1", "1Gi"), nil))
+	checkResponse(t, resp, false, "could not load config")
+}
+
+// bestEffortPod returns a pod of the tenant whose container requests only the
+// given resources, which leaves it BestEffort unless it sets cpu or memory.
+func bestEffortPod(name, tenant string, resources corev1.ResourceList) *corev1.Pod {
+	pod := testPod(name, tenant, "1", "1Gi")
+	pod.Spec.Containers[0].Resources = corev1.ResourceRequirements{}
+	if len(resources) > 0 {
+		pod.Spec.Containers[0].Resources = corev1.ResourceRequirements{Limits: resources, Requests: resources.DeepCopy()}
+	}
+	return pod
+}
+
+func TestBestEffortPods(t *testing.T) {
+	data := map[string]string{
+		"limitCPU":              "2",
+		"limitMemory":           "2Gi",
+		"limitEphemeralStorage": "10Gi",
+		"extendedResources":     `{"nvidia.com/gpu": "1"}`,
+		"maxBestEffortPods":     "2",
+	}
+	gpus := func(count string) corev1.ResourceList {
+		return corev1.ResourceList{"nvidia.com/gpu": resource.MustParse(count)}
+	}
+
+	tests := []struct {
+		name    string
+		data    map[string]string
+		pod     *corev1.Pod
+		allowed bool
+		message string
+	}{
+		{"within the cap, with the cpu and memory quota used up", data, bestEffortPod("new", "tenant-a", nil), true, ""},
+		{"over the cap", withData(data, map[string]string{"maxBestEffortPods": "1"}), bestEffortPod("new", "tenant-a", nil), false, "BestEffort pod limit exceeded"},
+		{"within the extended resource limit", data, bestEffortPod("new", "tenant-a", gpus("1")), true, ""},
+		{"over the extended resource limit", data, bestEffortPod("new", "tenant-a", gpus("8")), false, "nvidia.com/gpu limit exceeded"},
+		{"over the ephemeral storage limit", data, bestEffortPod("new", "tenant-a", corev1.ResourceList{corev1.ResourceEphemeralStorage: resource.MustParse("20Gi")}), false, "Ephemeral storage limit exceeded"},
+		{"without a cap limits are required", withData(data, map[string]string{"maxBestEffortPods": "0"}), bestEffortPod("new", "tenant-a", nil), false, "must specify both resource limits and requests"},
+		{"other pods are still checked", data, testPod("new", "tenant-a", "500m", "512Mi"), false, "CPU limit exceeded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The tenant's cpu and memory are used up and one BestEffort pod
+			// is running.
+			ctrl := newTestController(tt.data, testPod("running", "tenant-a", "2", "2Gi"), bestEffortPod("idle", "tenant-a", nil))
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestValidateContainers(t *testing.T) {
+	data := map[string]string{"limitCPU": "10", "limitMemory": "10Gi", "maxContainerCPU": "1", "minContainerMemoryRequest": "16Mi"}
+	always := corev1.ContainerRestartPolicyAlways
+	container := func(name, cpu string) corev1.Container {
+		c := testPod("", "", cpu, "64Mi").Spec.Containers[0]
+		c.Name = name
+		return c
+	}
+	withInit := func(init corev1.Container) *corev1.Pod {
+		pod := testPod("new", "tenant-a", "500m", "64Mi")
+		pod.Spec.InitContainers = []corev1.Container{init}
+		return pod
+	}
+	withEphemeral := func(cpu string) *corev1.Pod {
+		pod := testPod("new", "tenant-a", "500m", "64Mi")
+		debug := container("debug", cpu)
+		pod.Spec.EphemeralContainers = []corev1.EphemeralContainer{{
+			EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debug", Resources: debug.Resources},
+		}}
+		return pod
+	}
+	sidecar := container("proxy", "2")
+	sidecar.RestartPolicy = &always
+	unbounded := container("setup", "500m")
+	unbounded.Resources = corev1.ResourceRequirements{}
+	small := container("setup", "500m")
+	small.Resources.Requests[corev1.ResourceMemory] = resource.MustParse("8Mi")
+	inverted := container("setup", "500m")
+	inverted.Resources.Requests[corev1.ResourceCPU] = resource.MustParse("1")
+
+	tests := []struct {
+		name    string
+		data    map[string]string
+		pod     *corev1.Pod
+		allowed bool
+		message string
+	}{
+		{"init container within the maximum", data, withInit(container("setup", "1")), true, ""},
+		{"init container over the maximum", data, withInit(container("setup", "2")), false, "exceeds the per-container maximum"},
+		{"sidecar over the maximum", data, withInit(sidecar), false, "exceeds the per-container maximum"},
+		{"init container without resources", withData(data, map[string]string{"requireLimitsAndRequests": "true"}), withInit(unbounded), true, ""},
+		{"init container below the minimum", data, withInit(small), true, ""},
+		{"init container requesting more than its limit", withData(data, map[string]string{"enforceRequestsLeqLimits": "true"}), withInit(inverted), false, `container "setup" requests 1 CPU which exceeds its limit of 500m`},
+		{"container without limits", data, func() *corev1.Pod {
+			pod := testPod("new", "tenant-a", "500m", "64Mi")
+			pod.Spec.Containers[0].Resources = corev1.ResourceRequirements{}
+			return pod
+		}(), false, "must specify both resource limits and requests"},
+		{"ephemeral container over the maximum, not counted", data, withEphemeral("2"), true, ""},
+		{"ephemeral container over the maximum", withData(data, map[string]string{"countEphemeralContainers": "true"}), withEphemeral("2"), false, "exceeds the per-container maximum"},
+		{"ephemeral container without resources", withData(data, map[string]string{"countEphemeralContainers": "true"}), func() *corev1.Pod {
+			pod := withEphemeral("1")
+			pod.Spec.EphemeralContainers[0].Resources = corev1.ResourceRequirements{}
+			return pod
+		}(), true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(tt.data)
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestMultiContainerPods(t *testing.T) {
+	quota, err := parseQuota(Config{LimitCPU: "2", LimitMemory: "2Gi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		containers []corev1.Container
+		allowed    bool
+		message    string
+	}{
+		{"containers fit together", []corev1.Container{testContainer("a", "500m", "512Mi"), testContainer("b", "500m", "512Mi")}, true, ""},
+		{"containers fit the quota exactly", []corev1.Container{testContainer("a", "1", "1Gi"), testContainer("b", "500m", "512Mi"), testContainer("c", "500m", "512Mi")}, true, ""},
+		{"each container fits but not together", []corev1.Container{testContainer("a", "1500m", "512Mi"), testContainer("b", "1500m", "512Mi")}, false, "CPU limit exceeded"},
+		{"memory of the containers together", []corev1.Container{testContainer("a", "100m", "1536Mi"), testContainer("b", "100m", "1Gi")}, false, "Memory limit exceeded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: tt.containers}}
+			total := newUsage()
+			err := validateResource(podUsage(pod, Config{}), &total, quota)
+			if tt.allowed && err != nil {
+				t.Fatalf("validateResource() error = %v, want none", err)
+			}
+			if !tt.allowed && (err == nil || !strings.Contains(err.Error(), tt.message)) {
+				t.Fatalf("validateResource() error = %v, want %q", err, tt.message)
+			}
+		})
+	}
+}
+
+// TestProcessAdmissionReviewConcurrent admits pods of several tenants in
+// parallel, from the pod cache, for go test -race to check the shared state.
+func TestProcessAdmissionReviewConcurrent(t *testing.T) {
+	const tenants, podsPerTenant = 4, 25
+	config, err := parseConfig(map[string]string{"limitCPU": "100", "limitMemory": "100Gi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrl := newAPIServerController(t, servePods())
+	usePodCache(t, ctrl, true, testPod("running", "tenant-0", "1", "1Gi"))
+	ctrl.setConfig(config)
+
+	var wg sync.WaitGroup
+	denied := make(chan string, tenants*podsPerTenant)
+	for i := 0; i < tenants; i++ {
+		for j := 0; j < podsPerTenant; j++ {
+			pod := testPod(fmt.Sprintf("pod-%d-%d", i, j), fmt.Sprintf("tenant-%d", i), "100m", "128Mi")
+			ar := podReview(t, admissionv1.Create, pod, nil)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if resp := ctrl.processAdmissionReview(context.Background(), ar); !resp.Allowed {
+					denied <- resp.Result.Message
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	close(denied)
+	for message := range denied {
+		t.Errorf("denied: %s", message)
+	}
+
+	// Every admitted pod is charged, on top of the cached one.
+	for i := 0; i < tenants; i++ {
+		usage, err := ctrl.calculateResourceUsage(context.Background(), "", fmt.Sprintf("tenant-%d", i), "", config, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := podsPerTenant
+		if i == 0 {
+			want++
+		}
+		if usage.Pods != want {
+			t.Errorf("tenant-%d has %d pods, want %d", i, usage.Pods, want)
+		}
+	}
+}
+
+func TestUsagePhases(t *testing.T) {
+	inPhase := func(name string, phase corev1.PodPhase) *corev1.Pod {
+		pod := testPod(name, "tenant-a", "1", "1Gi")
+		pod.Status.Phase = phase
+		return pod
+	}
+	pods := []corev1.Pod{
+		*inPhase("running", corev1.PodRunning),
+		*inPhase("pending", corev1.PodPending),
+		*inPhase("unscheduled", ""),
+		*inPhase("unknown", corev1.PodUnknown),
+	}
+
+	tests := []struct {
+		name    string
+		phases  map[string]string
+		want    int
+		wantErr bool
+	}{
+		{name: "pending counted by default", want: 4},
+		{name: "pending left out", phases: map[string]string{"usagePhases": "Running"}, want: 1},
+		{name: "pending counted", phases: map[string]string{"usagePhases": "Pending, Running"}, want: 3},
+		{name: "unknown only", phases: map[string]string{"usagePhases": "Unknown"}, want: 1},
+		{name: "finished phase", phases: map[string]string{"usagePhases": "Running,Succeeded"}, wantErr: true},
+		{name: "no phases", phases: map[string]string{"usagePhases": " "}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := parseConfig(withData(map[string]string{"limitCPU": "10", "limitMemory": "10Gi"}, tt.phases))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseConfig() = %+v, want an error", config.UsagePhases)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctrl := newAPIServerController(t, servePods(pods...))
+			usage, err := ctrl.calculateResourceUsage(context.Background(), "", "tenant-a", "", config, nil)
+			if err != nil {
+				t.Fatalf("calculateResourceUsage() error = %v", err)
+			}
+			if usage.Pods != tt.want {
+				t.Errorf("usage counts %d pods, want %d", usage.Pods, tt.want)
+			}
+		})
+	}
+}
+
+func TestClusterWideQuota(t *testing.T) {
+	data := map[string]string{"limitCPU": "4", "limitMemory": "4Gi"}
+	elsewhere := testPod("elsewhere", "tenant-a", "2", "2Gi")
+	elsewhere.Namespace = "vcluster-a-2"
+	otherTenant := testPod("other", "tenant-b", "2", "2Gi")
+	otherTenant.Namespace = "vcluster-b"
+
+	tests := []struct {
+		name    string
+		data    map[string]string
+		pods    int
+		allowed bool
+		message string
+	}{
+		{"pods in both namespaces", withData(data, map[string]string{"clusterWideQuota": "true"}), 2, false, "CPU limit exceeded: requested 1500m on top of 3 used, limit is 4"},
+		{"only the request namespace", data, 1, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := parseConfig(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			running := testPod("running", "tenant-a", "1", "1Gi")
+			ctrl := newAPIServerController(t, servePods(*running, *elsewhere, *otherTenant))
+			ctrl.setConfig(config)
+			usage, err := ctrl.calculateResourceUsage(context.Background(), testNamespace, "tenant-a", "", config, nil)
+			if err != nil {
+				t.Fatalf("calculateResourceUsage() error = %v", err)
+			}
+			if usage.Pods != tt.pods {
+				t.Errorf("usage counts %d pods, want %d", usage.Pods, tt.pods)
+			}
+
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("new", "tenant-a", "1500m", "512Mi"), nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestPodOverhead(t *testing.T) {
+	pod := &corev1.Pod{Spec: corev1.PodSpec{
+		Containers: []corev1.Container{testContainer("app", "1500m", "1Gi")},
+		Overhead:   corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("750m"), corev1.ResourceMemory: resource.MustParse("256Mi")},
+	}}
+
+	tests := []struct {
+		name   string
+		config Config
+		cpu    string
+		memory string
+	}{
+		{"ignored by default", Config{}, "1500m", "1Gi"},
+		{"counted when enabled", Config{CountPodOverhead: true}, "2250m", "1280Mi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checkResources(t, podResources(pod, tt.config, quotaScopeLimits), tt.cpu, tt.memory)
+		})
+	}
+}
+
+// cpuMemory returns a resource list of cpu and memory, leaving out empty
+// values.
+func cpuMemory(cpu, memory string) corev1.ResourceList {
+	list := corev1.ResourceList{}
+	if cpu != "" {
+		list[corev1.ResourceCPU] = resource.MustParse(cpu)
+	}
+	if memory != "" {
+		list[corev1.ResourceMemory] = resource.MustParse(memory)
+	}
+	return list
+}
+
+// withResources replaces the resources of the pod's container.
+func withResources(pod *corev1.Pod, requests, limits corev1.ResourceList) *corev1.Pod {
+	pod.Spec.Containers[0].Resources = corev1.ResourceRequirements{Requests: requests, Limits: limits}
+	return pod
+}
+
+// scopePod returns a labeled pod with a single container and no resources.
+func scopePod() *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "new", Labels: map[string]string{"vcluster.loft.sh/managed-by": "tenant-a"}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	}
+}
+
+func TestQuotaScope(t *testing.T) {
+	// A pod that predates the webhook, with requests but no limits.
+	running := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "running", Labels: map[string]string{"vcluster.loft.sh/managed-by": "tenant-a"}},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	}
+	withResources(&running, cpuMemory("1500m", "256Mi"), nil)
+
+	tests := []struct {
+		name    string
+		scope   string
+		pod     *corev1.Pod
+		allowed bool
+	}{
+		{"fits the limits-based quota", quotaScopeLimits, withResources(scopePod(), cpuMemory("1", "1Gi"), cpuMemory("1", "1Gi")), true},
+		{"exceeds the requests-based quota", quotaScopeRequests, withResources(scopePod(), cpuMemory("1", "1Gi"), cpuMemory("1", "1Gi")), false},
+		{"exceeds the limits-based quota", quotaScopeLimits, withResources(scopePod(), cpuMemory("100m", "128Mi"), cpuMemory("4", "1Gi")), false},
+		{"fits the requests-based quota", quotaScopeRequests, withResources(scopePod(), cpuMemory("100m", "128Mi"), cpuMemory("4", "1Gi")), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newAPIServerController(t, servePods(running))
+			ctrl.setConfig(Config{LimitCPU: "2", LimitMemory: "2Gi", QuotaScope: tt.scope, TenantLabelKey: defaultTenantLabelKey, UsagePhases: defaultUsagePhases})
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+			if resp.Allowed != tt.allowed {
+				t.Fatalf("Allowed = %v, want %v (result: %v)", resp.Allowed, tt.allowed, resp.Result)
+			}
+		})
+	}
+}
+
+func TestParseQuotaScope(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string]string
+		want    string
+		wantErr bool
+	}{
+		{"defaults to limits", map[string]string{"limitCPU": "1", "limitMemory": "1Gi"}, quotaScopeLimits, false},
+		{"limits", map[string]string{"limitCPU": "1", "limitMemory": "1Gi", "quotaScope": "Limits"}, quotaScopeLimits, false},
+		{"requests", map[string]string{"limitCPU": "1", "limitMemory": "1Gi", "quotaScope": "Requests"}, quotaScopeRequests, false},
+		{"unknown scope", map[string]string{"limitCPU": "1", "limitMemory": "1Gi", "quotaScope": "limits"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := parseConfig(tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseConfig() accepted quotaScope %q", tt.data["quotaScope"])
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseConfig() error = %v", err)
+			}
+			if config.QuotaScope != tt.want {
+				t.Errorf("QuotaScope = %q, want %q", config.QuotaScope, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestQuotas(t *testing.T) {
+	config := Config{LimitCPU: "4", LimitMemory: "4Gi", RequestCPU: "2", RequestMemory: "2Gi", QuotaScope: quotaScopeLimits, TenantLabelKey: defaultTenantLabelKey, UsagePhases: defaultUsagePhases}
+	running := *withResources(scopePod(), cpuMemory("1", "1Gi"), cpuMemory("1", "1Gi"))
+	pod := func(requestCPU, requestMemory, limitCPU, limitMemory string) *corev1.Pod {
+		return withResources(scopePod(), cpuMemory(requestCPU, requestMemory), cpuMemory(limitCPU, limitMemory))
+	}
+	unbounded := config
+	unbounded.RequestCPU, unbounded.RequestMemory = "", ""
+
+	tests := []struct {
+		name    string
+		config  Config
+		pod     *corev1.Pod
+		allowed bool
+		message string
+	}{
+		{"within both quotas", config, pod("1", "1Gi", "3", "3Gi"), true, ""},
+		{"cpu request quota", config, pod("1500m", "1Gi", "3", "3Gi"), false, "CPU request quota exceeded: requested 1500m on top of 1 used, request quota is 2"},
+		{"memory request quota", config, pod("1", "1536Mi", "3", "3Gi"), false, "Memory request quota exceeded"},
+		{"cpu limit", config, pod("1", "1Gi", "3500m", "3Gi"), false, "CPU limit exceeded: requested 3500m on top of 1 used, limit is 4"},
+		{"memory limit", config, pod("1", "1Gi", "3", "3584Mi"), false, "Memory limit exceeded"},
+		{"empty request quotas are unbounded", unbounded, pod("3", "3Gi", "3", "3Gi"), true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newAPIServerController(t, servePods(running))
+			ctrl.setConfig(tt.config)
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestEphemeralStorageQuota(t *testing.T) {
+	config := Config{LimitCPU: "4", LimitMemory: "4Gi", LimitEphemeralStorage: "10Gi", QuotaScope: quotaScopeLimits, TenantLabelKey: defaultTenantLabelKey, UsagePhases: defaultUsagePhases}
+	pod := func(storage string) *corev1.Pod {
+		limits := cpuMemory("1", "1Gi")
+		if storage != "" {
+			limits[corev1.ResourceEphemeralStorage] = resource.MustParse(storage)
+		}
+		return withResources(scopePod(), cpuMemory("1", "1Gi"), limits)
+	}
+	unlimited := config
+	unlimited.LimitEphemeralStorage = ""
+
+	tests := []struct {
+		name    string
+		config  Config
+		pod     *corev1.Pod
+		allowed bool
+		message string
+	}{
+		{"within the limit", config, pod("4Gi"), true, ""},
+		{"excessive ephemeral storage", config, pod("50Gi"), false, "Ephemeral storage limit exceeded: requested 50Gi on top of 6Gi used, limit is 10Gi"},
+		{"pod without ephemeral storage", config, pod(""), true, ""},
+		{"no limit configured", unlimited, pod("50Gi"), true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newAPIServerController(t, servePods(*pod("6Gi")))
+			ctrl.setConfig(tt.config)
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestQuotaMap(t *testing.T) {
+	data := map[string]string{"quota": `{"cpu": "2", "memory": "2Gi", "ephemeral-storage": "10Gi"}`}
+	pod := func(cpu, memory, storage string) *corev1.Pod {
+		pod := testPod("new", "tenant-a", cpu, memory)
+		pod.Spec.Containers[0].Resources.Limits[corev1.ResourceEphemeralStorage] = resource.MustParse(storage)
+		return pod
+	}
+
+	tests := []struct {
+		name    string
+		data    map[string]string
+		pod     *corev1.Pod
+		allowed bool
+		message string
+	}{
+		{"within every ceiling", data, pod("500m", "512Mi", "4Gi"), true, ""},
+		{"cpu over the map", data, pod("1500m", "512Mi", "4Gi"), false, "CPU limit exceeded: requested 1500m on top of 1 used, limit is 2"},
+		{"memory over the map", data, pod("500m", "1536Mi", "4Gi"), false, "Memory limit exceeded: requested 1536Mi on top of 1Gi used, limit is 2Gi"},
+		{"ephemeral storage over the map", data, pod("500m", "512Mi", "8Gi"), false, "Ephemeral storage limit exceeded: requested 8Gi on top of 3Gi used, limit is 10Gi"},
+		{"flat field takes precedence", withData(data, map[string]string{"limitCPU": "4"}), pod("1500m", "512Mi", "4Gi"), true, ""},
+		{"flat fields fill in the map", map[string]string{"quota": `{"ephemeral-storage": "10Gi"}`, "limitCPU": "2", "limitMemory": "2Gi"}, pod("1500m", "512Mi", "4Gi"), false, "CPU limit exceeded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(tt.data, pod("1", "1Gi", "3Gi"))
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestExtendedResourceQuota(t *testing.T) {
+	config := Config{LimitCPU: "4", LimitMemory: "4Gi", ExtendedResources: map[string]string{"nvidia.com/gpu": "1"}, QuotaScope: quotaScopeLimits, TenantLabelKey: defaultTenantLabelKey, UsagePhases: defaultUsagePhases}
+	pod := func(gpus string) *corev1.Pod {
+		pod := withResources(scopePod(), cpuMemory("1", "1Gi"), cpuMemory("1", "1Gi"))
+		if gpus != "" {
+			pod.Spec.Containers[0].Resources.Limits["nvidia.com/gpu"] = resource.MustParse(gpus)
+			pod.Spec.Containers[0].Resources.Requests["nvidia.com/gpu"] = resource.MustParse(gpus)
+		}
+		return pod
+	}
+	fpga := config
+	fpga.ExtendedResources = map[string]string{"example.com/fpga": "1"}
+
+	tests := []struct {
+		name    string
+		config  Config
+		running []corev1.Pod
+		pod     *corev1.Pod
+		allowed bool
+		message string
+	}{
+		{"one gpu", config, nil, pod("1"), true, ""},
+		{"two gpus against a quota of one", config, nil, pod("2"), false, "nvidia.com/gpu limit exceeded: requested 2 on top of 0 used, limit is 1"},
+		{"gpu already in use", config, []corev1.Pod{*pod("1")}, pod("1"), false, "nvidia.com/gpu limit exceeded: requested 1 on top of 1 used"},
+		{"pod without gpus", config, []corev1.Pod{*pod("1")}, pod(""), true, ""},
+		{"resource not configured", fpga, nil, pod("2"), true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newAPIServerController(t, servePods(tt.running...))
+			ctrl.setConfig(tt.config)
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestEnforcedResources(t *testing.T) {
+	const hugepages = corev1.ResourceName("hugepages-2Mi")
+	data := map[string]string{"enforcedResources": "hugepages-2Mi", "quota": `{"hugepages-2Mi": "1Gi"}`}
+	pod := func(name, cpu, pages string) *corev1.Pod {
+		pod := testPod(name, "tenant-a", cpu, "1Gi")
+		if pages != "" {
+			pod.Spec.Containers[0].Resources.Limits[hugepages] = resource.MustParse(pages)
+			pod.Spec.Containers[0].Resources.Requests[hugepages] = resource.MustParse(pages)
+		}
+		return pod
+	}
+
+	tests := []struct {
+		name    string
+		data    map[string]string
+		pod     *corev1.Pod
+		allowed bool
+		message string
+	}{
+		{"hugepages within the quota", data, pod("new", "1", "512Mi"), true, ""},
+		{"hugepages over the quota", data, pod("new", "1", "768Mi"), false, "hugepages-2Mi limit exceeded: requested 768Mi on top of 512Mi used, limit is 1Gi"},
+		{"cpu is not enforced", data, pod("new", "64", "256Mi"), true, ""},
+		{
+			"cpu enforced next to hugepages",
+			withData(data, map[string]string{"enforcedResources": "cpu, hugepages-2Mi", "limitCPU": "2"}), pod("new", "2", "256Mi"),
+			false, "CPU limit exceeded: requested 2 on top of 1 used, limit is 2",
+		},
+		{"flat limits are ignored when not listed", withData(data, map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}), pod("new", "8", "256Mi"), true, ""},
+		{"cpu and memory by default", map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "quota": `{"hugepages-2Mi": "1Gi"}`}, pod("new", "2", "256Mi"), false, "CPU limit exceeded"},
+		{"listed resource without a limit", withData(data, map[string]string{"enforcedResources": "hugepages-1Gi"}), pod("new", "1", ""), false, "enforcedResources lists hugepages-1Gi but no limit is configured for it"},
+		{"invalid resource name", withData(data, map[string]string{"enforcedResources": "huge pages"}), pod("new", "1", ""), false, "invalid enforcedResources entry"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(tt.data, pod("running", "1", "512Mi"))
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestParseExtendedResources(t *testing.T) {
+	for _, value := range []string{`["nvidia.com/gpu"]`, `{"nvidia.com/gpu": "lots"}`} {
+		if _, err := parseConfig(map[string]string{"limitCPU": "1", "limitMemory": "1Gi", "extendedResources": value}); err == nil {
+			t.Errorf("parseConfig() accepted extendedResources %s", value)
+		}
+	}
+}
+
+func TestMaxPods(t *testing.T) {
+	config := Config{LimitCPU: "10", LimitMemory: "10Gi", MaxPods: 3, QuotaScope: quotaScopeLimits, TenantLabelKey: defaultTenantLabelKey, UsagePhases: defaultUsagePhases}
+	tenantPods := func(tenant string, n int) []corev1.Pod {
+		var pods []corev1.Pod
+		for i := 0; i < n; i++ {
+			pod := *withResources(scopePod(), cpuMemory("100m", "64Mi"), cpuMemory("100m", "64Mi"))
+			pod.Name = fmt.Sprintf("%s-%d", tenant, i)
+			pod.Labels = map[string]string{"vcluster.loft.sh/managed-by": tenant}
+			pods = append(pods, pod)
+		}
+		return pods
+	}
+	finished := tenantPods("tenant-a", 1)[0]
+	finished.Status.Phase = corev1.PodSucceeded
+	unbounded := config
+	unbounded.MaxPods = 0
+
+	tests := []struct {
+		name    string
+		config  Config
+		running []corev1.Pod
+		allowed bool
+		message string
+	}{
+		{"below the limit", config, tenantPods("tenant-a", 2), true, ""},
+		{"at the limit", config, tenantPods("tenant-a", 3), false, "pod limit exceeded: tenant already has 3 pods, 1 more would exceed the limit of 3"},
+		{"above the limit", config, tenantPods("tenant-a", 4), false, "pod limit exceeded"},
+		{"pods of other tenants", config, append(tenantPods("tenant-a", 2), tenantPods("tenant-b", 3)...), true, ""},
+		{"finished pods are not counted", config, append(tenantPods("tenant-a", 2), finished), true, ""},
+		{"no limit", unbounded, tenantPods("tenant-a", 10), true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newAPIServerController(t, servePods(tt.running...))
+			ctrl.setConfig(tt.config)
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, withResources(scopePod(), cpuMemory("100m", "64Mi"), cpuMemory("100m", "64Mi")), nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestCheckQuotaMessage(t *testing.T) {
+	tests := []struct {
+		name      string
+		used      corev1.ResourceList
+		requested corev1.ResourceList
+		kind      string
+		want      string
+	}{
+		{"cpu limit", cpuMemory("6", "1Gi"), cpuMemory("2", "1Gi"), "", "CPU limit exceeded: requested 2 on top of 6 used, limit is 7"},
+		{"memory limit", cpuMemory("1", "6Gi"), cpuMemory("1", "1536Mi"), "", "Memory limit exceeded: requested 1536Mi on top of 6Gi used, limit is 7Gi"},
+		{"cpu request quota", cpuMemory("6500m", "1Gi"), cpuMemory("750m", "1Gi"), "request", "CPU request quota exceeded: requested 750m on top of 6500m used, request quota is 7"},
+		{"nothing used yet", nil, cpuMemory("8", "1Gi"), "", "CPU limit exceeded: requested 8 on top of 0 used, limit is 7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkQuota(tt.used, tt.requested, cpuMemory("7", "7Gi"), tt.kind)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("checkQuota() = %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	if err := checkQuota(cpuMemory("6", "6Gi"), cpuMemory("1", "1Gi"), cpuMemory("7", "7Gi"), ""); err != nil {
+		t.Errorf("checkQuota() at the limit = %v, want nil", err)
+	}
+}
+
+func TestRejectionMessageDecoration(t *testing.T) {
+	const exceeded = "CPU limit exceeded: requested 3 on top of 0 used, limit is 2"
+	tests := []struct {
+		name  string
+		extra map[string]string
+		want  string
+	}{
+		{name: "undecorated", want: exceeded},
+		{name: "prefix", extra: map[string]string{"rejectionMessagePrefix": "[platform]"}, want: "[platform] " + exceeded},
+		{name: "URL", extra: map[string]string{"rejectionMessageURL": "https://wiki.example.com/quota"}, want: exceeded + " (see https://wiki.example.com/quota)"},
+		{
+			name:  "prefix and URL",
+			extra: map[string]string{"rejectionMessagePrefix": "[platform]", "rejectionMessageURL": "https://wiki.example.com/quota"},
+			want:  "[platform] " + exceeded + " (see https://wiki.example.com/quota)",
+		},
+		{name: "relative URL", extra: map[string]string{"rejectionMessageURL": "wiki/quota"}, want: "invalid rejectionMessageURL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newAPIServerController(t, serveConfig(withData(map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}, tt.extra)))
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("new", "tenant-a", "3", "1Gi"), nil))
+			if resp.Allowed || resp.Result == nil {
+				t.Fatalf("response = %+v, want a denial", resp)
+			}
+			if !strings.Contains(resp.Result.Message, tt.want) {
+				t.Errorf("message = %q, want %q", resp.Result.Message, tt.want)
+			}
+		})
+	}
+
+	// Allowed responses carry no message to decorate.
+	ctrl := newTestController(map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "rejectionMessagePrefix": "[platform]"})
+	resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("new", "tenant-a", "1", "1Gi"), nil))
+	if !resp.Allowed || resp.Result != nil {
+		t.Errorf("response = %+v, want an undecorated admission", resp)
+	}
+}
+
+// useFakeRecorder makes the controller record events to a fake recorder.
+func useFakeRecorder(ctrl *Controller) *record.FakeRecorder {
+	recorder := record.NewFakeRecorder(10)
+	ctrl.eventRecorder = recorder
+	return recorder
+}
+
+func TestDryRun(t *testing.T) {
+	ctrl := newAPIServerController(t, servePods(*withResources(scopePod(), cpuMemory("1", "1Gi"), cpuMemory("1", "1Gi"))))
+	ctrl.setConfig(Config{LimitCPU: "2", LimitMemory: "2Gi", QuotaScope: quotaScopeLimits, TenantLabelKey: defaultTenantLabelKey, UsagePhases: defaultUsagePhases, EmitEvents: true})
+	recorder := useFakeRecorder(ctrl)
+	dryRun := func(cpu string) admissionv1.AdmissionReview {
+		ar := podReview(t, admissionv1.Create, withResources(scopePod(), cpuMemory(cpu, "512Mi"), cpuMemory(cpu, "512Mi")), nil)
+		ar.Request.DryRun = new(bool)
+		*ar.Request.DryRun = true
+		return ar
+	}
+	requests := testutil.ToFloat64(admissionRequestsTotal)
+	rejections := testutil.ToFloat64(admissionRejectionsTotal.WithLabelValues("cpu_exceeded"))
+
+	resp := ctrl.processAdmissionReview(context.Background(), dryRun("2"))
+	if resp.Allowed {
+		t.Fatal("a dry-run pod over the CPU quota was allowed")
+	}
+	if !strings.Contains(resp.Result.Message, "CPU limit exceeded") {
+		t.Errorf("message = %q, want a CPU limit rejection", resp.Result.Message)
+	}
+	if resp.UID != "review-uid" {
+		t.Errorf("UID = %q, want the request's", resp.UID)
+	}
+	if resp := ctrl.processAdmissionReview(context.Background(), dryRun("500m")); !resp.Allowed {
+		t.Errorf("a dry-run pod within the quota was denied: %v", resp.Result)
+	}
+
+	if got := testutil.ToFloat64(admissionRequestsTotal) - requests; got != 0 {
+		t.Errorf("admission_requests_total rose by %v on dry runs", got)
+	}
+	if got := testutil.ToFloat64(admissionRejectionsTotal.WithLabelValues("cpu_exceeded")) - rejections; got != 0 {
+		t.Errorf("admission_rejections_total{reason=cpu_exceeded} rose by %v on a dry run", got)
+	}
+	select {
+	case event := <-recorder.Events:
+		t.Errorf("dry run emitted event %q", event)
+	default:
+	}
+}
+
+func TestResponseUID(t *testing.T) {
+	ctrl := newAPIServerController(t, servePods())
+	ctrl.setConfig(Config{LimitCPU: "2", LimitMemory: "2Gi", QuotaScope: quotaScopeLimits, TenantLabelKey: defaultTenantLabelKey, UsagePhases: defaultUsagePhases})
+	service := admissionv1.AdmissionReview{Request: &admissionv1.AdmissionRequest{
+		UID:       "review-uid",
+		Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "services"},
+		Operation: admissionv1.Create,
+	}}
+	undecodable := podReview(t, admissionv1.Create, scopePod(), nil)
+	undecodable.Request.Object.Raw = []byte(`{"spec": "not a pod spec"}`)
+	overQuota := podReview(t, admissionv1.Create, withResources(scopePod(), cpuMemory("8", "1Gi"), cpuMemory("8", "1Gi")), nil)
+
+	tests := []struct {
+		name    string
+		review  admissionv1.AdmissionReview
+		allowed bool
+	}{
+		{"non-pod resource", service, true},
+		{"undecodable pod", undecodable, false},
+		{"rejected pod", overQuota, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := ctrl.processAdmissionReview(context.Background(), tt.review)
+			if resp.Allowed != tt.allowed {
+				t.Errorf("allowed = %v, want %v", resp.Allowed, tt.allowed)
+			}
+			if resp.UID != "review-uid" {
+				t.Errorf("UID = %q, want the request's", resp.UID)
+			}
+		})
+	}
+
+	if resp := ctrl.processAdmissionReview(context.Background(), admissionv1.AdmissionReview{}); resp.Allowed {
+		t.Error("a review without a request was allowed")
+	}
+}
+
+// postReview posts body to the admission handler and returns the recorded
+// response.
+func postReview(ctrl *Controller, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	ctrl.handleAdmission(recorder, httptest.NewRequest(http.MethodPost, "/validate", strings.NewReader(body)))
+	return recorder
+}
+
+func TestHandleAdmissionWithoutRequest(t *testing.T) {
+	ctrl := newTestController(map[string]string{"limitCPU": "2", "limitMemory": "2Gi"})
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"review without a request", `{"apiVersion": "admission.k8s.io/v1", "kind": "AdmissionReview"}`, http.StatusOK},
+		{"empty object", `{}`, http.StatusOK},
+		{"not JSON", `not json`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := postReview(ctrl, tt.body)
+			if recorder.Code != tt.status {
+				t.Fatalf("status = %d, want %d", recorder.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var review admissionv1.AdmissionReview
+			if err := json.Unmarshal(recorder.Body.Bytes(), &review); err != nil {
+				t.Fatalf("decode response: %v", err)
+			}
+			if review.Response == nil {
+				t.Fatal("response carries no AdmissionResponse")
+			}
+			if review.Response.Allowed || !strings.Contains(review.Response.Result.Message, "contains no request") {
+				t.Errorf("response = %+v, want a denial for the missing request", review.Response)
+			}
+		})
+	}
+}
+
+func TestExcludedNamespaces(t *testing.T) {
+	running := withResources(scopePod(), cpuMemory("2", "2Gi"), cpuMemory("2", "2Gi"))
+	tests := []struct {
+		name     string
+		excluded string
+		allowed  bool
+	}{
+		{"namespace excluded", "kube-system, tenant-a-ns", true},
+		{"other namespaces excluded", "kube-system,monitoring", false},
+		{"nothing excluded", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "maxPods": "1", "excludedNamespaces": tt.excluded}, running)
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, withResources(scopePod(), cpuMemory("8", "8Gi"), cpuMemory("8", "8Gi")), nil))
+			if resp.Allowed != tt.allowed {
+				t.Fatalf("Allowed = %v, want %v (result: %v)", resp.Allowed, tt.allowed, resp.Result)
+			}
+			if !tt.allowed && !strings.Contains(resp.Result.Message, "exceeded") {
+				t.Errorf("message = %q, want a quota rejection", resp.Result.Message)
+			}
+		})
+	}
+}
+
+func TestExcludedNamespacePatterns(t *testing.T) {
+	tests := []struct {
+		pattern   string
+		namespace string
+		want      bool
+	}{
+		{"kube-*", "kube-system", true},
+		{"kube-*", "kube-", true},
+		{"kube-*", "tenant-kube-system", false},
+		{"*-system", "istio-system", true},
+		{"*-system", "istio-system-2", false},
+		{"tenant-*-system", "tenant-a-system", true},
+		{"tenant-*-system", "tenant-a-b-system", true},
+		{"tenant-*-system", "tenant-system", false},
+		{"tenant-?", "tenant-a", true},
+		{"tenant-?", "tenant-ab", false},
+		{"monitoring", "monitoring", true},
+		{"monitoring", "monitoring-2", false},
+	}
+	for _, tt := range tests {
+		config, err := parseConfig(map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "excludedNamespaces": tt.pattern})
+		if err != nil {
+			t.Fatalf("parseConfig(%q) error: %v", tt.pattern, err)
+		}
+		if got := config.namespaceExcluded(tt.namespace); got != tt.want {
+			t.Errorf("pattern %q excludes %q = %v, want %v", tt.pattern, tt.namespace, got, tt.want)
+		}
+	}
+
+	for _, pattern := range []string{"kube-[", "tenant-[a-", `tenant-\`} {
+		if _, err := parseConfig(map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "excludedNamespaces": "kube-system," + pattern}); err == nil {
+			t.Errorf("parseConfig accepted the invalid pattern %q", pattern)
+		}
+	}
+}
+
+func TestCustomTenantLabelKey(t *testing.T) {
+	const key = "example.com/tenant"
+	config, err := parseConfig(map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "tenantLabelKey": key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod := func(cpu string) *corev1.Pod {
+		return withResources(scopePod(), cpuMemory(cpu, "512Mi"), cpuMemory(cpu, "512Mi"))
+	}
+	relabel := func(pod *corev1.Pod) *corev1.Pod {
+		pod.Labels = map[string]string{key: pod.Labels[defaultTenantLabelKey]}
+		return pod
+	}
+
+	tests := []struct {
+		name    string
+		pod     *corev1.Pod
+		allowed bool
+		message string
+	}{
+		{"within quota", relabel(pod("500m")), true, ""},
+		{"over quota", relabel(pod("1500m")), false, "CPU limit exceeded: requested 1500m on top of 1 used"},
+		{"default key is not a tenant", pod("8"), true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Only the pod with the custom key is charged to the tenant.
+			ctrl := newAPIServerController(t, servePods(*relabel(pod("1")), *pod("1")))
+			ctrl.setConfig(config)
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestTeamQuotas(t *testing.T) {
+	data := map[string]string{"limitCPU": "2", "limitMemory": "4Gi", "teamLabelKey": "team", "teamOverrides": `{"tenant-a/web": {"limitCPU": "1500m"}}`}
+	teamPod := func(name, team, cpu string) *corev1.Pod {
+		pod := testPod(name, "tenant-a", cpu, "512Mi")
+		if team != "" {
+			pod.Labels["team"] = team
+		}
+		return pod
+	}
+	running := []runtime.Object{teamPod("web-0", "web", "1"), teamPod("api-0", "api", "1"), teamPod("shared-0", "", "1")}
+
+	tests := []struct {
+		name    string
+		data    map[string]string
+		pod     *corev1.Pod
+		allowed bool
+		message string
+	}{
+		{"team within its override", data, teamPod("web-1", "web", "500m"), true, ""},
+		{"team over its override", data, teamPod("web-1", "web", "1"), false, "CPU limit exceeded: requested 1 on top of 1 used, limit is 1500m"},
+		{"team within the tenant limit", data, teamPod("api-1", "api", "1"), true, ""},
+		{"team over the tenant limit", data, teamPod("api-1", "api", "1500m"), false, "CPU limit exceeded: requested 1500m on top of 1 used, limit is 2"},
+		{"pods without a team share a quota", data, teamPod("shared-1", "", "1500m"), false, "requested 1500m on top of 1 used"},
+		{"teams not configured", map[string]string{"limitCPU": "4", "limitMemory": "4Gi"}, teamPod("web-1", "web", "1500m"), false, "requested 1500m on top of 3 used"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(tt.data, running...)
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+
+	// A pod admitted for one team is not charged to the other.
+	ctrl := newTestController(data, running...)
+	checkResponse(t, ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, teamPod("api-1", "api", "1"), nil)), true, "")
+	checkResponse(t, ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, teamPod("web-1", "web", "500m"), nil)), true, "")
+	checkResponse(t, ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, teamPod("api-2", "api", "100m"), nil)), false, "requested 100m on top of 2 used")
+}
+
+func TestNamespaceTenants(t *testing.T) {
+	mapped := map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "namespaceTenants": `{"` + testNamespace + `": "tenant-a"}`}
+	labelless := func(name, cpu string) *corev1.Pod {
+		pod := testPod(name, "", cpu, "256Mi")
+		pod.Labels = nil
+		return pod
+	}
+
+	tests := []struct {
+		name    string
+		data    map[string]string
+		pod     *corev1.Pod
+		allowed bool
+		message string
+	}{
+		{"labelless pod within the mapped tenant's quota", mapped, labelless("new", "500m"), true, ""},
+		{"labelless pod over the mapped tenant's quota", mapped, labelless("new", "1"), false, "CPU limit exceeded: requested 1 on top of 1500m used, limit is 2"},
+		{"labelled pod counts the labelless pods", mapped, testPod("new", "tenant-a", "1", "256Mi"), false, "requested 1 on top of 1500m used"},
+		{"label wins over the mapping", mapped, testPod("new", "tenant-b", "1500m", "256Mi"), true, ""},
+		{"namespace not mapped", withData(mapped, map[string]string{"namespaceTenants": `{"other": "tenant-a"}`}), labelless("new", "8"), true, ""},
+		{"no mapping", map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}, labelless("new", "8"), true, ""},
+		{"invalid mapping", withData(mapped, map[string]string{"namespaceTenants": `["tenant-a"]`}), labelless("new", "500m"), false, "invalid namespaceTenants"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(tt.data, testPod("running", "tenant-a", "1", "1Gi"), labelless("unlabeled", "500m"))
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestTenantOverrides(t *testing.T) {
+	config, err := parseConfig(map[string]string{
+		"limitCPU":        "2",
+		"limitMemory":     "2Gi",
+		"tenantOverrides": `{"tenant-a": {"limitCPU": "8"}, "tenant-b": {"limitCPU": "1", "limitMemory": "1Gi"}}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		pod     *corev1.Pod
+		allowed bool
+		message string
+	}{
+		{"raised tenant within its limit", testPod("new", "tenant-a", "6", "512Mi"), true, ""},
+		{"raised tenant over its limit", testPod("new", "tenant-a", "8", "512Mi"), false, "CPU limit exceeded: requested 8 on top of 1 used, limit is 8"},
+		{"raised tenant falls back to the global memory limit", testPod("new", "tenant-a", "1", "1536Mi"), false, "Memory limit exceeded: requested 1536Mi on top of 1Gi used, limit is 2Gi"},
+		{"lowered tenant over its limit", testPod("new", "tenant-b", "1", "512Mi"), false, "CPU limit exceeded: requested 1 on top of 500m used, limit is 1"},
+		{"lowered tenant within its limit", testPod("new", "tenant-b", "500m", "512Mi"), true, ""},
+		{"tenant without an override", testPod("new", "tenant-c", "3", "512Mi"), false, "limit is 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newAPIServerController(t, servePods(*testPod("running-a", "tenant-a", "1", "1Gi"), *testPod("running-b", "tenant-b", "500m", "256Mi")))
+			ctrl.setConfig(config)
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestTenantSelector(t *testing.T) {
+	key := defaultTenantLabelKey
+	tests := []struct {
+		name    string
+		tenant  string
+		team    string
+		teamKey string
+		want    string
+		wantErr bool
+	}{
+		{name: "tenant", tenant: "tenant-a", want: key + "=tenant-a"},
+		{name: "unlabeled pods", want: "!" + key},
+		{name: "tenant and team", tenant: "tenant-a", team: "web", teamKey: "team", want: "team=web," + key + "=tenant-a"},
+		{name: "tenant without a team", tenant: "tenant-a", teamKey: "team", want: "!team," + key + "=tenant-a"},
+		{name: "value with a space", tenant: "tenant a", wantErr: true},
+		{name: "value with a comma", tenant: "tenant-a,other=x", wantErr: true},
+		{name: "value too long", tenant: strings.Repeat("a", 64), wantErr: true},
+		{name: "invalid team", tenant: "tenant-a", team: "web/api", teamKey: "team", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := Config{TenantLabelKey: key, TeamLabelKey: tt.teamKey}
+			selector, err := config.tenantSelector(tt.tenant, tt.team)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("tenantSelector() = %q, want an error", selector)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("tenantSelector() error: %v", err)
+			}
+			if got := selector.String(); got != tt.want {
+				t.Errorf("tenantSelector() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvalidTenantLabelValue(t *testing.T) {
+	ctrl := newTestController(map[string]string{"limitCPU": "2", "limitMemory": "2Gi"})
+	resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("new", "tenant a,b", "1", "1Gi"), nil))
+	checkResponse(t, resp, false, "invalid tenant label")
+
+	for _, action := range ctrl.client.(*fake.Clientset).Actions() {
+		if action.Matches("list", "pods") {
+			t.Errorf("listed pods with an invalid selector: %+v", action)
+		}
+	}
+}
+
+func TestGetPodsWithLabelSelectors(t *testing.T) {
+	inPhase := func(name, tenant string, phase corev1.PodPhase) corev1.Pod {
+		pod := testPod(name, tenant, "1", "1Gi")
+		pod.Status.Phase = phase
+		return *pod
+	}
+	var queries []url.Values
+	pods := servePods(
+		inPhase("running", "tenant-a", corev1.PodRunning),
+		inPhase("pending", "tenant-a", corev1.PodPending),
+		inPhase("succeeded", "tenant-a", corev1.PodSucceeded),
+		inPhase("failed", "tenant-a", corev1.PodFailed),
+		inPhase("other", "tenant-b", corev1.PodRunning),
+	)
+	ctrl := newAPIServerController(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query())
+		pods(w, r)
+	}))
+
+	selector := labels.SelectorFromSet(labels.Set{defaultTenantLabelKey: "tenant-a"})
+	listed, err := ctrl.getPodsWithLabel(context.Background(), testNamespace, selector)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(queries) != 1 {
+		t.Fatalf("listed pods %d times, want once", len(queries))
+	}
+	if got := queries[0].Get("labelSelector"); got != selector.String() {
+		t.Errorf("label selector = %q, want %q", got, selector.String())
+	}
+	if got := queries[0].Get("fieldSelector"); got != "status.phase!=Succeeded,status.phase!=Failed" {
+		t.Errorf("field selector = %q, want both finished phases excluded", got)
+	}
+	var names []string
+	for _, pod := range listed {
+		names = append(names, pod.Name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "pending,running" {
+		t.Errorf("listed pods %v, want [pending running]", names)
+	}
+}
+
+func TestFailurePolicyOnAPIError(t *testing.T) {
+	data := map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}
+	allow := map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "failurePolicy": failurePolicyAllow}
+	tests := []struct {
+		name    string
+		data    map[string]string
+		global  string
+		failing string
+		cpu     string
+		allowed bool
+		message string
+	}{
+		{"config lookup fails closed by default", data, failurePolicyFail, "configmaps", "1", false, "could not load config"},
+		{"config lookup fails open", data, failurePolicyAllow, "configmaps", "1", true, ""},
+		{"pod list fails closed by default", data, failurePolicyFail, "pods", "1", false, "could not list pods"},
+		{"pod list fails open", allow, failurePolicyFail, "pods", "1", true, ""},
+		{"quota violations are denied when failing open", allow, failurePolicyAllow, "", "3", false, "CPU limit exceeded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configMap, pods := serveConfigMap(tt.data), servePods()
+			ctrl := newAPIServerController(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case tt.failing != "" && strings.Contains(r.URL.Path, "/"+tt.failing):
+					http.Error(w, "connection refused", http.StatusInternalServerError)
+				case strings.Contains(r.URL.Path, "/pods"):
+					pods(w, r)
+				default:
+					configMap(w, r)
+				}
+			}))
+			ctrl.failurePolicy = tt.global
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("new", "tenant-a", tt.cpu, "1Gi"), nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestOvercommitRatio(t *testing.T) {
+	requestScope := map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "quotaScope": "Requests"}
+	requestQuota := map[string]string{"limitCPU": "8", "limitMemory": "8Gi", "requestCPU": "2", "requestMemory": "2Gi"}
+	ratio := func(data map[string]string, value string) map[string]string {
+		withRatio := map[string]string{"overcommitRatio": value}
+		for key, value := range data {
+			withRatio[key] = value
+		}
+		return withRatio
+	}
+
+	tests := []struct {
+		name    string
+		data    map[string]string
+		pod     *corev1.Pod
+		allowed bool
+		message string
+	}{
+		{"requests scope at 1.0", ratio(requestScope, "1"), testPod("new", "tenant-a", "1500m", "512Mi"), false, "CPU limit exceeded"},
+		{"requests scope at 1.5", ratio(requestScope, "1.5"), testPod("new", "tenant-a", "1500m", "512Mi"), true, ""},
+		{"requests scope over 1.5", ratio(requestScope, "1.5"), testPod("new", "tenant-a", "2500m", "512Mi"), false, "limit is 3"},
+		{"request quota at 1.0", ratio(requestQuota, "1"), testPod("new", "tenant-a", "1500m", "512Mi"), false, "CPU request quota exceeded"},
+		{"request quota at 1.5", ratio(requestQuota, "1.5"), testPod("new", "tenant-a", "1500m", "512Mi"), true, ""},
+		{"limits stay strict in the limits scope", ratio(map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}, "1.5"), testPod("new", "tenant-a", "1500m", "512Mi"), false, "limit is 2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(tt.data, testPod("running", "tenant-a", "1", "1Gi"))
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+
+	for _, value := range []string{"0", "-1", "lots"} {
+		if _, err := parseConfig(ratio(requestScope, value)); err == nil {
+			t.Errorf("parseConfig() accepted overcommitRatio %q", value)
+		}
+	}
+}
+
+func TestBurstPercent(t *testing.T) {
+	data := map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "burstPercent": "10"}
+	burst := func(data map[string]string, value string) map[string]string {
+		return withData(data, map[string]string{"burstPercent": value})
+	}
+
+	tests := []struct {
+		name    string
+		data    map[string]string
+		pod     *corev1.Pod
+		allowed bool
+		message string
+	}{
+		{"within the burst band", data, testPod("new", "tenant-a", "1200m", "512Mi"), true, ""},
+		{"at the top of the burst band", data, testPod("new", "tenant-a", "1200m", "1288490188"), true, ""},
+		{"a byte over the burst band", data, testPod("new", "tenant-a", "1200m", "1288490189"), false, "Memory limit exceeded: requested 1288490189 on top of 1Gi used, limit is 2362232012"},
+		{"over the burst band", data, testPod("new", "tenant-a", "1300m", "512Mi"), false, "CPU limit exceeded: requested 1300m on top of 1 used, limit is 2200m"},
+		{"no burst allowance", burst(data, "0"), testPod("new", "tenant-a", "1200m", "512Mi"), false, "limit is 2"},
+		{"requests scope", withData(data, map[string]string{"quotaScope": "Requests"}), testPod("new", "tenant-a", "1200m", "512Mi"), true, ""},
+		{"request quota is not raised", withData(data, map[string]string{"limitCPU": "8", "requestCPU": "2"}), testPod("new", "tenant-a", "1200m", "512Mi"), false, "CPU request quota exceeded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(tt.data, testPod("running", "tenant-a", "1", "1Gi"))
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+
+	for _, value := range []string{"-1", "101", "ten"} {
+		if _, err := parseConfig(burst(data, value)); err == nil {
+			t.Errorf("parseConfig() accepted burstPercent %q", value)
+		}
+	}
+}
+
+func TestQOSClassQuotas(t *testing.T) {
+	data := map[string]string{"limitCPU": "8", "limitMemory": "8Gi", "limitGuaranteedCPU": "4", "limitBurstableCPU": "2"}
+	burstable := func(cpu string) *corev1.Pod {
+		return withResources(testPod("new", "tenant-a", cpu, "256Mi"), cpuMemory("100m", "128Mi"), cpuMemory(cpu, "256Mi"))
+	}
+
+	tests := []struct {
+		name    string
+		data    map[string]string
+		pod     *corev1.Pod
+		allowed bool
+		message string
+	}{
+		{"burstable within its class quota", data, burstable("1"), true, ""},
+		{"burstable over its class quota with guaranteed room", data, burstable("1500m"), false, "CPU burstable quota exceeded: requested 1500m on top of 1 used, burstable quota is 2"},
+		{"guaranteed within its class quota", data, testPod("new", "tenant-a", "3", "1Gi"), true, ""},
+		{"guaranteed over its class quota", data, testPod("new", "tenant-a", "3600m", "1Gi"), false, "CPU guaranteed quota exceeded"},
+		{"no class quotas", withData(data, map[string]string{"limitGuaranteedCPU": "", "limitBurstableCPU": ""}), burstable("1500m"), true, ""},
+		{"overall limit still applies", withData(data, map[string]string{"limitCPU": "2"}), burstable("1"), false, "CPU limit exceeded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(tt.data,
+				testPod("guaranteed", "tenant-a", "500m", "512Mi"),
+				withResources(testPod("burstable", "tenant-a", "1", "512Mi"), cpuMemory("100m", "128Mi"), cpuMemory("1", "512Mi")))
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestEnforceRequestsLeqLimits(t *testing.T) {
+	data := map[string]string{"limitCPU": "4", "limitMemory": "4Gi", "enforceRequestsLeqLimits": "true"}
+	pod := func(requestCPU, requestMemory string) *corev1.Pod {
+		return withResources(testPod("new", "tenant-a", "1", "1Gi"), cpuMemory(requestCPU, requestMemory), cpuMemory("1", "1Gi"))
+	}
+
+	tests := []struct {
+		name    string
+		data    map[string]string
+		pod     *corev1.Pod
+		allowed bool
+		message string
+	}{
+		{"requests equal to the limits", data, pod("1", "1Gi"), true, ""},
+		{"requests below the limits", data, pod("500m", "512Mi"), true, ""},
+		{"memory request above its limit", data, pod("1", "2Gi"), false, `container "app" requests 2Gi Memory which exceeds its limit of 1Gi`},
+		{"cpu request above its limit", data, pod("1500m", "1Gi"), false, `container "app" requests 1500m CPU which exceeds its limit of 1`},
+		{"check disabled", withData(data, map[string]string{"enforceRequestsLeqLimits": "false"}), pod("1", "2Gi"), true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(tt.data)
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestMinContainerRequests(t *testing.T) {
+	data := map[string]string{"limitCPU": "4", "limitMemory": "4Gi", "minContainerCPURequest": "100m", "minContainerMemoryRequest": "64Mi"}
+	pod := func(requestCPU, requestMemory string) *corev1.Pod {
+		return withResources(testPod("new", "tenant-a", "1", "1Gi"), cpuMemory(requestCPU, requestMemory), cpuMemory("2", "1Gi"))
+	}
+
+	tests := []struct {
+		name    string
+		data    map[string]string
+		pod     *corev1.Pod
+		allowed bool
+		message string
+	}{
+		{"requests above the floor", data, pod("500m", "128Mi"), true, ""},
+		{"requests at the floor", data, pod("100m", "64Mi"), true, ""},
+		{"cpu request below the floor", data, pod("10m", "128Mi"), false, `container "app" requests 10m CPU which is below the per-container minimum of 100m`},
+		{"memory request below the floor", data, pod("500m", "1Mi"), false, `container "app" requests 1Mi Memory which is below the per-container minimum of 64Mi`},
+		{"missing request defaults to the limit", data, pod("", "128Mi"), true, ""},
+		{"no floor", map[string]string{"limitCPU": "4", "limitMemory": "4Gi"}, pod("1m", "1Mi"), true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(tt.data)
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestRequireLimitsAndRequests(t *testing.T) {
+	strict := map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}
+	lenient := withData(strict, map[string]string{"requireLimitsAndRequests": "false"})
+	withoutLimits := func(cpu string) *corev1.Pod {
+		return withResources(testPod("new", "tenant-a", "1", "1Gi"), cpuMemory(cpu, "256Mi"), nil)
+	}
+
+	tests := []struct {
+		name    string
+		data    map[string]string
+		pod     *corev1.Pod
+		allowed bool
+		message string
+	}{
+		{"strict mode rejects missing limits", strict, withoutLimits("100m"), false, "must specify both resource limits and requests"},
+		{"lenient mode allows missing limits", lenient, withoutLimits("100m"), true, ""},
+		{"lenient mode still enforces the limits that are set", lenient, withResources(testPod("new", "tenant-a", "1", "1Gi"), nil, cpuMemory("1500m", "")), false, "CPU limit exceeded"},
+		{"lenient mode in the requests scope", withData(lenient, map[string]string{"quotaScope": "Requests"}), withoutLimits("1500m"), false, "CPU limit exceeded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(tt.data, testPod("running", "tenant-a", "1", "1Gi"))
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestPodUpdate(t *testing.T) {
+	data := map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}
+	relabeled := testPod("web", "tenant-a", "1", "1Gi")
+	relabeled.Labels["version"] = "2"
+
+	tests := []struct {
+		name    string
+		data    map[string]string
+		pod     *corev1.Pod
+		allowed bool
+		message string
+	}{
+		{"limits raised within quota", data, testPod("web", "tenant-a", "1500m", "1Gi"), true, ""},
+		{"limits raised beyond quota", data, testPod("web", "tenant-a", "2", "1Gi"), false, "CPU limit exceeded"},
+		{"label-only update", data, relabeled, true, ""},
+		// Lowering the quota below usage must not block metadata updates.
+		{"label-only update over a lowered quota", withData(data, map[string]string{"limitCPU": "1"}), relabeled, true, ""},
+		{"limits lowered over a lowered quota", withData(data, map[string]string{"limitCPU": "1"}), testPod("web", "tenant-a", "500m", "1Gi"), true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := testPod("web", "tenant-a", "1", "1Gi")
+			ctrl := newTestController(tt.data, old, testPod("other", "tenant-a", "500m", "512Mi"))
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Update, tt.pod, old))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestShrinkingUpdateOverQuota(t *testing.T) {
+	// Lowering the quota left the tenant with 3 CPUs and 3Gi in use.
+	data := map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "maxPods": "2"}
+	running := append(runningPods("tenant-a", 2, "1", "1Gi"), testPod("db", "tenant-a", "1", "1Gi"))
+	old := testPod("db", "tenant-a", "1", "1Gi")
+
+	tests := []struct {
+		name     string
+		resource schema.GroupVersionResource
+		object   interface{}
+		old      interface{}
+		allowed  bool
+		message  string
+	}{
+		{name: "pod shrinking cpu", resource: podsResource, object: testPod("db", "tenant-a", "500m", "1Gi"), old: old, allowed: true},
+		{name: "pod shrinking memory", resource: podsResource, object: testPod("db", "tenant-a", "1", "512Mi"), old: old, allowed: true},
+		{name: "pod shrinking everything", resource: podsResource, object: testPod("db", "tenant-a", "100m", "128Mi"), old: old, allowed: true},
+		{name: "pod unchanged", resource: podsResource, object: testPod("db", "tenant-a", "1", "1Gi"), old: old, allowed: true},
+		{name: "pod growing", resource: podsResource, object: testPod("db", "tenant-a", "1500m", "1Gi"), old: old, message: "CPU limit exceeded"},
+		{name: "pod trading memory for cpu", resource: podsResource, object: testPod("db", "tenant-a", "1500m", "512Mi"), old: old, message: "CPU limit exceeded"},
+		{
+			name: "deployment scaling down", resource: deploymentsResource,
+			object: testDeployment("web", "tenant-a", 1, "1", "1Gi"), old: testDeployment("web", "tenant-a", 2, "1", "1Gi"), allowed: true,
+		},
+		{
+			name: "deployment scaling up", resource: deploymentsResource,
+			object: testDeployment("web", "tenant-a", 3, "1", "1Gi"), old: testDeployment("web", "tenant-a", 2, "1", "1Gi"), message: "exceeded",
+		},
+		{name: "new pod", resource: podsResource, object: testPod("new", "tenant-a", "100m", "128Mi"), message: "exceeded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			operation := admissionv1.Update
+			if tt.old == nil {
+				operation = admissionv1.Create
+			}
+			ctrl := newTestController(data, running...)
+			resp := ctrl.processAdmissionReview(context.Background(), admissionReview(t, metav1.GroupVersionResource(tt.resource), operation, tt.object, tt.old))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestPodUpdateNotDoubleCounted(t *testing.T) {
+	data := map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}
+	twoContainers := func(app, sidecar string) *corev1.Pod {
+		pod := testPod("web", "tenant-a", app, "512Mi")
+		pod.Spec.Containers = append(pod.Spec.Containers, testContainer("sidecar", sidecar, "512Mi"))
+		return pod
+	}
+
+	tests := []struct {
+		name    string
+		old     *corev1.Pod
+		pod     *corev1.Pod
+		allowed bool
+		message string
+	}{
+		{"cpu moved between containers at the limit", twoContainers("1", "500m"), twoContainers("500m", "1"), true, ""},
+		{"unchanged pod at the limit", testPod("web", "tenant-a", "1500m", "1Gi"), testPod("web", "tenant-a", "1500m", "1Gi"), true, ""},
+		{"resize up to the limit", testPod("web", "tenant-a", "1", "1Gi"), testPod("web", "tenant-a", "1500m", "1Gi"), true, ""},
+		{"resize past the limit", testPod("web", "tenant-a", "1", "1Gi"), testPod("web", "tenant-a", "1600m", "1Gi"), false, "CPU limit exceeded: requested 1600m on top of 500m used"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(data, tt.old, testPod("other", "tenant-a", "500m", "512Mi"))
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Update, tt.pod, tt.old))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestRejectionNamesContainer(t *testing.T) {
+	data := map[string]string{"limitCPU": "10", "limitMemory": "10Gi", "maxContainerCPU": "1", "minContainerMemoryRequest": "32Mi", "enforceRequestsLeqLimits": "true"}
+	withSidecar := func(sidecar corev1.Container) *corev1.Pod {
+		pod := testPod("new", "tenant-a", "500m", "256Mi")
+		sidecar.Name = "log-shipper"
+		pod.Spec.Containers = append(pod.Spec.Containers, sidecar)
+		return pod
+	}
+	unbounded := testContainer("", "100m", "64Mi")
+	unbounded.Resources.Limits = nil
+	inverted := testContainer("", "100m", "64Mi")
+	inverted.Resources.Requests[corev1.ResourceMemory] = resource.MustParse("128Mi")
+
+	tests := []struct {
+		name    string
+		sidecar corev1.Container
+		message string
+	}{
+		{"missing limits", unbounded, `container "log-shipper" must specify both resource limits and requests`},
+		{"request above the limit", inverted, `container "log-shipper" requests 128Mi Memory which exceeds its limit of 64Mi`},
+		{"over the per-container maximum", testContainer("", "2", "64Mi"), `container "log-shipper" uses 2 CPU which exceeds the per-container maximum of 1`},
+		{"below the per-container minimum", testContainer("", "100m", "16Mi"), `container "log-shipper" requests 16Mi Memory which is below the per-container minimum of 32Mi`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(data)
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, withSidecar(tt.sidecar), nil))
+			if resp.Allowed {
+				t.Fatalf("Allowed = true, want false")
+			}
+			if !strings.Contains(resp.Result.Message, tt.message) {
+				t.Errorf("message = %q, want it to contain %q", resp.Result.Message, tt.message)
+			}
+		})
+	}
+}
+
+func TestWarnThresholdPercent(t *testing.T) {
+	data := map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "warnThresholdPercent": "90"}
+	tests := []struct {
+		name     string
+		data     map[string]string
+		pod      *corev1.Pod
+		allowed  bool
+		warnings []string
+	}{
+		{"crossing 90%", data, testPod("new", "tenant-a", "900m", "256Mi"), true, []string{"CPU limit is 95% used: 1900m of 2"}},
+		{"crossing 90% of both", data, testPod("new", "tenant-a", "900m", "900Mi"), true, []string{"CPU limit is 95% used: 1900m of 2", "Memory limit is 94% used: 1924Mi of 2Gi"}},
+		{"filling the quota", data, testPod("new", "tenant-a", "1", "256Mi"), true, []string{"CPU limit is 100% used: 2 of 2"}},
+		{"below 90%", data, testPod("new", "tenant-a", "500m", "256Mi"), true, nil},
+		{"threshold disabled", withData(data, map[string]string{"warnThresholdPercent": "0"}), testPod("new", "tenant-a", "900m", "256Mi"), true, nil},
+		{"over quota", data, testPod("new", "tenant-a", "1500m", "256Mi"), false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(tt.data, testPod("running", "tenant-a", "1", "1Gi"))
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+			if resp.Allowed != tt.allowed {
+				t.Fatalf("Allowed = %v, want %v (result: %v)", resp.Allowed, tt.allowed, resp.Result)
+			}
+			if strings.Join(resp.Warnings, "\n") != strings.Join(tt.warnings, "\n") {
+				t.Errorf("warnings = %q, want %q", resp.Warnings, tt.warnings)
+			}
+		})
+	}
+
+	for _, value := range []string{"-1", "101", "ninety"} {
+		if _, err := parseConfig(withData(data, map[string]string{"warnThresholdPercent": value})); err == nil {
+			t.Errorf("parseConfig() accepted warnThresholdPercent %q", value)
+		}
+	}
+}
+
+func TestSoftLimits(t *testing.T) {
+	data := map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "softLimitCPU": "1500m", "softLimitMemory": "1536Mi"}
+	tests := []struct {
+		name     string
+		data     map[string]string
+		pod      *corev1.Pod
+		allowed  bool
+		warnings []string
+	}{
+		{"below the soft limits", data, testPod("new", "tenant-a", "250m", "256Mi"), true, nil},
+		{"at the soft limit", data, testPod("new", "tenant-a", "500m", "256Mi"), true, nil},
+		{"above the soft limit", data, testPod("new", "tenant-a", "750m", "256Mi"), true, []string{"CPU usage of 1750m is above the soft limit of 1500m"}},
+		{"above both soft limits", data, testPod("new", "tenant-a", "1", "1Gi"), true, []string{"CPU usage of 2 is above the soft limit of 1500m", "Memory usage of 2Gi is above the soft limit of 1536Mi"}},
+		{"above the hard limit", data, testPod("new", "tenant-a", "1500m", "256Mi"), false, nil},
+		{"soft limits disabled", map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}, testPod("new", "tenant-a", "750m", "256Mi"), true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(tt.data, testPod("running", "tenant-a", "1", "1Gi"))
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+			if resp.Allowed != tt.allowed {
+				t.Fatalf("Allowed = %v, want %v (result: %v)", resp.Allowed, tt.allowed, resp.Result)
+			}
+			if !tt.allowed && !strings.Contains(resp.Result.Message, "CPU limit exceeded") {
+				t.Errorf("message = %q, want it to contain %q", resp.Result.Message, "CPU limit exceeded")
+			}
+			if strings.Join(resp.Warnings, "\n") != strings.Join(tt.warnings, "\n") {
+				t.Errorf("warnings = %q, want %q", resp.Warnings, tt.warnings)
+			}
+		})
+	}
+
+	config, err := parseConfig(withData(data, map[string]string{"softLimitCPU": "3"}))
+	if err == nil {
+		_, err = parseQuota(config)
+	}
+	if err == nil || !strings.Contains(err.Error(), "above the limit") {
+		t.Errorf("soft limit above the limit: error = %v, want it rejected", err)
+	}
+}
+
+func TestBypassAnnotation(t *testing.T) {
+	data := map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "bypassUsers": "admin, system:serviceaccounts:kube-system"}
+	annotated := func(value string) *corev1.Pod {
+		pod := testPod("new", "tenant-a", "4", "4Gi")
+		pod.Annotations = map[string]string{bypassAnnotation: value}
+		return pod
+	}
+
+	tests := []struct {
+		name    string
+		pod     *corev1.Pod
+		user    authenticationv1.UserInfo
+		allowed bool
+	}{
+		{"allowlisted user", annotated("true"), authenticationv1.UserInfo{Username: "admin"}, true},
+		{"allowlisted group", annotated("true"), authenticationv1.UserInfo{Username: "system:serviceaccount:kube-system:deployer", Groups: []string{"system:serviceaccounts:kube-system"}}, true},
+		{"unauthorized user", annotated("true"), authenticationv1.UserInfo{Username: "tenant-a-user", Groups: []string{"system:authenticated"}}, false},
+		{"allowlisted user without the annotation", testPod("new", "tenant-a", "4", "4Gi"), authenticationv1.UserInfo{Username: "admin"}, false},
+		{"annotation not set to true", annotated("yes"), authenticationv1.UserInfo{Username: "admin"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(data)
+			ar := podReview(t, admissionv1.Create, tt.pod, nil)
+			ar.Request.UserInfo = tt.user
+			resp := ctrl.processAdmissionReview(context.Background(), ar)
+			if resp.Allowed != tt.allowed {
+				t.Fatalf("Allowed = %v, want %v (result: %v)", resp.Allowed, tt.allowed, resp.Result)
+			}
+			if !tt.allowed && !strings.Contains(resp.Result.Message, "CPU limit exceeded") {
+				t.Errorf("message = %q, want it to contain %q", resp.Result.Message, "CPU limit exceeded")
+			}
+		})
+	}
+}
+
+func TestVerifyTenantIdentity(t *testing.T) {
+	data := map[string]string{
+		"limitCPU":             "2",
+		"limitMemory":          "2Gi",
+		"verifyTenantIdentity": "true",
+		"tenantUsers":          `{"tenant-a": ["system:serviceaccount:vcluster-a:vc-a"], "tenant-b": ["system:serviceaccounts:vcluster-b"]}`,
+	}
+	syncerA := authenticationv1.UserInfo{Username: "system:serviceaccount:vcluster-a:vc-a", Groups: []string{"system:serviceaccounts:vcluster-a"}}
+	syncerB := authenticationv1.UserInfo{Username: "system:serviceaccount:vcluster-b:vc-b", Groups: []string{"system:serviceaccounts:vcluster-b"}}
+
+	tests := []struct {
+		name    string
+		data    map[string]string
+		tenant  string
+		user    authenticationv1.UserInfo
+		allowed bool
+		message string
+	}{
+		{"syncer of the tenant", data, "tenant-a", syncerA, true, ""},
+		{"group of the tenant", data, "tenant-b", syncerB, true, ""},
+		{"syncer of another tenant", data, "tenant-b", syncerA, false, `may not create pods for tenant "tenant-b"`},
+		{"tenant without users", data, "tenant-c", syncerA, false, `may not create pods for tenant "tenant-c"`},
+		{"verification disabled", withData(data, map[string]string{"verifyTenantIdentity": "false"}), "tenant-b", syncerA, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(tt.data)
+			ar := podReview(t, admissionv1.Create, testPod("new", tt.tenant, "1", "1Gi"), nil)
+			ar.Request.UserInfo = tt.user
+			resp := ctrl.processAdmissionReview(context.Background(), ar)
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestRequireTenantLabel(t *testing.T) {
+	data := map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "requireTenantLabel": "true"}
+	tests := []struct {
+		name    string
+		data    map[string]string
+		tenant  string
+		allowed bool
+		message string
+	}{
+		{"labelless pod in a watched namespace", withData(data, map[string]string{"tenantNamespaces": "other, tenant-a-ns"}), "", false, "pods in namespace tenant-a-ns must carry the " + defaultTenantLabelKey + " label"},
+		{"labelless pod in another namespace", withData(data, map[string]string{"tenantNamespaces": "other"}), "", true, ""},
+		{"labelless pod with every namespace watched", data, "", false, "must carry the"},
+		{"labelled pod in a watched namespace", withData(data, map[string]string{"tenantNamespaces": "tenant-a-ns"}), "tenant-a", true, ""},
+		{"labelless pod in an excluded namespace", withData(data, map[string]string{"excludedNamespaces": "tenant-a-ns"}), "", true, ""},
+		{"label not required", withData(data, map[string]string{"requireTenantLabel": "false", "tenantNamespaces": "tenant-a-ns"}), "", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := testPod("new", tt.tenant, "1", "1Gi")
+			if tt.tenant == "" {
+				pod.Labels = nil
+			}
+			ctrl := newTestController(tt.data)
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, pod, nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestMaxContainerLimits(t *testing.T) {
+	data := map[string]string{"limitCPU": "10", "limitMemory": "10Gi", "maxContainerCPU": "1", "maxContainerMemory": "1Gi"}
+	withContainers := func(containers ...corev1.Container) *corev1.Pod {
+		pod := testPod("new", "tenant-a", "500m", "256Mi")
+		pod.Spec.Containers = containers
+		return pod
+	}
+
+	tests := []struct {
+		name    string
+		pod     *corev1.Pod
+		allowed bool
+		message string
+	}{
+		{"every container within the maximum", withContainers(testContainer("app", "1", "1Gi"), testContainer("proxy", "1", "1Gi")), true, ""},
+		{"one oversized container", withContainers(testContainer("app", "500m", "256Mi"), testContainer("batch", "2", "256Mi")), false, `container "batch" uses 2 CPU which exceeds the per-container maximum of 1`},
+		{"oversized memory", withContainers(testContainer("app", "500m", "2Gi")), false, `container "app" uses 2Gi Memory which exceeds the per-container maximum of 1Gi`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(data)
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestBlockOverQuota(t *testing.T) {
+	// The zero-resource pods would be rejected for lacking limits otherwise.
+	data := map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "blockOverQuota": "true", "requireLimitsAndRequests": "false"}
+	over := []runtime.Object{testPod("a-1", "tenant-a", "2", "1Gi"), testPod("a-2", "tenant-a", "1", "512Mi")}
+	zeroResourcePod := func(name, tenant string) *corev1.Pod {
+		pod := testPod(name, tenant, "1", "1Gi")
+		pod.Spec.Containers[0].Resources = corev1.ResourceRequirements{}
+		return pod
+	}
+
+	tests := []struct {
+		name    string
+		data    map[string]string
+		running []runtime.Object
+		pod     *corev1.Pod
+		old     *corev1.Pod
+		allowed bool
+		message string
+	}{
+		{
+			name: "zero-resource pod of a tenant over quota", data: data, running: over, pod: zeroResourcePod("new", "tenant-a"),
+			message: `tenant "tenant-a" is already over quota (CPU limit: 3 used, limit is 2), new pods are rejected until its usage drops below the quota`,
+		},
+		{name: "tenant at its quota", data: data, running: []runtime.Object{testPod("a-1", "tenant-a", "2", "2Gi")}, pod: zeroResourcePod("new", "tenant-a"), allowed: true},
+		{name: "another tenant", data: data, running: over, pod: zeroResourcePod("new", "tenant-b"), allowed: true},
+		{name: "shrinking update of a tenant over quota", data: data, running: over, pod: testPod("a-2", "tenant-a", "500m", "512Mi"), old: testPod("a-2", "tenant-a", "1", "512Mi"), allowed: true},
+		{
+			name: "blocking disabled", data: withData(data, map[string]string{"blockOverQuota": "false"}), running: over, pod: zeroResourcePod("new", "tenant-a"),
+			message: "CPU limit exceeded: requested 0 on top of 3 used, limit is 2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(tt.data, tt.running...)
+			ar := podReview(t, admissionv1.Create, tt.pod, nil)
+			if tt.old != nil {
+				ar = podReview(t, admissionv1.Update, tt.pod, tt.old)
+			}
+			resp := ctrl.processAdmissionReview(context.Background(), ar)
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestCountEphemeralContainers(t *testing.T) {
+	data := map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}
+	debugged := testPod("debugged", "tenant-a", "1", "1Gi")
+	debug := testContainer("debug", "500m", "256Mi")
+	debugged.Spec.EphemeralContainers = []corev1.EphemeralContainer{{
+		EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debug", Resources: debug.Resources},
+	}}
+
+	tests := []struct {
+		name    string
+		data    map[string]string
+		allowed bool
+		message string
+	}{
+		{"ephemeral containers not counted", data, true, ""},
+		{"ephemeral containers counted", withData(data, map[string]string{"countEphemeralContainers": "true"}), false, "CPU limit exceeded: requested 1 on top of 1500m used"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(tt.data, debugged)
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("new", "tenant-a", "1", "512Mi"), nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestAuditAnnotations(t *testing.T) {
+	data := map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}
+	tests := []struct {
+		name string
+		data map[string]string
+		pod  *corev1.Pod
+		want map[string]string
+	}{
+		{"allowed pod", data, testPod("new", "tenant-a", "500m", "512Mi"), map[string]string{"quota.decision": "allowed"}},
+		{"denied pod", data, testPod("new", "tenant-a", "3", "512Mi"), map[string]string{"quota.decision": "denied", "quota.reason": "cpu_exceeded"}},
+		{"denied for memory", data, testPod("new", "tenant-a", "500m", "3Gi"), map[string]string{"quota.decision": "denied", "quota.reason": "memory_exceeded"}},
+		{"would be denied in audit mode", withData(data, map[string]string{"auditMode": "true"}), testPod("new", "tenant-a", "3", "512Mi"), map[string]string{"quota.decision": "would_deny", "quota.reason": "cpu_exceeded"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(tt.data)
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+			if !reflect.DeepEqual(resp.AuditAnnotations, tt.want) {
+				t.Errorf("audit annotations = %v, want %v", resp.AuditAnnotations, tt.want)
+			}
+			// The message may name users and objects, so it stays out.
+			for key, value := range resp.AuditAnnotations {
+				if strings.Contains(value, "tenant-a") || len(value) > 64 {
+					t.Errorf("annotation %s = %q, want a short value without details", key, value)
+				}
+			}
+		})
+	}
+}
+
+func TestAuditMode(t *testing.T) {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	data := map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "auditMode": "true"}
+	ctrl := newTestController(data, testPod("running", "tenant-audited", "1", "1Gi"))
+	audited := testutil.ToFloat64(admissionAuditRejectionsTotal.WithLabelValues("cpu_exceeded"))
+	rejected := testutil.ToFloat64(admissionRejectionsTotal.WithLabelValues("cpu_exceeded"))
+
+	resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("new", "tenant-audited", "3", "512Mi"), nil))
+	if !resp.Allowed {
+		t.Fatalf("over-quota pod denied in audit mode: %v", resp.Result)
+	}
+	if len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "would have been rejected: CPU limit exceeded") {
+		t.Errorf("warnings = %q, want the would-be rejection", resp.Warnings)
+	}
+	if resp.UID != "review-uid" {
+		t.Errorf("UID = %q, want the request's", resp.UID)
+	}
+
+	if got := testutil.ToFloat64(admissionAuditRejectionsTotal.WithLabelValues("cpu_exceeded")) - audited; got != 1 {
+		t.Errorf("audit rejections rose by %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(admissionRejectionsTotal.WithLabelValues("cpu_exceeded")) - rejected; got != 0 {
+		t.Errorf("rejections rose by %v in audit mode, want 0", got)
+	}
+	if !strings.Contains(buf.String(), "decision=would_deny") || !strings.Contains(buf.String(), "tenant=tenant-audited") {
+		t.Errorf("log does not record the would-be rejection:\n%s", buf.String())
+	}
+
+	// Pods within quota get no warning. The pod let through above is charged
+	// like any other, so the recently admitted pods are cleared.
+	ctrl = newTestController(data, testPod("running", "tenant-audited", "1", "1Gi"))
+	resp = ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("small", "tenant-audited", "500m", "512Mi"), nil))
+	if !resp.Allowed {
+		t.Fatalf("pod within quota denied: %v", resp.Result)
+	}
+	if len(resp.Warnings) != 0 {
+		t.Errorf("warnings = %q, want none", resp.Warnings)
+	}
+
+	// The quota warnings an allowed pod would get come first.
+	ctrl = newTestController(withData(data, map[string]string{"warnThresholdPercent": "90"}), testPod("running", "tenant-audited", "1", "1Gi"))
+	resp = ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("big", "tenant-audited", "3", "900Mi"), nil))
+	if !resp.Allowed {
+		t.Fatalf("over-quota pod denied in audit mode: %v", resp.Result)
+	}
+	if len(resp.Warnings) != 2 || resp.Warnings[0] != "Memory limit is 94% used: 1924Mi of 2Gi" || !strings.HasPrefix(resp.Warnings[1], "would have been rejected: CPU limit exceeded") {
+		t.Errorf("warnings = %q, want the memory warning and the would-be rejection", resp.Warnings)
+	}
+}
+
+func TestMixedMemorySuffixes(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   string
+		running string
+		memory  string
+		allowed bool
+	}{
+		{"1000Mi fits under 1Gi", "1Gi", "0", "1000Mi", true},
+		{"1024Mi fills 1Gi", "1Gi", "512Mi", "512Mi", true},
+		{"1G fits under 1Gi", "1Gi", "0", "1G", true},
+		{"1Gi does not fit under 1G", "1G", "0", "1Gi", false},
+		{"1000M fills 1G", "1G", "500M", "500M", true},
+		{"1000Mi does not fit under 1G", "1G", "0", "1000Mi", false},
+		{"953Mi fits under 1G", "1G", "0", "953Mi", true},
+		{"kilobytes on top of gigabytes", "2Gi", "1Gi", "1048577Ki", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var running []runtime.Object
+			if tt.running != "0" {
+				running = append(running, testPod("running", "tenant-a", "100m", tt.running))
+			}
+			ctrl := newTestController(map[string]string{"limitCPU": "2", "limitMemory": tt.limit}, running...)
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("new", "tenant-a", "100m", tt.memory), nil))
+			if resp.Allowed != tt.allowed {
+				t.Fatalf("Allowed = %v, want %v (result: %v)", resp.Allowed, tt.allowed, resp.Result)
+			}
+			if !tt.allowed && !strings.Contains(resp.Result.Message, "Memory limit exceeded") {
+				t.Errorf("message = %q, want it to contain %q", resp.Result.Message, "Memory limit exceeded")
+			}
+		})
+	}
+}
+
+func TestCountsTowardUsage(t *testing.T) {
+	deleted := metav1.Now()
+	config := Config{UsagePhases: defaultUsagePhases}
+	tests := []struct {
+		name string
+		pod  corev1.Pod
+		want bool
+	}{
+		{"running", corev1.Pod{Status: corev1.PodStatus{Phase: corev1.PodRunning}}, true},
+		{"pending", corev1.Pod{Status: corev1.PodStatus{Phase: corev1.PodPending}}, true},
+		{"succeeded", corev1.Pod{Status: corev1.PodStatus{Phase: corev1.PodSucceeded}}, false},
+		{"failed", corev1.Pod{Status: corev1.PodStatus{Phase: corev1.PodFailed}}, false},
+		{"terminating", corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{DeletionTimestamp: &deleted},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning},
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := countsTowardUsage(tt.pod, config); got != tt.want {
+				t.Errorf("countsTowardUsage() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
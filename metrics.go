@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Rejection reasons used as the "reason" label of admission_rejections_total.
+// Quota violations use "<resource>_exceeded", see exceededReason.
+const (
+	reasonMissingLimits        = "missing_limits"
+	reasonMaxPods              = "max_pods_exceeded"
+	reasonMaxBestEffortPods    = "max_best_effort_pods_exceeded"
+	reasonOverQuota            = "over_quota"
+	reasonRequestsExceedLimits = "requests_exceed_limits"
+	reasonContainerMaxExceeded = "container_max_exceeded"
+	reasonRequestBelowMinimum  = "request_below_minimum"
+	reasonInvalidObject        = "invalid_object"
+	reasonTenantMismatch       = "tenant_mismatch"
+	reasonMissingTenantLabel   = "missing_tenant_label"
+	reasonConfigError          = "config_error"
+	reasonListFailed           = "list_failed"
+	reasonTimeout              = "timeout"
+	reasonUnknown              = "unknown"
+)
+
+var (
+	admissionRequestsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "admission_requests_total",
+		Help: "Total number of admission requests processed.",
+	})
+	admissionRejectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "admission_rejections_total",
+		Help: "Total number of admission requests rejected, by reason.",
+	}, []string{"reason"})
+	admissionAuditRejectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "admission_audit_rejections_total",
+		Help: "Total number of admission requests allowed in audit mode that would have been rejected, by reason.",
+	}, []string{"reason"})
+	tenantUsage = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tenant_resource_usage",
+		Help: "Usage of a tenant as compared against its quota, by resource, as of the last admission.",
+	}, []string{"namespace", "tenant", "team", "resource"})
+	tenantLimit = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tenant_resource_limit",
+		Help: "Quota of a tenant, by resource, as of the last admission.",
+	}, []string{"namespace", "tenant", "team", "resource"})
+	tenantPods = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tenant_pods",
+		Help: "Number of pods of a tenant as of the last admission.",
+	}, []string{"namespace", "tenant", "team"})
+	admissionDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "admission_duration_seconds",
+		Help:    "Time spent handling admission requests.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+func init() {
+	prometheus.MustRegister(admissionRequestsTotal, admissionRejectionsTotal, admissionAuditRejectionsTotal, admissionDuration, tenantUsage, tenantLimit, tenantPods)
+}
+
+// recordDecision updates the admission metrics. rejection is nil for allowed
+// requests.
+func recordDecision(rejection error) {
+	admissionRequestsTotal.Inc()
+	if rejection != nil {
+		admissionRejectionsTotal.WithLabelValues(rejectionReason(rejection)).Inc()
+	}
+}
+
+// recordAudit counts a rejection that audit mode turned into an allow. It does
+// nothing for nil.
+func recordAudit(rejection error) {
+	if rejection != nil {
+		admissionAuditRejectionsTotal.WithLabelValues(rejectionReason(rejection)).Inc()
+	}
+}
+
+// tenantSeries remembers which tenants have gauges, so their number can be
+// capped. Tenants are never dropped, a tenant that got gauges keeps them.
+var tenantSeries = struct {
+	sync.Mutex
+	keys map[string]bool
+}{keys: map[string]bool{}}
+
+// admitTenantSeries reports whether the tenant may have gauges, registering it
+// if there is room below limit.
+func admitTenantSeries(namespace, tenant, team string, limit int) bool {
+	tenantSeries.Lock()
+	defer tenantSeries.Unlock()
+
+	key := namespace + "/" + teamKey(tenant, team)
+	if tenantSeries.keys[key] {
+		return true
+	}
+	if len(tenantSeries.keys) >= limit {
+		return false
+	}
+	tenantSeries.keys[key] = true
+	return true
+}
+
+// recordTenantUsage updates the tenant gauges from a decided request. Denied
+// updates are skipped, since the usage of the pod they would replace is not
+// part of the review.
+func recordTenantUsage(namespace string, r *review, allowed, update bool) {
+	if r.used == nil || r.quota == nil || r.config == nil || (update && !allowed) {
+		return
+	}
+	if r.config.ClusterWideQuota {
+		namespace = ""
+	}
+	if !admitTenantSeries(namespace, r.tenant, r.team, r.config.TenantMetricsLimit) {
+		return
+	}
+
+	usage := r.used.clone()
+	if allowed && !r.target.workload() {
+		usage.add(r.target.usage(*r.config))
+	}
+	scoped := usage.Limits
+	if r.quota.Scope == quotaScopeRequests {
+		scoped = usage.Requests
+	}
+
+	for name, ceiling := range r.quota.Limits {
+		used := scoped[name]
+		tenantUsage.WithLabelValues(namespace, r.tenant, r.team, string(name)).Set(used.AsApproximateFloat64())
+		tenantLimit.WithLabelValues(namespace, r.tenant, r.team, string(name)).Set(ceiling.AsApproximateFloat64())
+	}
+	tenantPods.WithLabelValues(namespace, r.tenant, r.team).Set(float64(usage.Pods))
+}
+
+// rejectionError is returned by the validation functions when a pod must be
+// denied. The reason is used to label the rejection metric.
+type rejectionError struct {
+	reason  string
+	message string
+}
+
+func (e *rejectionError) Error() string {
+	return e.message
+}
+
+func newRejection(reason, format string, args ...interface{}) error {
+	return &rejectionError{reason: reason, message: fmt.Sprintf(format, args...)}
+}
+
+// exceededReason returns the rejection reason for a quota violation of the
+// named resource, e.g. "cpu_exceeded" or "memory_request_exceeded".
+func exceededReason(name corev1.ResourceName, kind string) string {
+	reason := strings.NewReplacer(".", "_", "/", "_", "-", "_").Replace(string(name))
+	if kind != "" {
+		reason += "_" + kind
+	}
+	return reason + "_exceeded"
+}
+
+func rejectionReason(err error) string {
+	var rejection *rejectionError
+	if errors.As(err, &rejection) {
+		return rejection.reason
+	}
+	return reasonUnknown
+}
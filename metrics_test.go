@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestAdmissionMetrics(t *testing.T) {
+	ctrl := newTestController(map[string]string{"limitCPU": "2", "limitMemory": "2Gi"})
+	requests := testutil.ToFloat64(admissionRequestsTotal)
+	cpuRejections := testutil.ToFloat64(admissionRejectionsTotal.WithLabelValues("cpu_exceeded"))
+	memoryRejections := testutil.ToFloat64(admissionRejectionsTotal.WithLabelValues("memory_exceeded"))
+
+	resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("big", "tenant-a", "3", "1Gi"), nil))
+	checkResponse(t, resp, false, "CPU limit exceeded")
+	resp = ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("small", "tenant-a", "1", "1Gi"), nil))
+	checkResponse(t, resp, true, "")
+
+	if got := testutil.ToFloat64(admissionRequestsTotal) - requests; got != 2 {
+		t.Errorf("admission_requests_total rose by %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(admissionRejectionsTotal.WithLabelValues("cpu_exceeded")) - cpuRejections; got != 1 {
+		t.Errorf("admission_rejections_total{reason=cpu_exceeded} rose by %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(admissionRejectionsTotal.WithLabelValues("memory_exceeded")) - memoryRejections; got != 0 {
+		t.Errorf("admission_rejections_total{reason=memory_exceeded} rose by %v, want 0", got)
+	}
+}
+
+// resetTenantGauges drops the tenant gauges and their series cap before and
+// after the test.
+func resetTenantGauges(t *testing.T) {
+	reset := func() {
+		tenantSeries.Lock()
+		tenantSeries.keys = map[string]bool{}
+		tenantSeries.Unlock()
+		tenantUsage.Reset()
+		tenantLimit.Reset()
+		tenantPods.Reset()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestTenantGauges(t *testing.T) {
+	tests := []struct {
+		name    string
+		pod     *corev1.Pod
+		cpu     float64
+		memory  float64
+		pods    float64
+		allowed bool
+	}{
+		{"allowed pod is included", testPod("new", "tenant-a", "500m", "512Mi"), 1.5, 1.5 * (1 << 30), 2, true},
+		{"denied pod is left out", testPod("new", "tenant-a", "3", "512Mi"), 1, 1 << 30, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetTenantGauges(t)
+			ctrl := newTestController(map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}, testPod("running", "tenant-a", "1", "1Gi"))
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+			checkResponse(t, resp, tt.allowed, "")
+
+			gauges := []struct {
+				name string
+				got  float64
+				want float64
+			}{
+				{"tenant_resource_usage{resource=cpu}", testutil.ToFloat64(tenantUsage.WithLabelValues(testNamespace, "tenant-a", "", "cpu")), tt.cpu},
+				{"tenant_resource_usage{resource=memory}", testutil.ToFloat64(tenantUsage.WithLabelValues(testNamespace, "tenant-a", "", "memory")), tt.memory},
+				{"tenant_resource_limit{resource=cpu}", testutil.ToFloat64(tenantLimit.WithLabelValues(testNamespace, "tenant-a", "", "cpu")), 2},
+				{"tenant_resource_limit{resource=memory}", testutil.ToFloat64(tenantLimit.WithLabelValues(testNamespace, "tenant-a", "", "memory")), 2 << 30},
+				{"tenant_pods", testutil.ToFloat64(tenantPods.WithLabelValues(testNamespace, "tenant-a", "")), tt.pods},
+			}
+			for _, gauge := range gauges {
+				if gauge.got != gauge.want {
+					t.Errorf("%s = %v, want %v", gauge.name, gauge.got, gauge.want)
+				}
+			}
+		})
+	}
+}
+
+func TestTenantGaugesCapped(t *testing.T) {
+	resetTenantGauges(t)
+	ctrl := newTestController(map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "tenantMetricsLimit": "1"})
+	for _, tenant := range []string{"tenant-a", "tenant-b", "tenant-a"} {
+		resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("new-"+tenant, tenant, "500m", "512Mi"), nil))
+		checkResponse(t, resp, true, "")
+	}
+
+	if got := testutil.CollectAndCount(tenantPods); got != 1 {
+		t.Errorf("tenant_pods has %d series, want 1 for the first tenant", got)
+	}
+	// The tenant below the cap keeps being updated.
+	if got := testutil.ToFloat64(tenantPods.WithLabelValues(testNamespace, "tenant-a", "")); got != 2 {
+		t.Errorf("tenant_pods{tenant=tenant-a} = %v, want 2", got)
+	}
+}
+
+func TestRejectionReason(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{newRejection(reasonMissingLimits, "missing"), reasonMissingLimits},
+		{newRejection(exceededReason("cpu", ""), "cpu"), "cpu_exceeded"},
+		{newRejection(exceededReason("nvidia.com/gpu", ""), "gpu"), "nvidia_com_gpu_exceeded"},
+		{newRejection(exceededReason("memory", "request"), "memory"), "memory_request_exceeded"},
+		{context.DeadlineExceeded, reasonUnknown},
+	}
+	for _, tt := range tests {
+		if got := rejectionReason(tt.err); got != tt.want {
+			t.Errorf("rejectionReason(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
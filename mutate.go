@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// jsonPatchOperation is a single RFC 6902 operation.
+type jsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+func (ctrl *Controller) handleMutate(w http.ResponseWriter, r *http.Request) {
+	serveAdmissionReview(w, r, ctrl.processMutation)
+}
+
+// processMutation injects the configured default limits and requests into
+// containers of tenant pods that lack them. It only denies a review without a
+// request: pods it cannot handle are passed through unchanged and left to the
+// validating webhook.
+func (ctrl *Controller) processMutation(ctx context.Context, ar admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
+	if ar.Request == nil {
+		admissionResponse, _ := deny(&admissionv1.AdmissionResponse{}, newRejection(reasonInvalidObject, "admission review contains no request"))
+		return admissionResponse
+	}
+	admissionResponse := &admissionv1.AdmissionResponse{UID: ar.Request.UID, Allowed: true}
+
+	if ar.Request.SubResource != "" || schema.GroupVersionResource(ar.Request.Resource) != podsResource {
+		return admissionResponse
+	}
+
+	var pod corev1.Pod
+	if err := json.Unmarshal(ar.Request.Object.Raw, &pod); err != nil {
+		slog.Warn("Not mutating pod: could not unmarshal pod object", "namespace", ar.Request.Namespace, "error", err)
+		return admissionResponse
+	}
+
+	config, err := ctrl.loadConfig(ctx)
+	if err != nil {
+		slog.Warn("Not mutating pod: could not load config", "namespace", ar.Request.Namespace, "error", err)
+		return admissionResponse
+	}
+
+	if config.MissingResourcesMode != missingResourcesInject || config.namespaceExcluded(ar.Request.Namespace) {
+		return admissionResponse
+	}
+	if _, ok := config.podTenant(ar.Request.Namespace, pod.Labels); !ok {
+		return admissionResponse
+	}
+
+	patch, err := json.Marshal(defaultResourcesPatch(&pod, config))
+	if err != nil {
+		slog.Error("Not mutating pod: could not marshal patch", "namespace", ar.Request.Namespace, "error", err)
+		return admissionResponse
+	}
+	if string(patch) == "[]" {
+		return admissionResponse
+	}
+
+	patchType := admissionv1.PatchTypeJSONPatch
+	admissionResponse.Patch = patch
+	admissionResponse.PatchType = &patchType
+	return admissionResponse
+}
+
+// defaultResourcesPatch returns the operations that fill in missing limits and
+// requests of the pod's init and regular containers from the config defaults.
+// Resources a container already sets are left alone.
+func defaultResourcesPatch(pod *corev1.Pod, config Config) []jsonPatchOperation {
+	patch := []jsonPatchOperation{}
+	for _, containers := range []struct {
+		field string
+		list  []corev1.Container
+	}{
+		{"initContainers", pod.Spec.InitContainers},
+		{"containers", pod.Spec.Containers},
+	} {
+		for i, container := range containers.list {
+			resources := *container.Resources.DeepCopy()
+			limitsChanged := fillMissing(&resources.Limits, config.DefaultLimits)
+			requestsChanged := fillMissing(&resources.Requests, config.DefaultRequests)
+			if !limitsChanged && !requestsChanged {
+				continue
+			}
+
+			// Replacing the whole resources object works whether or not the
+			// container had one.
+			patch = append(patch, jsonPatchOperation{
+				Op:    "add",
+				Path:  fmt.Sprintf("/spec/%s/%d/resources", containers.field, i),
+				Value: resources,
+			})
+		}
+	}
+	return patch
+}
+
+// fillMissing adds every entry of defaults that list does not have yet and
+// reports whether list changed.
+func fillMissing(list *corev1.ResourceList, defaults corev1.ResourceList) bool {
+	changed := false
+	for name, quantity := range defaults {
+		if _, ok := (*list)[name]; ok {
+			continue
+		}
+		if *list == nil {
+			*list = corev1.ResourceList{}
+		}
+		(*list)[name] = quantity.DeepCopy()
+		changed = true
+	}
+	return changed
+}
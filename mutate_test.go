@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func TestDefaultResourcesPatch(t *testing.T) {
+	config := Config{
+		DefaultLimits:   corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("500m")},
+		DefaultRequests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m")},
+	}
+	set := testPod("", "", "1", "1Gi").Spec.Containers[0]
+	pod := &corev1.Pod{Spec: corev1.PodSpec{
+		InitContainers: []corev1.Container{{Name: "setup"}},
+		Containers:     []corev1.Container{set, {Name: "app"}},
+	}}
+
+	patch := defaultResourcesPatch(pod, config)
+	var paths []string
+	for _, operation := range patch {
+		paths = append(paths, operation.Path)
+	}
+	want := []string{"/spec/initContainers/0/resources", "/spec/containers/1/resources"}
+	if len(paths) != len(want) || paths[0] != want[0] || paths[1] != want[1] {
+		t.Fatalf("patched %v, want %v", paths, want)
+	}
+	resources := patch[1].Value.(corev1.ResourceRequirements)
+	if limit := resources.Limits[corev1.ResourceCPU]; limit.String() != "500m" {
+		t.Errorf("injected limit = %s, want 500m", limit.String())
+	}
+	if request := resources.Requests[corev1.ResourceCPU]; request.String() != "100m" {
+		t.Errorf("injected request = %s, want 100m", request.String())
+	}
+}
+
+func TestProcessMutation(t *testing.T) {
+	data := map[string]string{
+		"limitCPU":             "2",
+		"limitMemory":          "2Gi",
+		"missingResourcesMode": "Inject",
+		"defaultLimits":        `{"cpu": "500m", "memory": "256Mi"}`,
+		"defaultRequests":      `{"cpu": "100m", "memory": "128Mi"}`,
+	}
+	bare := func() *corev1.Pod {
+		pod := testPod("new", "tenant-a", "1", "1Gi")
+		pod.Spec.Containers[0].Resources = corev1.ResourceRequirements{}
+		return pod
+	}
+	unlabeled := bare()
+	unlabeled.Labels = nil
+
+	tests := []struct {
+		name    string
+		data    map[string]string
+		pod     *corev1.Pod
+		patched bool
+	}{
+		{"container without resources", data, bare(), true},
+		{"container with resources", data, testPod("new", "tenant-a", "1", "1Gi"), false},
+		{"reject mode", withData(data, map[string]string{"missingResourcesMode": "Reject"}), bare(), false},
+		{"pod without a tenant", data, unlabeled, false},
+		{"excluded namespace", withData(data, map[string]string{"excludedNamespaces": "tenant-a-ns"}), bare(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(tt.data)
+			ar := podReview(t, admissionv1.Create, tt.pod, nil)
+			resp := ctrl.processMutation(context.Background(), ar)
+			if !resp.Allowed || resp.UID != "review-uid" {
+				t.Fatalf("allowed = %v with UID %q, want the request allowed", resp.Allowed, resp.UID)
+			}
+			if !tt.patched {
+				if resp.Patch != nil {
+					t.Errorf("unexpected patch %s", resp.Patch)
+				}
+				return
+			}
+
+			if resp.PatchType == nil || *resp.PatchType != admissionv1.PatchTypeJSONPatch {
+				t.Fatalf("patch type = %v, want JSONPatch", resp.PatchType)
+			}
+			var patch []struct {
+				Op    string                      `json:"op"`
+				Path  string                      `json:"path"`
+				Value corev1.ResourceRequirements `json:"value"`
+			}
+			if err := json.Unmarshal(resp.Patch, &patch); err != nil {
+				t.Fatalf("decode patch: %v", err)
+			}
+			if len(patch) != 1 || patch[0].Op != "add" || patch[0].Path != "/spec/containers/0/resources" {
+				t.Fatalf("patch = %s, want the container's resources added", resp.Patch)
+			}
+			checkResources(t, patch[0].Value.Limits, "500m", "256Mi")
+			checkResources(t, patch[0].Value.Requests, "100m", "128Mi")
+
+			// The patched pod passes the validating webhook.
+			pod := tt.pod.DeepCopy()
+			pod.Spec.Containers[0].Resources = patch[0].Value
+			if resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, pod, nil)); !resp.Allowed {
+				t.Errorf("patched pod denied: %v", resp.Result)
+			}
+		})
+	}
+}
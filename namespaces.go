@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+)
+
+// namespaceQuotaAnnotationPrefix prefixes the namespace annotations read when
+// namespaceQuotaAnnotations is enabled, e.g.
+// vcluster-resource-quota-controller/limit-cpu.
+const namespaceQuotaAnnotationPrefix = "vcluster-resource-quota-controller/"
+
+// startNamespaceInformers starts namespace and ResourceQuota informers from
+// one shared factory so that namespace annotations and ResourceQuotas are read
+// from a local cache instead of the API server.
+func (ctrl *Controller) startNamespaceInformers(stopCh <-chan struct{}) {
+	if ctrl.client == nil {
+		return
+	}
+	factory := informers.NewSharedInformerFactory(ctrl.client, 0)
+	namespaces := factory.Core().V1().Namespaces()
+	ctrl.namespaceLister = namespaces.Lister()
+	ctrl.namespacesSynced = namespaces.Informer().HasSynced
+	resourceQuotas := factory.Core().V1().ResourceQuotas()
+	ctrl.resourceQuotaLister = resourceQuotas.Lister()
+	ctrl.resourceQuotasSynced = resourceQuotas.Informer().HasSynced
+	factory.Start(stopCh)
+}
+
+// getNamespace returns the namespace from the cache once it has synced and from
+// the API server until then.
+func (ctrl *Controller) getNamespace(ctx context.Context, name string) (*corev1.Namespace, error) {
+	if ctrl.namespaceLister != nil && ctrl.namespacesSynced() {
+		return ctrl.namespaceLister.Get(name)
+	}
+	if ctrl.client == nil {
+		return nil, errNoClient
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ctrl.apiTimeout)
+	defer cancel()
+
+	var namespace *corev1.Namespace
+	err := retryTransient(ctx, func() (err error) {
+		namespace, err = ctrl.client.CoreV1().Namespaces().Get(ctx, name, metav1.GetOptions{})
+		return err
+	})
+	return namespace, err
+}
+
+// withNamespaceQuota replaces the config's ceilings with the ones annotated on
+// the namespace, if NamespaceQuotaAnnotations is enabled. Ceilings the
+// namespace does not annotate keep their configured values.
+func (c Config) withNamespaceQuota(ctx context.Context, ctrl *Controller, name string) (Config, error) {
+	if !c.NamespaceQuotaAnnotations {
+		return c, nil
+	}
+
+	namespace, err := ctrl.getNamespace(ctx, name)
+	if apierrors.IsNotFound(err) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+
+	var override TenantQuota
+	fields := []struct {
+		annotation string
+		field      *string
+	}{
+		{"limit-cpu", &override.LimitCPU},
+		{"limit-memory", &override.LimitMemory},
+		{"limit-ephemeral-storage", &override.LimitEphemeralStorage},
+		{"limit-storage", &override.LimitStorage},
+		{"request-cpu", &override.RequestCPU},
+		{"request-memory", &override.RequestMemory},
+	}
+	for _, f := range fields {
+		value, ok := namespace.Annotations[namespaceQuotaAnnotationPrefix+f.annotation]
+		if !ok {
+			continue
+		}
+		if _, err := resource.ParseQuantity(value); err != nil {
+			return c, fmt.Errorf("invalid annotation %s%s %q on namespace %s: %v", namespaceQuotaAnnotationPrefix, f.annotation, value, name, err)
+		}
+		*f.field = value
+	}
+	if value, ok := namespace.Annotations[namespaceQuotaAnnotationPrefix+"max-pods"]; ok {
+		maxPods, err := strconv.Atoi(value)
+		if err != nil || maxPods <= 0 {
+			return c, fmt.Errorf("invalid annotation %smax-pods %q on namespace %s: must be a positive integer", namespaceQuotaAnnotationPrefix, value, name)
+		}
+		override.MaxPods = maxPods
+	}
+	return c.withOverride(override), nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// testNamespaceObject returns the test namespace with the quota annotations,
+// given without their prefix.
+func testNamespaceObject(annotations map[string]string) *corev1.Namespace {
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: testNamespace, Annotations: map[string]string{}}}
+	for key, value := range annotations {
+		namespace.Annotations[namespaceQuotaAnnotationPrefix+key] = value
+	}
+	return namespace
+}
+
+func TestNamespaceQuotaAnnotations(t *testing.T) {
+	data := map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "namespaceQuotaAnnotations": "true"}
+	tests := []struct {
+		name      string
+		data      map[string]string
+		namespace *corev1.Namespace
+		pod       *corev1.Pod
+		allowed   bool
+		message   string
+	}{
+		{"raised by the namespace", data, testNamespaceObject(map[string]string{"limit-cpu": "8"}), testPod("new", "tenant-a", "3", "512Mi"), true, ""},
+		{"lowered by the namespace", data, testNamespaceObject(map[string]string{"limit-cpu": "1500m"}), testPod("new", "tenant-a", "1", "512Mi"), false, "CPU limit exceeded: requested 1 on top of 1 used, limit is 1500m"},
+		{"unannotated limits fall back to the config", data, testNamespaceObject(map[string]string{"limit-cpu": "8"}), testPod("new", "tenant-a", "1", "1536Mi"), false, "limit is 2Gi"},
+		{"pod limit", data, testNamespaceObject(map[string]string{"max-pods": "1"}), testPod("new", "tenant-a", "100m", "128Mi"), false, "pod limit exceeded"},
+		{"namespace without annotations", data, testNamespaceObject(nil), testPod("new", "tenant-a", "3", "512Mi"), false, "limit is 2"},
+		{"namespace not found", data, nil, testPod("new", "tenant-a", "3", "512Mi"), false, "limit is 2"},
+		{"annotations not enabled", withData(data, map[string]string{"namespaceQuotaAnnotations": "false"}), testNamespaceObject(map[string]string{"limit-cpu": "8"}), testPod("new", "tenant-a", "3", "512Mi"), false, "limit is 2"},
+		{"invalid annotation", data, testNamespaceObject(map[string]string{"limit-cpu": "lots"}), testPod("new", "tenant-a", "100m", "128Mi"), false, "invalid annotation " + namespaceQuotaAnnotationPrefix + "limit-cpu"},
+		{"invalid pod limit annotation", data, testNamespaceObject(map[string]string{"max-pods": "0"}), testPod("new", "tenant-a", "100m", "128Mi"), false, "must be a positive integer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects := []runtime.Object{testPod("running", "tenant-a", "1", "1Gi")}
+			if tt.namespace != nil {
+				objects = append(objects, tt.namespace)
+			}
+			ctrl := newTestController(tt.data, objects...)
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestNamespaceQuotaFromCache(t *testing.T) {
+	ctrl := newTestController(map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "namespaceQuotaAnnotations": "true"})
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := indexer.Add(testNamespaceObject(map[string]string{"limit-cpu": "8"})); err != nil {
+		t.Fatal(err)
+	}
+	ctrl.namespaceLister = corelisters.NewNamespaceLister(indexer)
+	ctrl.namespacesSynced = func() bool { return true }
+
+	resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("new", "tenant-a", "3", "512Mi"), nil))
+	checkResponse(t, resp, true, "")
+	for _, action := range ctrl.client.(*fake.Clientset).Actions() {
+		if action.Matches("get", "namespaces") {
+			t.Errorf("got the namespace from the API server despite the synced cache: %+v", action)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// nodeRefreshInterval is how often the summed node allocatable is refreshed
+// while a config uses nodeAllocatablePercent.
+const nodeRefreshInterval = time.Minute
+
+// watchNodeAllocatable keeps the summed node allocatable up to date in the
+// background so that admission does not list nodes. Nodes are only listed
+// while the config asks for it.
+func (ctrl *Controller) watchNodeAllocatable(ctx context.Context) {
+	ticker := time.NewTicker(nodeRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !ctrl.nodeAllocatableUsed() {
+				continue
+			}
+			if _, err := ctrl.refreshNodeAllocatable(ctx); err != nil {
+				slog.Error("Error refreshing node allocatable, keeping the last known value", "error", err)
+			}
+		}
+	}
+}
+
+func (ctrl *Controller) nodeAllocatableUsed() bool {
+	ctrl.configMu.RLock()
+	defer ctrl.configMu.RUnlock()
+	return ctrl.config != nil && ctrl.config.NodeAllocatablePercent > 0
+}
+
+// refreshNodeAllocatable lists all nodes and caches their summed allocatable.
+func (ctrl *Controller) refreshNodeAllocatable(ctx context.Context) (corev1.ResourceList, error) {
+	if ctrl.client == nil {
+		return nil, errNoClient
+	}
+	ctx, cancel := context.WithTimeout(ctx, ctrl.apiTimeout)
+	defer cancel()
+
+	var nodes *corev1.NodeList
+	err := retryTransient(ctx, func() (err error) {
+		nodes, err = ctrl.client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	total := corev1.ResourceList{}
+	for _, node := range nodes.Items {
+		addResourceList(total, node.Status.Allocatable)
+	}
+
+	ctrl.nodeAllocatableMu.Lock()
+	ctrl.nodeAllocatable = total
+	ctrl.nodeAllocatableMu.Unlock()
+	return total, nil
+}
+
+// cachedNodeAllocatable returns the summed node allocatable, listing the nodes
+// only if it has not been loaded yet.
+func (ctrl *Controller) cachedNodeAllocatable(ctx context.Context) (corev1.ResourceList, error) {
+	ctrl.nodeAllocatableMu.RLock()
+	total := ctrl.nodeAllocatable
+	ctrl.nodeAllocatableMu.RUnlock()
+
+	if total != nil {
+		return total, nil
+	}
+	return ctrl.refreshNodeAllocatable(ctx)
+}
+
+// withNodeAllocatable replaces the CPU and memory limit ceilings with
+// NodeAllocatablePercent of the cluster's summed node allocatable, as cached by
+// ctrl.
+func (c Config) withNodeAllocatable(ctx context.Context, ctrl *Controller) (Config, error) {
+	if c.NodeAllocatablePercent == 0 {
+		return c, nil
+	}
+
+	total, err := ctrl.cachedNodeAllocatable(ctx)
+	if err != nil {
+		return c, err
+	}
+
+	cpu := total[corev1.ResourceCPU]
+	memory := total[corev1.ResourceMemory]
+	if cpu.IsZero() || memory.IsZero() {
+		return c, fmt.Errorf("nodes report no allocatable CPU or memory")
+	}
+
+	percent := int64(c.NodeAllocatablePercent)
+	c.LimitCPU = resource.NewMilliQuantity(cpu.MilliValue()*percent/100, resource.DecimalSI).String()
+	c.LimitMemory = resource.NewQuantity(memory.Value()*percent/100, resource.BinarySI).String()
+	return c, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testNode(name, cpu, memory string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status:     corev1.NodeStatus{Allocatable: cpuMemory(cpu, memory)},
+	}
+}
+
+// nodeServer answers node lists with its nodes, counting the lists, and every
+// other request with the pods.
+type nodeServer struct {
+	mu    sync.Mutex
+	nodes []corev1.Node
+	lists int
+	pods  http.HandlerFunc
+}
+
+func (s *nodeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/v1/nodes" {
+		s.pods(w, r)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lists++
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&corev1.NodeList{TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "NodeList"}, Items: s.nodes})
+}
+
+func (s *nodeServer) addNode(node corev1.Node) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nodes = append(s.nodes, node)
+}
+
+func (s *nodeServer) listCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lists
+}
+
+// newNodesController returns a controller whose API server serves the nodes
+// and pods.
+func newNodesController(t *testing.T, nodes []corev1.Node, pods ...corev1.Pod) (*Controller, *nodeServer) {
+	t.Helper()
+	server := &nodeServer{nodes: nodes, pods: servePods(pods...)}
+	return newAPIServerController(t, server), server
+}
+
+func TestWithNodeAllocatable(t *testing.T) {
+	nodes := []corev1.Node{*testNode("node-1", "4", "16Gi"), *testNode("node-2", "3500m", "8Gi")}
+	tests := []struct {
+		name    string
+		percent string
+		nodes   []corev1.Node
+		cpu     string
+		memory  string
+		wantErr bool
+	}{
+		{"half of the cluster", "50", nodes, "3750m", "12Gi", false},
+		{"a tenth of the cluster", "10", nodes, "750m", "2576980377", false},
+		{"all of the cluster", "100", nodes, "7500m", "24Gi", false},
+		{"disabled", "0", nodes, "2", "2Gi", false},
+		{"no nodes", "50", nil, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := parseConfig(map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "nodeAllocatablePercent": tt.percent})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctrl, _ := newNodesController(t, tt.nodes)
+			config, err = config.withNodeAllocatable(context.Background(), ctrl)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("withNodeAllocatable() = limitCPU %q, want an error", config.LimitCPU)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("withNodeAllocatable() error = %v", err)
+			}
+			if config.LimitCPU != tt.cpu || config.LimitMemory != tt.memory {
+				t.Errorf("limits = %s and %s, want %s and %s", config.LimitCPU, config.LimitMemory, tt.cpu, tt.memory)
+			}
+		})
+	}
+}
+
+func TestNodeAllocatableCached(t *testing.T) {
+	config, err := parseConfig(map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "nodeAllocatablePercent": "50"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrl, server := newNodesController(t, []corev1.Node{*testNode("node-1", "4", "8Gi")})
+	ctrl.setConfig(config)
+
+	for _, name := range []string{"first", "second", "third"} {
+		if resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod(name, "tenant-a", "500m", "512Mi"), nil)); !resp.Allowed {
+			t.Fatalf("pod %s denied: %v", name, resp.Result)
+		}
+	}
+	resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("fourth", "tenant-a", "1", "512Mi"), nil))
+	if resp.Allowed {
+		t.Fatal("fourth pod allowed, want it denied by half of the node allocatable")
+	}
+	if want := "CPU limit exceeded: requested 1 on top of 1500m used, limit is 2"; !strings.Contains(resp.Result.Message, want) {
+		t.Errorf("message = %q, want it to contain %q", resp.Result.Message, want)
+	}
+	if lists := server.listCount(); lists != 1 {
+		t.Errorf("nodes were listed %d times, want once", lists)
+	}
+
+	// A refresh picks up added nodes.
+	server.addNode(*testNode("node-2", "4", "8Gi"))
+	if _, err := ctrl.refreshNodeAllocatable(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("fifth", "tenant-a", "1", "512Mi"), nil)); !resp.Allowed {
+		t.Fatalf("fifth pod denied after a node was added: %v", resp.Result)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/client-go/informers"
+)
+
+// recentAdmissionTTL is how long an admitted pod is charged on top of the pod
+// cache. It only needs to cover the time until the informer sees the pod.
+const recentAdmissionTTL = 10 * time.Second
+
+// activePodsFieldSelector excludes finished pods server side, which keeps
+// them out of both the pod cache and live lists.
+var activePodsFieldSelector = fields.AndSelectors(
+	fields.OneTermNotEqualSelector("status.phase", string(corev1.PodSucceeded)),
+	fields.OneTermNotEqualSelector("status.phase", string(corev1.PodFailed)),
+).String()
+
+// startPodInformer starts a shared pod informer so that usage is computed from
+// a local cache instead of listing pods on every admission. Only pods carrying
+// the tenant label key are cached, which keeps the host cluster's own pods out
+// of memory.
+func (ctrl *Controller) startPodInformer(tenantLabelKey string, stopCh <-chan struct{}) {
+	if ctrl.client == nil {
+		return
+	}
+	factory := informers.NewSharedInformerFactoryWithOptions(ctrl.client, 0,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = activePodsFieldSelector
+			options.LabelSelector = tenantLabelKey
+		}),
+	)
+	pods := factory.Core().V1().Pods()
+	ctrl.podLister = pods.Lister()
+	ctrl.podsSynced = pods.Informer().HasSynced
+	ctrl.podCacheLabelKey = tenantLabelKey
+	factory.Start(stopCh)
+}
+
+// podCacheHolds reports whether the pod cache holds every pod the selector
+// matches, which it only does if the selector requires the cached label key.
+// Pods without the tenant label, which count towards the tenant their
+// namespace is mapped to, and a tenant label key changed since the informer
+// started are served from live lists instead.
+func (ctrl *Controller) podCacheHolds(selector labels.Selector) bool {
+	requirements, _ := selector.Requirements()
+	for _, requirement := range requirements {
+		if requirement.Key() != ctrl.podCacheLabelKey {
+			continue
+		}
+		switch requirement.Operator() {
+		case selection.Equals, selection.DoubleEquals, selection.In, selection.Exists:
+			return true
+		}
+	}
+	return false
+}
+
+// listTenantPods returns the pods in namespace, or in all namespaces if it is
+// empty, matching the selector.
+// It reads from the pod cache once it has synced and lists from the API server
+// until then, or if the cache does not hold the pods the selector matches.
+func (ctrl *Controller) listTenantPods(ctx context.Context, namespace string, selector labels.Selector) ([]corev1.Pod, error) {
+	if ctrl.podLister == nil || !ctrl.podsSynced() || !ctrl.podCacheHolds(selector) {
+		return ctrl.getPodsWithLabel(ctx, namespace, selector)
+	}
+
+	cached, err := ctrl.podLister.Pods(namespace).List(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	pods := make([]corev1.Pod, 0, len(cached))
+	for _, pod := range cached {
+		pods = append(pods, *pod)
+	}
+	return pods, nil
+}
+
+// admissionTracker remembers recently admitted pods. The pod cache, and even
+// a live list, may not contain a pod that was admitted a moment ago, so their
+// usage is charged on top until the pod shows up or the entry expires. Pods
+// created from a generateName cannot be matched and are charged until expiry,
+// which over-counts briefly rather than letting a burst of pods slip past the
+// quota.
+type admissionTracker struct {
+	mu      sync.Mutex
+	entries map[string][]trackedAdmission // by teamKey
+}
+
+type trackedAdmission struct {
+	namespace string
+	name      string
+	usage     Usage
+	expires   time.Time
+}
+
+func newAdmissionTracker() *admissionTracker {
+	return &admissionTracker{entries: map[string][]trackedAdmission{}}
+}
+
+func (t *admissionTracker) add(namespace, tenant, name string, usage Usage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.entries[tenant] = append(t.entries[tenant], trackedAdmission{
+		namespace: namespace,
+		name:      name,
+		usage:     usage,
+		expires:   time.Now().Add(recentAdmissionTTL),
+	})
+}
+
+// pending returns the usage of the tenant's recently admitted pods in namespace,
+// or in all namespaces if it is empty, that are not among the known pods,
+// dropping expired entries. Known pods are keyed by podKey.
+func (t *admissionTracker) pending(namespace, tenant string, known map[string]bool) Usage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	total := newUsage()
+	live := t.entries[tenant][:0]
+	for _, entry := range t.entries[tenant] {
+		if now.After(entry.expires) {
+			continue
+		}
+		live = append(live, entry)
+		if namespace != "" && entry.namespace != namespace {
+			continue
+		}
+		if entry.name == "" || !known[podKey(entry.namespace, entry.name)] {
+			total.add(entry.usage)
+		}
+	}
+
+	if len(live) == 0 {
+		delete(t.entries, tenant)
+	} else {
+		t.entries[tenant] = live
+	}
+	return total
+}
+
+func podKey(namespace, name string) string {
+	return namespace + "/" + name
+}
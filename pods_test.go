@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// usePodCache makes usage be read from an indexer holding the given pods,
+// reporting it synced as given.
+func usePodCache(t *testing.T, ctrl *Controller, synced bool, pods ...*corev1.Pod) {
+	t.Helper()
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, pod := range pods {
+		if err := indexer.Add(pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctrl.podLister = corelisters.NewPodLister(indexer)
+	ctrl.podsSynced = func() bool { return synced }
+	ctrl.podCacheLabelKey = defaultTenantLabelKey
+}
+
+func TestUsageFromPodCache(t *testing.T) {
+	tests := []struct {
+		name    string
+		synced  bool
+		cpu     string
+		allowed bool
+		message string
+	}{
+		{"cached pods are counted", true, "1", false, "CPU limit exceeded: requested 1 on top of 1500m used"},
+		{"within quota with the cached pods", true, "500m", true, ""},
+		{"unsynced cache falls back to the API server", false, "1", false, "CPU limit exceeded: requested 1 on top of 1200m used"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The API server and the cache disagree, to tell which one was read.
+			ctrl := newAPIServerController(t, servePods(*testPod("listed", "tenant-a", "1200m", "1Gi")))
+			ctrl.setConfig(Config{LimitCPU: "2", LimitMemory: "2Gi", QuotaScope: quotaScopeLimits, TenantLabelKey: defaultTenantLabelKey, UsagePhases: defaultUsagePhases})
+			usePodCache(t, ctrl, tt.synced, testPod("cached", "tenant-a", "1", "512Mi"), testPod("cached-too", "tenant-a", "500m", "256Mi"), testPod("other", "tenant-b", "2", "2Gi"))
+
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("new", "tenant-a", tt.cpu, "256Mi"), nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestPodCacheLagIsCharged(t *testing.T) {
+	ctrl := newAPIServerController(t, servePods())
+	ctrl.setConfig(Config{LimitCPU: "2", LimitMemory: "2Gi", QuotaScope: quotaScopeLimits, TenantLabelKey: defaultTenantLabelKey, UsagePhases: defaultUsagePhases})
+	usePodCache(t, ctrl, true, testPod("cached", "tenant-a", "1", "1Gi"))
+
+	// The first pod is admitted but never reaches the cache, so it has to be
+	// charged against the second.
+	if resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("first", "tenant-a", "1", "512Mi"), nil)); !resp.Allowed {
+		t.Fatalf("first pod denied: %v", resp.Result)
+	}
+	resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("second", "tenant-a", "1", "512Mi"), nil))
+	if resp.Allowed {
+		t.Fatal("second pod allowed although the first is not in the cache yet")
+	}
+	if want := "CPU limit exceeded: requested 1 on top of 2 used"; !strings.Contains(resp.Result.Message, want) {
+		t.Errorf("message = %q, want it to contain %q", resp.Result.Message, want)
+	}
+}
+
+func TestPodCacheHolds(t *testing.T) {
+	key := defaultTenantLabelKey
+	tenant := labels.SelectorFromSet(labels.Set{key: "tenant-a"})
+	unlabeled, err := Config{TenantLabelKey: key}.tenantSelector("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		selector labels.Selector
+		cacheKey string
+		want     bool
+	}{
+		{"tenant pods", tenant, key, true},
+		{"unlabeled pods", unlabeled, key, false},
+		{"all pods", labels.Everything(), key, false},
+		{"tenant label key changed", tenant, "example.com/tenant", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newController(nil)
+			ctrl.podCacheLabelKey = tt.cacheKey
+			if got := ctrl.podCacheHolds(tt.selector); got != tt.want {
+				t.Errorf("podCacheHolds(%q) = %v, want %v", tt.selector, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPodInformerCachesTenantPods(t *testing.T) {
+	host := testPod("host", "", "1", "1Gi")
+	host.Labels = map[string]string{"app": "ingress"}
+	ctrl := newTestController(nil, testPod("tenant", "tenant-a", "1", "1Gi"), host)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	ctrl.startPodInformer(defaultTenantLabelKey, stopCh)
+	if !cache.WaitForCacheSync(stopCh, ctrl.podsSynced) {
+		t.Fatal("pod cache did not sync")
+	}
+
+	pods, err := ctrl.podLister.List(labels.Everything())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pods) != 1 || pods[0].Name != "tenant" {
+		t.Errorf("cached %d pods, want only the tenant's pod", len(pods))
+	}
+}
+
+func TestGetPodsWithLabelPaginates(t *testing.T) {
+	pages := map[string]corev1.PodList{
+		"":       {ListMeta: metav1.ListMeta{Continue: "page-2"}, Items: []corev1.Pod{*testPod("pod-1", "tenant-a", "1", "1Gi"), *testPod("pod-2", "tenant-a", "1", "1Gi")}},
+		"page-2": {ListMeta: metav1.ListMeta{Continue: "page-3"}, Items: []corev1.Pod{*testPod("pod-3", "tenant-a", "1", "1Gi")}},
+		"page-3": {Items: []corev1.Pod{*testPod("pod-4", "tenant-a", "1", "1Gi")}},
+	}
+	var tokens []string
+	ctrl := newAPIServerController(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if limit := query.Get("limit"); limit != strconv.Itoa(podListPageSize) {
+			t.Errorf("limit = %q, want %d", limit, podListPageSize)
+		}
+		token := query.Get("continue")
+		tokens = append(tokens, token)
+		page, ok := pages[token]
+		if !ok {
+			http.Error(w, "unknown continue token", http.StatusGone)
+			return
+		}
+		page.Kind, page.APIVersion = "PodList", "v1"
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+	}))
+
+	pods, err := ctrl.getPodsWithLabel(context.Background(), testNamespace, labels.Everything())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pods) != 4 {
+		t.Errorf("got %d pods, want all 4 across the pages", len(pods))
+	}
+	if strings.Join(tokens, ",") != ",page-2,page-3" {
+		t.Errorf("listed with continue tokens %q, want each page's token in turn", tokens)
+	}
+}
+
+// serveHanging answers like serveConfigMap with the given data but never
+// answers requests for resource.
+func serveHanging(data map[string]string, resource string) http.HandlerFunc {
+	configMap := serveConfigMap(data)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/"+resource) {
+			<-r.Context().Done()
+			return
+		}
+		configMap(w, r)
+	}
+}
+
+func TestAPITimeout(t *testing.T) {
+	data := map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}
+
+	tests := []struct {
+		name    string
+		hang    string
+		policy  string
+		allowed bool
+		message string
+	}{
+		{"config lookup, failing closed", "configmaps", failurePolicyFail, false, "could not load config"},
+		{"config lookup, failing open", "configmaps", failurePolicyAllow, true, ""},
+		{"pod list, failing closed", "pods", failurePolicyFail, false, "could not list pods"},
+		{"pod list, failing open", "pods", failurePolicyAllow, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newAPIServerController(t, serveHanging(data, tt.hang))
+			ctrl.apiTimeout = 50 * time.Millisecond
+			ctrl.failurePolicy = tt.policy
+			start := time.Now()
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("new", "tenant-a", "1", "1Gi"), nil))
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("review took %v despite the API timeout", elapsed)
+			}
+			checkResponse(t, resp, tt.allowed, tt.message)
+			if !tt.allowed && !strings.Contains(resp.Result.Message, context.DeadlineExceeded.Error()) {
+				t.Errorf("message = %q, want it to name the timeout", resp.Result.Message)
+			}
+		})
+	}
+}
+
+func TestMaxProcessingTime(t *testing.T) {
+	data := map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "maxProcessingTime": "100ms"}
+	tests := []struct {
+		name    string
+		data    map[string]string
+		hang    bool
+		allowed bool
+		message string
+	}{
+		{"slow listing, timeout policy denies", withData(data, map[string]string{"timeoutPolicy": failurePolicyFail, "failurePolicy": failurePolicyAllow}), true, false, "could not decide within maxProcessingTime of 100ms"},
+		{"slow listing, timeout policy allows", withData(data, map[string]string{"timeoutPolicy": failurePolicyAllow}), true, true, ""},
+		{"slow listing, failure policy by default", withData(data, map[string]string{"failurePolicy": failurePolicyAllow}), true, true, ""},
+		{"fast listing", data, false, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The pods are listed with the much longer API timeout, so only
+			// the internal deadline can cut the review short.
+			config, err := parseConfig(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var handler http.Handler = servePods()
+			if tt.hang {
+				handler = serveHanging(tt.data, "pods")
+			}
+			ctrl := newAPIServerController(t, handler)
+			ctrl.setConfig(config)
+			start := time.Now()
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("new", "tenant-a", "1", "1Gi"), nil))
+			if elapsed := time.Since(start); elapsed > ctrl.apiTimeout/2 {
+				t.Errorf("review took %v despite the internal deadline", elapsed)
+			}
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
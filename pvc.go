@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+var pvcResource = corev1.SchemeGroupVersion.WithResource("persistentvolumeclaims")
+
+// reviewPVC decides whether a PersistentVolumeClaim is admitted: the storage
+// requested by the tenant's claims, this one included, must fit the storage
+// limit. Claims are matched to their tenant like pods, and claims that belong
+// to no tenant are allowed.
+func (ctrl *Controller) reviewPVC(ctx context.Context, ar admissionv1.AdmissionReview, r *review) (*admissionv1.AdmissionResponse, error) {
+	var pvc corev1.PersistentVolumeClaim
+	if err := json.Unmarshal(ar.Request.Object.Raw, &pvc); err != nil {
+		return deny(&admissionv1.AdmissionResponse{}, newRejection(reasonInvalidObject, "could not unmarshal persistentvolumeclaim object"))
+	}
+
+	config, err := ctrl.loadConfig(ctx)
+	if err != nil {
+		return failureResponse(ctrl.failurePolicy, reasonConfigError, fmt.Sprintf("could not load config: %v", err))
+	}
+	r.config = &config
+
+	if config.namespaceExcluded(ar.Request.Namespace) {
+		return &admissionv1.AdmissionResponse{Allowed: true}, nil
+	}
+	if pvc.Annotations[bypassAnnotation] == "true" && config.bypassAllowed(ar.Request.UserInfo) {
+		slog.Info("Bypassing quota", "namespace", ar.Request.Namespace, "user", ar.Request.UserInfo.Username)
+		return &admissionv1.AdmissionResponse{Allowed: true}, nil
+	}
+
+	tenant, ok, err := resolveTenant(ar.Request, config, pvc.Labels, "persistentvolumeclaims")
+	r.tenant = tenant
+	if err != nil {
+		return deny(&admissionv1.AdmissionResponse{}, err)
+	}
+	if !ok {
+		return &admissionv1.AdmissionResponse{Allowed: true}, nil
+	}
+	team := config.podTeam(pvc.Labels)
+	r.team = team
+
+	config = config.forTenant(tenant).forTeam(tenant, team)
+	config, err = config.withNamespaceQuota(ctx, ctrl, ar.Request.Namespace)
+	if err != nil {
+		return failureResponse(config.failurePolicy(ctrl.failurePolicy), reasonConfigError, fmt.Sprintf("could not get namespace quota: %v", err))
+	}
+	quota, err := parseQuota(config)
+	if err != nil {
+		return failureResponse(config.failurePolicy(ctrl.failurePolicy), reasonConfigError, fmt.Sprintf("invalid quota in config: %v", err))
+	}
+	if quota.Storage.IsZero() {
+		return &admissionv1.AdmissionResponse{Allowed: true}, nil
+	}
+
+	requested := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+	if ar.Request.Operation == admissionv1.Update {
+		var old corev1.PersistentVolumeClaim
+		if err := json.Unmarshal(ar.Request.OldObject.Raw, &old); err != nil {
+			return deny(&admissionv1.AdmissionResponse{}, newRejection(reasonInvalidObject, "old object: could not unmarshal persistentvolumeclaim object"))
+		}
+		if previous := old.Spec.Resources.Requests[corev1.ResourceStorage]; requested.Cmp(previous) <= 0 {
+			return &admissionv1.AdmissionResponse{Allowed: true}, nil
+		}
+	}
+
+	used, err := ctrl.tenantStorage(ctx, ar.Request.Namespace, tenant, team, config, pvc.Name)
+	if err != nil {
+		return failureResponse(config.failurePolicy(ctrl.failurePolicy), reasonListFailed, fmt.Sprintf("could not list persistentvolumeclaims: %v", err))
+	}
+
+	sum := used.DeepCopy()
+	sum.Add(requested)
+	if sum.Cmp(quota.Storage) > 0 {
+		return deny(&admissionv1.AdmissionResponse{}, newRejection(exceededReason(corev1.ResourceStorage, ""),
+			"Storage limit exceeded: requested %s on top of %s used, limit is %s", requested.String(), used.String(), quota.Storage.String()))
+	}
+	return &admissionv1.AdmissionResponse{Allowed: true}, nil
+}
+
+// tenantStorage sums the storage requested by the tenant's claims in namespace,
+// or in all namespaces for a cluster-wide quota, leaving out the named claim
+// so that a resize is not counted twice and claims that are being deleted.
+// Claims without the tenant label count too in namespaces that
+// namespaceTenants maps to the tenant.
+func (ctrl *Controller) tenantStorage(ctx context.Context, namespace, tenant, team string, config Config, replaced string) (resource.Quantity, error) {
+	if ctrl.client == nil {
+		return resource.Quantity{}, errNoClient
+	}
+	selector, err := config.tenantSelector(tenant, team)
+	if err != nil {
+		return resource.Quantity{}, err
+	}
+	listNamespace := namespace
+	if config.ClusterWideQuota {
+		listNamespace = metav1.NamespaceAll
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ctrl.apiTimeout)
+	defer cancel()
+
+	list := func(namespace string, selector labels.Selector) ([]corev1.PersistentVolumeClaim, error) {
+		var claims *corev1.PersistentVolumeClaimList
+		err := retryTransient(ctx, func() (err error) {
+			claims, err = ctrl.client.CoreV1().PersistentVolumeClaims(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return claims.Items, nil
+	}
+	claims, err := list(listNamespace, selector)
+	if err != nil {
+		return resource.Quantity{}, err
+	}
+	for _, mapped := range config.mappedNamespaces(tenant) {
+		if listNamespace != metav1.NamespaceAll && mapped != listNamespace {
+			continue
+		}
+		unlabeled, err := config.tenantSelector("", team)
+		if err != nil {
+			return resource.Quantity{}, err
+		}
+		more, err := list(mapped, unlabeled)
+		if err != nil {
+			return resource.Quantity{}, err
+		}
+		claims = append(claims, more...)
+	}
+
+	total := resource.Quantity{}
+	for _, claim := range claims {
+		if claim.DeletionTimestamp != nil || (claim.Namespace == namespace && claim.Name == replaced) {
+			continue
+		}
+		total.Add(claim.Spec.Resources.Requests[corev1.ResourceStorage])
+	}
+	return total, nil
+}
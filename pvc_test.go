@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testPVC(name, tenant, storage string) *corev1.PersistentVolumeClaim {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse(storage)},
+			},
+		},
+	}
+	if tenant != "" {
+		pvc.Labels = map[string]string{defaultTenantLabelKey: tenant}
+	}
+	return pvc
+}
+
+func TestReviewPVC(t *testing.T) {
+	base := map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "limitStorage": "10Gi"}
+	with := func(extra map[string]string) map[string]string { return withData(base, extra) }
+	bypassed := testPVC("new", "tenant-a", "100Gi")
+	bypassed.Annotations = map[string]string{bypassAnnotation: "true"}
+
+	tests := []struct {
+		name      string
+		data      map[string]string
+		operation admissionv1.Operation
+		pvc       *corev1.PersistentVolumeClaim
+		old       *corev1.PersistentVolumeClaim
+		user      string
+		allowed   bool
+		message   string
+	}{
+		{name: "within the storage limit", data: base, pvc: testPVC("new", "tenant-a", "4Gi"), allowed: true},
+		{name: "over the storage limit", data: base, pvc: testPVC("new", "tenant-a", "5Gi"), message: "Storage limit exceeded"},
+		{name: "other tenants are not counted", data: base, pvc: testPVC("new", "tenant-c", "10Gi"), allowed: true},
+		{name: "claims without a tenant are allowed", data: base, pvc: testPVC("new", "", "100Gi"), allowed: true},
+		{name: "no storage limit", data: with(map[string]string{"limitStorage": ""}), pvc: testPVC("new", "tenant-a", "100Gi"), allowed: true},
+		{name: "shrinking resize", data: base, operation: admissionv1.Update, pvc: testPVC("existing", "tenant-a", "1Gi"), old: testPVC("existing", "tenant-a", "6Gi"), allowed: true},
+		{name: "resize within the limit", data: base, operation: admissionv1.Update, pvc: testPVC("existing", "tenant-a", "10Gi"), old: testPVC("existing", "tenant-a", "6Gi"), allowed: true},
+		{name: "resize over the limit", data: base, operation: admissionv1.Update, pvc: testPVC("existing", "tenant-a", "11Gi"), old: testPVC("existing", "tenant-a", "6Gi"), message: "Storage limit exceeded"},
+		{name: "missing required tenant label", data: with(map[string]string{"requireTenantLabel": "true"}), pvc: testPVC("new", "", "1Gi"), message: "must carry the"},
+		{name: "namespace mapped to the tenant", data: with(map[string]string{"namespaceTenants": `{"` + testNamespace + `": "tenant-a"}`}), pvc: testPVC("new", "", "5Gi"), message: "Storage limit exceeded"},
+		{name: "user may not create for the tenant", data: with(map[string]string{"verifyTenantIdentity": "true", "tenantUsers": `{"tenant-a": ["alice"]}`}), pvc: testPVC("new", "tenant-a", "1Gi"), user: "mallory", message: "may not create persistentvolumeclaims"},
+		{name: "user of the tenant", data: with(map[string]string{"verifyTenantIdentity": "true", "tenantUsers": `{"tenant-a": ["alice"]}`}), pvc: testPVC("new", "tenant-a", "1Gi"), user: "alice", allowed: true},
+		{name: "bypass by an allowed user", data: with(map[string]string{"bypassUsers": "admin"}), pvc: bypassed, user: "admin", allowed: true},
+		{name: "bypass by another user", data: with(map[string]string{"bypassUsers": "admin"}), pvc: bypassed, user: "alice", message: "Storage limit exceeded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(tt.data, testPVC("existing", "tenant-a", "6Gi"), testPVC("other", "tenant-b", "6Gi"))
+			operation := tt.operation
+			if operation == "" {
+				operation = admissionv1.Create
+			}
+			var old interface{}
+			if tt.old != nil {
+				old = tt.old
+			}
+			ar := admissionReview(t, metav1.GroupVersionResource(pvcResource), operation, tt.pvc, old)
+			ar.Request.UserInfo = authenticationv1.UserInfo{Username: tt.user}
+
+			// The whole path is run, side effects included, which PVCs must
+			// get through without a pod target.
+			resp := ctrl.processAdmissionReview(context.Background(), ar)
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
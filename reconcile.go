@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/selection"
+)
+
+// reconcileIdleInterval is how often the reconciler checks whether it has been
+// enabled while reconcileInterval is unset.
+const reconcileIdleInterval = time.Minute
+
+var tenantsOverQuota = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "tenants_over_quota",
+	Help: "Number of tenants whose existing pods exceed their quota, as of the last reconcile.",
+})
+
+func init() {
+	prometheus.MustRegister(tenantsOverQuota)
+}
+
+// runReconciler periodically looks for tenants that are already over their
+// quota, e.g. because pods were created while the webhook was unavailable or
+// the quota was lowered. It only reports them; existing pods are never
+// touched. It runs on the leader only.
+func (ctrl *Controller) runReconciler(ctx context.Context) {
+	interval := reconcileIdleInterval
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		interval = reconcileIdleInterval
+		if config, err := ctrl.loadConfig(ctx); err == nil && config.ReconcileInterval > 0 {
+			ctrl.reconcileQuotas(ctx, config)
+			interval = config.ReconcileInterval
+		}
+	}
+}
+
+// tenantKey identifies the pods that share a quota: a tenant, or a team of it,
+// in a namespace, or in all namespaces for a cluster-wide quota.
+type tenantKey struct {
+	namespace string
+	tenant    string
+	team      string
+}
+
+// reconcileQuotas checks the usage of every tenant in the pod cache against its
+// quota and reports the ones that exceed it. The cache only holds labelled
+// pods, so the unlabelled pods in namespaces mapped to a tenant are listed
+// from the API server.
+func (ctrl *Controller) reconcileQuotas(ctx context.Context, config Config) {
+	if ctrl.podLister == nil || !ctrl.podsSynced() || ctrl.podCacheLabelKey != config.TenantLabelKey {
+		return
+	}
+	pods, err := ctrl.podLister.List(labels.Everything())
+	if err != nil {
+		slog.Error("Error listing pods for reconcile", "error", err)
+		return
+	}
+	unlabeled, err := labels.NewRequirement(config.TenantLabelKey, selection.DoesNotExist, nil)
+	if err != nil {
+		slog.Error("Invalid tenant label for reconcile", "error", err)
+		return
+	}
+	for namespace := range config.NamespaceTenants {
+		more, err := ctrl.getPodsWithLabel(ctx, namespace, labels.NewSelector().Add(*unlabeled))
+		if err != nil {
+			slog.Error("Error listing pods for reconcile", "namespace", namespace, "error", err)
+			return
+		}
+		for i := range more {
+			pods = append(pods, &more[i])
+		}
+	}
+
+	usages := map[tenantKey]*Usage{}
+	for _, pod := range pods {
+		tenant, ok := config.podTenant(pod.Namespace, pod.Labels)
+		if !ok || config.namespaceExcluded(pod.Namespace) {
+			continue
+		}
+		team := config.podTeam(pod.Labels)
+		tenantConfig := config.forTenant(tenant).forTeam(tenant, team)
+		if !countsTowardUsage(*pod, tenantConfig) {
+			continue
+		}
+
+		key := tenantKey{namespace: pod.Namespace, tenant: tenant, team: team}
+		if tenantConfig.ClusterWideQuota {
+			key.namespace = ""
+		}
+		usage, ok := usages[key]
+		if !ok {
+			u := newUsage()
+			usage = &u
+			usages[key] = usage
+		}
+		usage.add(podUsage(pod, tenantConfig))
+	}
+
+	over := 0
+	for key, usage := range usages {
+		tenantConfig := config.forTenant(key.tenant).forTeam(key.tenant, key.team)
+		var err error
+		if key.namespace != "" {
+			tenantConfig, err = tenantConfig.withNamespaceQuota(ctx, ctrl, key.namespace)
+			if err == nil {
+				tenantConfig, err = tenantConfig.withResourceQuota(ctx, ctrl, key.namespace)
+			}
+		}
+		if err == nil {
+			tenantConfig, err = tenantConfig.withNodeAllocatable(ctx, ctrl)
+		}
+		if err != nil {
+			slog.Error("Error resolving quota for reconcile", "namespace", key.namespace, "tenant", key.tenant, "team", key.team, "error", err)
+			continue
+		}
+		quota, err := parseQuota(tenantConfig)
+		if err != nil {
+			slog.Error("Invalid quota for reconcile", "namespace", key.namespace, "tenant", key.tenant, "team", key.team, "error", err)
+			continue
+		}
+
+		if exceeded := overQuota(*usage, quota, tenantConfig.MaxPods); len(exceeded) > 0 {
+			over++
+			slog.Warn("Tenant is over quota", "namespace", key.namespace, "tenant", key.tenant, "team", key.team, "exceeded", exceeded)
+		}
+	}
+	tenantsOverQuota.Set(float64(over))
+}
+
+// overQuota describes every ceiling that usage already exceeds. maxPods is
+// ignored when zero.
+func overQuota(usage Usage, quota Quota, maxPods int) []string {
+	scoped := usage.Limits
+	if quota.Scope == quotaScopeRequests {
+		scoped = usage.Requests
+	}
+
+	var exceeded []string
+	check := func(used, ceilings corev1.ResourceList, description string) {
+		for _, name := range sortedResourceNames(ceilings) {
+			ceiling := ceilings[name]
+			if quantity := used[name]; quantity.Cmp(ceiling) > 0 {
+				exceeded = append(exceeded, fmt.Sprintf("%s %s: %s used, %s is %s",
+					resourceDisplayName(name), description, quantity.String(), description, ceiling.String()))
+			}
+		}
+	}
+	check(scoped, quota.Limits, "limit")
+	check(usage.Requests, quota.Requests, "request quota")
+	if maxPods > 0 && usage.Pods > maxPods {
+		exceeded = append(exceeded, fmt.Sprintf("pods: %d, limit is %d", usage.Pods, maxPods))
+	}
+	return exceeded
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestReconcileQuotas(t *testing.T) {
+	data := map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}
+	finished := testPod("finished", "tenant-b", "4", "1Gi")
+	finished.Status.Phase = corev1.PodSucceeded
+	unlabeled := testPod("unlabeled", "", "2", "1Gi")
+	unlabeled.Labels = nil
+
+	tests := []struct {
+		name   string
+		data   map[string]string
+		pods   []*corev1.Pod
+		listed []runtime.Object
+		synced bool
+		over   float64
+		warned []string
+	}{
+		{
+			name:   "seeded tenant over quota",
+			data:   data,
+			pods:   []*corev1.Pod{testPod("a-1", "tenant-a", "2", "1Gi"), testPod("a-2", "tenant-a", "1", "512Mi"), testPod("b-1", "tenant-b", "1", "1Gi")},
+			synced: true,
+			over:   1,
+			warned: []string{"tenant=tenant-a", "CPU limit: 3 used, limit is 2"},
+		},
+		{
+			name:   "finished pods are not counted",
+			data:   data,
+			pods:   []*corev1.Pod{testPod("b-1", "tenant-b", "1", "1Gi"), finished},
+			synced: true,
+		},
+		{
+			name:   "excluded namespace",
+			data:   withData(data, map[string]string{"excludedNamespaces": "tenant-a-ns"}),
+			pods:   []*corev1.Pod{testPod("a-1", "tenant-a", "4", "4Gi")},
+			synced: true,
+		},
+		{
+			name:   "pod limit",
+			data:   withData(data, map[string]string{"maxPods": "1"}),
+			pods:   []*corev1.Pod{testPod("a-1", "tenant-a", "500m", "512Mi"), testPod("a-2", "tenant-a", "500m", "512Mi")},
+			synced: true,
+			over:   1,
+			warned: []string{"pods: 2, limit is 1"},
+		},
+		{
+			name:   "unlabeled pods in a mapped namespace",
+			data:   withData(data, map[string]string{"namespaceTenants": `{"` + testNamespace + `": "tenant-a"}`}),
+			pods:   []*corev1.Pod{testPod("a-1", "tenant-a", "1", "512Mi")},
+			listed: []runtime.Object{unlabeled},
+			synced: true,
+			over:   1,
+			warned: []string{"tenant=tenant-a", "CPU limit: 3 used, limit is 2"},
+		},
+		{
+			name: "cache not synced",
+			data: data,
+			pods: []*corev1.Pod{testPod("a-1", "tenant-a", "4", "4Gi")},
+			over: -1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			previous := slog.Default()
+			slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+			t.Cleanup(func() { slog.SetDefault(previous) })
+			// The gauge is left alone when nothing was checked.
+			tenantsOverQuota.Set(-1)
+
+			ctrl := newTestController(tt.data, tt.listed...)
+			usePodCache(t, ctrl, tt.synced, tt.pods...)
+			config, err := ctrl.loadConfig(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctrl.reconcileQuotas(context.Background(), config)
+
+			if got := testutil.ToFloat64(tenantsOverQuota); got != tt.over {
+				t.Errorf("tenants_over_quota = %v, want %v", got, tt.over)
+			}
+			if tt.warned == nil && strings.Contains(buf.String(), "over quota") {
+				t.Errorf("logged a warning for tenants within quota:\n%s", buf.String())
+			}
+			for _, want := range tt.warned {
+				if !strings.Contains(buf.String(), want) {
+					t.Errorf("log does not mention %q:\n%s", want, buf.String())
+				}
+			}
+		})
+	}
+}
+
+func TestOverQuota(t *testing.T) {
+	quota := Quota{Limits: cpuMemory("2", "2Gi")}
+	tests := []struct {
+		name    string
+		usage   Usage
+		quota   Quota
+		maxPods int
+		want    []string
+	}{
+		{name: "within quota", usage: Usage{Limits: cpuMemory("2", "2Gi"), Pods: 3}, quota: quota},
+		{name: "over the limits", usage: Usage{Limits: cpuMemory("3", "3Gi")}, quota: quota, want: []string{"CPU limit: 3 used, limit is 2", "Memory limit: 3Gi used, limit is 2Gi"}},
+		{name: "requests scope", usage: Usage{Limits: cpuMemory("3", ""), Requests: cpuMemory("1", "")}, quota: Quota{Limits: cpuMemory("2", ""), Scope: quotaScopeRequests}},
+		{name: "request quota", usage: Usage{Requests: cpuMemory("1500m", "")}, quota: Quota{Requests: cpuMemory("1", "")}, want: []string{"CPU request quota: 1500m used, request quota is 1"}},
+		{name: "pod limit", usage: Usage{Pods: 3}, quota: quota, maxPods: 2, want: []string{"pods: 3, limit is 2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := overQuota(tt.usage, tt.quota, tt.maxPods); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("overQuota() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
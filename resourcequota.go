@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// withResourceQuota replaces the config's ceilings with the hard limits of the
+// ResourceQuota named by ResourceQuotaName in the namespace, so the quota only
+// has to be maintained in one place. Ceilings the ResourceQuota does not set,
+// or all of them if it does not exist, keep their configured values.
+func (c Config) withResourceQuota(ctx context.Context, ctrl *Controller, namespace string) (Config, error) {
+	if c.ResourceQuotaName == "" {
+		return c, nil
+	}
+
+	resourceQuota, err := ctrl.getResourceQuota(ctx, namespace, c.ResourceQuotaName)
+	if apierrors.IsNotFound(err) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+
+	fields := []struct {
+		name  corev1.ResourceName
+		field *string
+	}{
+		{corev1.ResourceLimitsCPU, &c.LimitCPU},
+		{corev1.ResourceLimitsMemory, &c.LimitMemory},
+		{corev1.ResourceRequestsCPU, &c.RequestCPU},
+		{corev1.ResourceRequestsMemory, &c.RequestMemory},
+	}
+	for _, f := range fields {
+		if quantity, ok := resourceQuota.Spec.Hard[f.name]; ok {
+			*f.field = quantity.String()
+		}
+	}
+	return c, nil
+}
+
+// getResourceQuota returns the ResourceQuota from the cache once it has synced
+// and from the API server until then.
+func (ctrl *Controller) getResourceQuota(ctx context.Context, namespace, name string) (*corev1.ResourceQuota, error) {
+	if ctrl.resourceQuotaLister != nil && ctrl.resourceQuotasSynced() {
+		return ctrl.resourceQuotaLister.ResourceQuotas(namespace).Get(name)
+	}
+	if ctrl.client == nil {
+		return nil, errNoClient
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ctrl.apiTimeout)
+	defer cancel()
+
+	var resourceQuota *corev1.ResourceQuota
+	err := retryTransient(ctx, func() (err error) {
+		resourceQuota, err = ctrl.client.CoreV1().ResourceQuotas(namespace).Get(ctx, name, metav1.GetOptions{})
+		return err
+	})
+	return resourceQuota, err
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func testResourceQuota(namespace string, hard corev1.ResourceList) *corev1.ResourceQuota {
+	return &corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{Name: "compute", Namespace: namespace},
+		Spec:       corev1.ResourceQuotaSpec{Hard: hard},
+	}
+}
+
+// serveResourceQuotas answers ResourceQuota gets with the given objects and
+// every other request with servePods.
+func serveResourceQuotas(quotas []corev1.ResourceQuota, pods ...corev1.Pod) http.HandlerFunc {
+	listPods := servePods(pods...)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.Path, "/resourcequotas/") {
+			listPods(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		for _, quota := range quotas {
+			if r.URL.Path == "/api/v1/namespaces/"+quota.Namespace+"/resourcequotas/"+quota.Name {
+				quota.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "ResourceQuota"}
+				json.NewEncoder(w).Encode(&quota)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(&metav1.Status{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Status"},
+			Status:   metav1.StatusFailure,
+			Reason:   metav1.StatusReasonNotFound,
+			Code:     http.StatusNotFound,
+		})
+	}
+}
+
+func TestWithResourceQuota(t *testing.T) {
+	data := map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "resourceQuotaName": "compute"}
+	hard := corev1.ResourceList{
+		corev1.ResourceLimitsCPU:      resource.MustParse("4"),
+		corev1.ResourceLimitsMemory:   resource.MustParse("8Gi"),
+		corev1.ResourceRequestsCPU:    resource.MustParse("2"),
+		corev1.ResourceRequestsMemory: resource.MustParse("4Gi"),
+	}
+
+	tests := []struct {
+		name     string
+		data     map[string]string
+		quotas   []corev1.ResourceQuota
+		limits   [2]string
+		requests [2]string
+	}{
+		{"limits from the ResourceQuota", data, []corev1.ResourceQuota{*testResourceQuota(testNamespace, hard)}, [2]string{"4", "8Gi"}, [2]string{"2", "4Gi"}},
+		{"partial ResourceQuota", data, []corev1.ResourceQuota{*testResourceQuota(testNamespace, corev1.ResourceList{corev1.ResourceLimitsCPU: resource.MustParse("3")})}, [2]string{"3", "2Gi"}, [2]string{"", ""}},
+		{"missing ResourceQuota falls back to the config", data, nil, [2]string{"2", "2Gi"}, [2]string{"", ""}},
+		{"ResourceQuota of another namespace", data, []corev1.ResourceQuota{*testResourceQuota("other", hard)}, [2]string{"2", "2Gi"}, [2]string{"", ""}},
+		{"mode disabled", map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}, []corev1.ResourceQuota{*testResourceQuota(testNamespace, hard)}, [2]string{"2", "2Gi"}, [2]string{"", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := parseConfig(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctrl := newAPIServerController(t, serveResourceQuotas(tt.quotas))
+			config, err = config.withResourceQuota(context.Background(), ctrl, testNamespace)
+			if err != nil {
+				t.Fatalf("withResourceQuota() error = %v", err)
+			}
+			got := [4]string{config.LimitCPU, config.LimitMemory, config.RequestCPU, config.RequestMemory}
+			want := [4]string{tt.limits[0], tt.limits[1], tt.requests[0], tt.requests[1]}
+			if got != want {
+				t.Errorf("limitCPU, limitMemory, requestCPU, requestMemory = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestResourceQuotaFromCache(t *testing.T) {
+	data := map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "resourceQuotaName": "compute"}
+	tests := []struct {
+		name    string
+		cached  *corev1.ResourceQuota
+		cpu     string
+		allowed bool
+	}{
+		{"limits from the cached ResourceQuota", testResourceQuota(testNamespace, corev1.ResourceList{corev1.ResourceLimitsCPU: resource.MustParse("8")}), "3", true},
+		{"missing ResourceQuota falls back to the config", nil, "3", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(data)
+			indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+			if tt.cached != nil {
+				if err := indexer.Add(tt.cached); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ctrl.resourceQuotaLister = corelisters.NewResourceQuotaLister(indexer)
+			ctrl.resourceQuotasSynced = func() bool { return true }
+
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("new", "tenant-a", tt.cpu, "512Mi"), nil))
+			checkResponse(t, resp, tt.allowed, "CPU limit exceeded")
+			for _, action := range ctrl.client.(*fake.Clientset).Actions() {
+				if action.Matches("get", "resourcequotas") {
+					t.Errorf("got the ResourceQuota from the API server despite the synced cache: %+v", action)
+				}
+			}
+		})
+	}
+}
+
+func TestResourceQuotaEnforced(t *testing.T) {
+	data := map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "resourceQuotaName": "compute"}
+	hard := corev1.ResourceList{corev1.ResourceLimitsCPU: resource.MustParse("4"), corev1.ResourceLimitsMemory: resource.MustParse("4Gi")}
+	config, err := parseConfig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrl := newAPIServerController(t, serveResourceQuotas([]corev1.ResourceQuota{*testResourceQuota(testNamespace, hard)}, *testPod("running", "tenant-a", "1", "1Gi")))
+	ctrl.setConfig(config)
+
+	small := podReview(t, admissionv1.Create, testPod("small", "tenant-a", "3", "1Gi"), nil)
+	if resp := ctrl.processAdmissionReview(context.Background(), small); !resp.Allowed {
+		t.Fatalf("first pod denied: %v", resp.Result)
+	}
+	big := podReview(t, admissionv1.Create, testPod("big", "tenant-a", "1", "1Gi"), nil)
+	resp := ctrl.processAdmissionReview(context.Background(), big)
+	if resp.Allowed {
+		t.Fatal("second pod allowed, want it denied by the ResourceQuota")
+	}
+	if want := "CPU limit exceeded: requested 1 on top of 4 used, limit is 4"; !strings.Contains(resp.Result.Message, want) {
+		t.Errorf("message = %q, want it to contain %q", resp.Result.Message, want)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// Usage holds the summed limits and requests of one or more pods.
+type Usage struct {
+	Limits   corev1.ResourceList
+	Requests corev1.ResourceList
+	Pods     int
+
+	// BestEffortPods counts the pods of QoS class BestEffort among Pods.
+	BestEffortPods int
+
+	// QOSClasses holds the limits or requests, whichever the quota scope
+	// sums, of the Guaranteed and the Burstable pods.
+	QOSClasses map[corev1.PodQOSClass]corev1.ResourceList
+}
+
+func newUsage() Usage {
+	return Usage{Limits: corev1.ResourceList{}, Requests: corev1.ResourceList{}, QOSClasses: map[corev1.PodQOSClass]corev1.ResourceList{}}
+}
+
+func (u *Usage) add(other Usage) {
+	addResourceList(u.Limits, other.Limits)
+	addResourceList(u.Requests, other.Requests)
+	u.Pods += other.Pods
+	u.BestEffortPods += other.BestEffortPods
+	for class, list := range other.QOSClasses {
+		if u.QOSClasses == nil {
+			u.QOSClasses = map[corev1.PodQOSClass]corev1.ResourceList{}
+		}
+		if u.QOSClasses[class] == nil {
+			u.QOSClasses[class] = corev1.ResourceList{}
+		}
+		addResourceList(u.QOSClasses[class], list)
+	}
+}
+
+func (u Usage) equal(other Usage) bool {
+	if u.Pods != other.Pods || u.BestEffortPods != other.BestEffortPods || !resourceListsEqual(u.Limits, other.Limits) || !resourceListsEqual(u.Requests, other.Requests) {
+		return false
+	}
+	for _, class := range []corev1.PodQOSClass{corev1.PodQOSGuaranteed, corev1.PodQOSBurstable} {
+		if !resourceListsEqual(u.QOSClasses[class], other.QOSClasses[class]) {
+			return false
+		}
+	}
+	return true
+}
+
+// within reports whether u uses no more than other of every resource and no
+// more pods. Missing entries count as zero.
+func (u Usage) within(other Usage) bool {
+	if u.Pods > other.Pods || !resourceListWithin(u.Limits, other.Limits) || !resourceListWithin(u.Requests, other.Requests) {
+		return false
+	}
+	for class, list := range u.QOSClasses {
+		if !resourceListWithin(list, other.QOSClasses[class]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (u Usage) clone() Usage {
+	c := newUsage()
+	c.add(u)
+	return c
+}
+
+// times returns the usage of n copies of u.
+func (u Usage) times(n int) Usage {
+	total := newUsage()
+	for i := 0; i < n; i++ {
+		total.add(u)
+	}
+	return total
+}
+
+// sub removes other from u. Resources never drop below zero, so usage that
+// was charged but never counted cannot go negative.
+func (u *Usage) sub(other Usage) {
+	subResourceList(u.Limits, other.Limits)
+	subResourceList(u.Requests, other.Requests)
+	u.Pods -= other.Pods
+	if u.Pods < 0 {
+		u.Pods = 0
+	}
+	u.BestEffortPods -= other.BestEffortPods
+	if u.BestEffortPods < 0 {
+		u.BestEffortPods = 0
+	}
+	for class, list := range other.QOSClasses {
+		if u.QOSClasses[class] != nil {
+			subResourceList(u.QOSClasses[class], list)
+		}
+	}
+}
+
+// podUsage returns the effective limits and requests of a pod.
+func podUsage(pod *corev1.Pod, config Config) Usage {
+	usage := Usage{
+		Limits:   podResources(pod, config, quotaScopeLimits),
+		Requests: podResources(pod, config, quotaScopeRequests),
+		Pods:     1,
+	}
+	class := podQOSClass(pod)
+	if class == corev1.PodQOSBestEffort {
+		usage.BestEffortPods = 1
+		return usage
+	}
+	scoped := usage.Limits
+	if config.QuotaScope == quotaScopeRequests {
+		scoped = usage.Requests
+	}
+	classUsage := corev1.ResourceList{}
+	addResourceList(classUsage, scoped)
+	usage.QOSClasses = map[corev1.PodQOSClass]corev1.ResourceList{class: classUsage}
+	return usage
+}
+
+// podQOSClass returns the QoS class of a pod the way the kubelet assigns it.
+// The class is computed from the spec rather than read from the status, which
+// is not set yet when a pod is admitted. Only CPU and memory are considered
+// and zero quantities count as unset.
+func podQOSClass(pod *corev1.Pod) corev1.PodQOSClass {
+	requests := corev1.ResourceList{}
+	limits := corev1.ResourceList{}
+	guaranteed := true
+	containers := append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...)
+	for _, container := range containers {
+		set := 0
+		for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+			if quantity, ok := container.Resources.Requests[name]; ok && !quantity.IsZero() {
+				addResourceList(requests, corev1.ResourceList{name: quantity})
+			}
+			if quantity, ok := container.Resources.Limits[name]; ok && !quantity.IsZero() {
+				addResourceList(limits, corev1.ResourceList{name: quantity})
+				set++
+			}
+		}
+		if set < 2 {
+			guaranteed = false
+		}
+	}
+
+	if len(requests) == 0 && len(limits) == 0 {
+		return corev1.PodQOSBestEffort
+	}
+	if guaranteed && resourceListsEqual(requests, limits) {
+		return corev1.PodQOSGuaranteed
+	}
+	return corev1.PodQOSBurstable
+}
+
+// podResources returns the effective limits or requests of a pod, the same
+// way the scheduler computes them: init containers run one after another
+// before the regular containers start, so the pod reserves the larger of the
+// sum of its regular containers and its biggest init container, per
+// resource. Sidecars, init containers with restartPolicy Always, keep running
+// once started: they add to the regular containers and to every init
+// container that starts after them. Ephemeral containers and the RuntimeClass
+// overhead are added on top when the config asks for them.
+func podResources(pod *corev1.Pod, config Config, scope string) corev1.ResourceList {
+	total := corev1.ResourceList{}
+	for _, container := range pod.Spec.Containers {
+		addResourceList(total, scopedResources(container.Resources, scope))
+	}
+
+	initTotal := corev1.ResourceList{}
+	sidecars := corev1.ResourceList{}
+	for _, container := range pod.Spec.InitContainers {
+		resources := scopedResources(container.Resources, scope)
+		if container.RestartPolicy != nil && *container.RestartPolicy == corev1.ContainerRestartPolicyAlways {
+			addResourceList(total, resources)
+			addResourceList(sidecars, resources)
+			maxResourceList(initTotal, sidecars)
+			continue
+		}
+		running := corev1.ResourceList{}
+		addResourceList(running, sidecars)
+		addResourceList(running, resources)
+		maxResourceList(initTotal, running)
+	}
+	maxResourceList(total, initTotal)
+
+	if config.CountEphemeralContainers {
+		for _, container := range pod.Spec.EphemeralContainers {
+			addResourceList(total, scopedResources(container.EphemeralContainerCommon.Resources, scope))
+		}
+	}
+	if config.CountPodOverhead {
+		addResourceList(total, pod.Spec.Overhead)
+	}
+	return total
+}
+
+// scopedResources returns the requests or the limits of a container, with CPU
+// normalized by normalizeCPU.
+func scopedResources(resources corev1.ResourceRequirements, scope string) corev1.ResourceList {
+	list := resources.Limits
+	if scope == quotaScopeRequests {
+		list = resources.Requests
+	}
+	return normalizeCPU(list)
+}
+
+// normalizeCPU rounds CPU up to whole millicores, the precision the scheduler
+// and kubelet work with, so that e.g. "0.0001" counts as the 1m it reserves.
+// Quantities are otherwise summed exactly, so ten containers of 100m add up to
+// exactly 1 CPU and fit a limit of 1.
+func normalizeCPU(list corev1.ResourceList) corev1.ResourceList {
+	cpu, ok := list[corev1.ResourceCPU]
+	if !ok {
+		return list
+	}
+	rounded := resource.NewMilliQuantity(cpu.MilliValue(), resource.DecimalSI)
+	if rounded.Cmp(cpu) == 0 {
+		return list
+	}
+
+	normalized := corev1.ResourceList{}
+	for name, quantity := range list {
+		normalized[name] = quantity
+	}
+	normalized[corev1.ResourceCPU] = *rounded
+	return normalized
+}
+
+// addResourceList adds every quantity in src to the matching entry in dst.
+// Quantities share their decimal representation when copied and Add modifies
+// it in place, so new entries are deep copied: dst never aliases src, which
+// may belong to a pod in the shared informer cache.
+func addResourceList(dst, src corev1.ResourceList) {
+	for name, quantity := range src {
+		if value, ok := dst[name]; ok {
+			value.Add(quantity)
+			dst[name] = value
+		} else {
+			dst[name] = quantity.DeepCopy()
+		}
+	}
+}
+
+// subResourceList subtracts every quantity in src from the matching entry in
+// dst, stopping at zero.
+func subResourceList(dst, src corev1.ResourceList) {
+	for name, quantity := range src {
+		value, ok := dst[name]
+		if !ok {
+			continue
+		}
+		value.Sub(quantity)
+		if value.Sign() < 0 {
+			value.Set(0)
+		}
+		dst[name] = value
+	}
+}
+
+// maxResourceList raises every entry in dst to the matching quantity in src if
+// the latter is larger.
+func maxResourceList(dst, src corev1.ResourceList) {
+	for name, quantity := range src {
+		if value, ok := dst[name]; !ok || quantity.Cmp(value) > 0 {
+			dst[name] = quantity.DeepCopy()
+		}
+	}
+}
+
+// resourceListsEqual reports whether a and b hold equal quantities. Missing
+// entries count as zero.
+func resourceListsEqual(a, b corev1.ResourceList) bool {
+	for name, quantity := range a {
+		other := b[name]
+		if quantity.Cmp(other) != 0 {
+			return false
+		}
+	}
+	for name, quantity := range b {
+		other := a[name]
+		if quantity.Cmp(other) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// resourceListWithin reports whether no quantity in a exceeds the matching one
+// in b.
+func resourceListWithin(a, b corev1.ResourceList) bool {
+	for name, quantity := range a {
+		other := b[name]
+		if quantity.Cmp(other) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// scaleResourceList multiplies every quantity in list by factor, rounding down
+// to the nearest milli unit, or to whole bytes for the resources that
+// checkUnits holds to them.
+func scaleResourceList(list corev1.ResourceList, factor float64) {
+	for name, quantity := range list {
+		scaled := int64(float64(quantity.MilliValue()) * factor)
+		switch name {
+		case corev1.ResourceMemory, corev1.ResourceEphemeralStorage, corev1.ResourceStorage:
+			scaled -= scaled % 1000
+		}
+		list[name] = *resource.NewMilliQuantity(scaled, quantity.Format)
+	}
+}
+
+// sortedResourceNames returns the names in list in a stable order so that
+// quota checks and messages are deterministic.
+func sortedResourceNames(list corev1.ResourceList) []corev1.ResourceName {
+	names := make([]corev1.ResourceName, 0, len(list))
+	for name := range list {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
+
+// resourceDisplayName returns the name used for a resource in messages.
+func resourceDisplayName(name corev1.ResourceName) string {
+	switch name {
+	case corev1.ResourceCPU:
+		return "CPU"
+	case corev1.ResourceMemory:
+		return "Memory"
+	case corev1.ResourceEphemeralStorage:
+		return "Ephemeral storage"
+	default:
+		return string(name)
+	}
+}
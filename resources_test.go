@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// checkResources fails the test unless list holds exactly the cpu and memory
+// given.
+func checkResources(t *testing.T, list corev1.ResourceList, cpu, memory string) {
+	t.Helper()
+	gotCPU, gotMemory := list[corev1.ResourceCPU], list[corev1.ResourceMemory]
+	if len(list) != 2 || gotCPU.Cmp(resource.MustParse(cpu)) != 0 || gotMemory.Cmp(resource.MustParse(memory)) != 0 {
+		t.Errorf("resources = %v, want cpu %s and memory %s", list, cpu, memory)
+	}
+}
+
+func TestPodResourcesInitContainers(t *testing.T) {
+	always := corev1.ContainerRestartPolicyAlways
+	sidecar := func(name, cpu, memory string) corev1.Container {
+		container := testContainer(name, cpu, memory)
+		container.RestartPolicy = &always
+		return container
+	}
+
+	tests := []struct {
+		name       string
+		init       []corev1.Container
+		containers []corev1.Container
+		cpu        string
+		memory     string
+	}{
+		{"no init containers", nil, []corev1.Container{testContainer("a", "1", "1Gi"), testContainer("b", "1", "1Gi")}, "2", "2Gi"},
+		{"init container dominates", []corev1.Container{testContainer("setup", "4", "4Gi")}, []corev1.Container{testContainer("a", "1", "1Gi")}, "4", "4Gi"},
+		{"regular containers dominate", []corev1.Container{testContainer("setup", "1", "1Gi")}, []corev1.Container{testContainer("a", "1", "1Gi"), testContainer("b", "1", "1Gi")}, "2", "2Gi"},
+		{"biggest of several init containers", []corev1.Container{testContainer("first", "3", "1Gi"), testContainer("second", "1", "3Gi")}, []corev1.Container{testContainer("a", "1", "1Gi")}, "3", "3Gi"},
+		{"per resource", []corev1.Container{testContainer("setup", "4", "512Mi")}, []corev1.Container{testContainer("a", "1", "2Gi")}, "4", "2Gi"},
+		{"sidecar adds to the regular containers", []corev1.Container{sidecar("proxy", "1", "1Gi")}, []corev1.Container{testContainer("a", "1", "1Gi")}, "2", "2Gi"},
+		{"sidecar runs next to later init containers", []corev1.Container{sidecar("proxy", "1", "1Gi"), testContainer("setup", "3", "1Gi")}, []corev1.Container{testContainer("a", "1", "1Gi")}, "4", "2Gi"},
+		{"init container before a sidecar", []corev1.Container{testContainer("setup", "3", "1Gi"), sidecar("proxy", "1", "1Gi")}, []corev1.Container{testContainer("a", "1", "1Gi")}, "3", "2Gi"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{Spec: corev1.PodSpec{InitContainers: tt.init, Containers: tt.containers}}
+			checkResources(t, podResources(pod, Config{}, quotaScopeLimits), tt.cpu, tt.memory)
+			checkResources(t, podResources(pod, Config{}, quotaScopeRequests), tt.cpu, tt.memory)
+		})
+	}
+}
+
+func TestSidecarUsage(t *testing.T) {
+	always := corev1.ContainerRestartPolicyAlways
+	withSidecar := func(pod *corev1.Pod, cpu, memory string) *corev1.Pod {
+		sidecar := testContainer("proxy", cpu, memory)
+		sidecar.RestartPolicy = &always
+		pod.Spec.InitContainers = append([]corev1.Container{sidecar}, pod.Spec.InitContainers...)
+		return pod
+	}
+	withInit := func(pod *corev1.Pod, cpu, memory string) *corev1.Pod {
+		pod.Spec.InitContainers = append(pod.Spec.InitContainers, testContainer("setup", cpu, memory))
+		return pod
+	}
+	data := map[string]string{"limitCPU": "4", "limitMemory": "4Gi"}
+
+	tests := []struct {
+		name    string
+		data    map[string]string
+		pod     *corev1.Pod
+		allowed bool
+		message string
+	}{
+		{"sidecar adds to the containers", data, withSidecar(testPod("new", "tenant-a", "1", "1Gi"), "1", "512Mi"), true, ""},
+		{"sidecar pushes the pod over the quota", data, withSidecar(testPod("new", "tenant-a", "1500m", "1Gi"), "1", "512Mi"), false, "CPU limit exceeded: requested 2500m on top of 2 used, limit is 4"},
+		{"init container after a sidecar", data, withInit(withSidecar(testPod("new", "tenant-a", "500m", "512Mi"), "500m", "512Mi"), "2", "512Mi"), false, "requested 2500m on top of 2 used"},
+		{"init container before a sidecar dominates alone", data, withSidecar(withInit(testPod("new", "tenant-a", "500m", "512Mi"), "1500m", "512Mi"), "500m", "512Mi"), true, ""},
+		{"requests scope", withData(data, map[string]string{"quotaScope": "Requests"}), withSidecar(testPod("new", "tenant-a", "1500m", "1Gi"), "1", "512Mi"), false, "CPU limit exceeded: requested 2500m"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The running pod's sidecar is part of the tenant's usage.
+			running := withSidecar(testPod("running", "tenant-a", "1", "1Gi"), "1", "512Mi")
+			ctrl := newTestController(tt.data, running)
+			config, err := ctrl.loadConfig(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			usage, err := ctrl.calculateResourceUsage(context.Background(), testNamespace, "tenant-a", "", config, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkResources(t, usage.Limits, "2", "1536Mi")
+
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, tt.pod, nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestPodResourcesEphemeralContainers(t *testing.T) {
+	debug := testContainer("debug", "500m", "256Mi")
+	pod := &corev1.Pod{Spec: corev1.PodSpec{
+		Containers: []corev1.Container{testContainer("app", "1", "1Gi")},
+		EphemeralContainers: []corev1.EphemeralContainer{{
+			EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debug", Resources: debug.Resources},
+		}},
+	}}
+
+	checkResources(t, podResources(pod, Config{}, quotaScopeLimits), "1", "1Gi")
+	counted := Config{CountEphemeralContainers: true}
+	checkResources(t, podResources(pod, counted, quotaScopeLimits), "1500m", "1280Mi")
+	checkResources(t, podResources(pod, counted, quotaScopeRequests), "1500m", "1280Mi")
+}
+
+func TestScaleResourceList(t *testing.T) {
+	tests := []struct {
+		name   string
+		list   corev1.ResourceList
+		factor float64
+		want   corev1.ResourceList
+	}{
+		{"whole result", cpuMemory("2", "2Gi"), 1.5, cpuMemory("3", "3Gi")},
+		{"cpu rounds down to milli units", cpuMemory("1", ""), 1.0005, cpuMemory("1", "")},
+		{"memory rounds down to whole bytes", cpuMemory("", "2Gi"), 1.1, cpuMemory("", "2362232012")},
+		{
+			"storage rounds down to whole bytes",
+			corev1.ResourceList{corev1.ResourceEphemeralStorage: resource.MustParse("1G"), corev1.ResourceStorage: resource.MustParse("3")},
+			1.0000000005,
+			corev1.ResourceList{corev1.ResourceEphemeralStorage: resource.MustParse("1G"), corev1.ResourceStorage: resource.MustParse("3")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scaleResourceList(tt.list, tt.factor)
+			if !resourceListsEqual(tt.list, tt.want) {
+				t.Errorf("scaled = %v, want %v", resourceListStrings(tt.list), resourceListStrings(tt.want))
+			}
+			for name, quantity := range tt.list {
+				if err := checkUnits(name, quantity); err != nil {
+					t.Errorf("scaled %s = %s: %v", name, quantity.String(), err)
+				}
+			}
+		})
+	}
+}
+
+func TestFractionalQuantities(t *testing.T) {
+	containers := func(count int, cpu, memory string) []corev1.Container {
+		var list []corev1.Container
+		for i := 0; i < count; i++ {
+			list = append(list, testContainer(fmt.Sprintf("c%d", i), cpu, memory))
+		}
+		return list
+	}
+
+	tests := []struct {
+		name       string
+		containers []corev1.Container
+		cpu        string
+		memory     string
+	}{
+		{"ten 100m containers", containers(10, "100m", "100Mi"), "1", "1000Mi"},
+		{"decimal notation", containers(10, "0.1", "0.1Gi"), "1", "1Gi"},
+		{"thirds", containers(3, "333m", "1Mi"), "999m", "3Mi"},
+		{"mixed units", []corev1.Container{testContainer("a", "0.25", "512Mi"), testContainer("b", "250m", "0.5Gi"), testContainer("c", "500m", "1G")}, "1", "2073741824"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: tt.containers}}
+			total := podResources(pod, Config{}, quotaScopeLimits)
+			for name, want := range map[corev1.ResourceName]string{corev1.ResourceCPU: tt.cpu, corev1.ResourceMemory: tt.memory} {
+				got := total[name]
+				if got.Cmp(resource.MustParse(want)) != 0 {
+					t.Errorf("%s = %s, want %s", name, got.String(), want)
+				}
+			}
+		})
+	}
+}
+
+func TestFractionalQuotaBoundaries(t *testing.T) {
+	data := map[string]string{"limitCPU": "1", "limitMemory": "1Gi"}
+	tests := []struct {
+		name    string
+		running []runtime.Object
+		cpu     string
+		allowed bool
+	}{
+		{"ten 100m pods fill a limit of 1", runningPods("tenant-a", 9, "100m", "64Mi"), "100m", true},
+		{"an eleventh 100m pod", runningPods("tenant-a", 10, "100m", "64Mi"), "100m", false},
+		{"one millicore below the limit", runningPods("tenant-a", 3, "333m", "64Mi"), "1m", true},
+		{"one millicore over the limit", runningPods("tenant-a", 3, "333m", "64Mi"), "2m", false},
+		{"decimal notation", runningPods("tenant-a", 3, "0.25", "64Mi"), "0.25", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(data, tt.running...)
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("new", "tenant-a", tt.cpu, "1Mi"), nil))
+			if resp.Allowed != tt.allowed {
+				t.Fatalf("Allowed = %v, want %v (result: %v)", resp.Allowed, tt.allowed, resp.Result)
+			}
+			if !tt.allowed && !strings.Contains(resp.Result.Message, "CPU limit exceeded") {
+				t.Errorf("message = %q, want it to contain %q", resp.Result.Message, "CPU limit exceeded")
+			}
+		})
+	}
+}
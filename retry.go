@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+)
+
+// apiBackoff spaces out retries of transient API errors. Retries also stop
+// once the call's context, bounded by the controller's apiTimeout, is done, so they never push
+// a request past the webhook timeout.
+var apiBackoff = wait.Backoff{
+	Steps:    4,
+	Duration: 100 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+}
+
+// reconnectBackoff spaces out restarts of a long-running loop that returned,
+// such as leader election after the Lease was lost, so that a flapping API
+// server does not cause a tight reconnect loop. Informers need none of this,
+// their reflectors already back off with jitter when a list or watch fails.
+var reconnectBackoff = wait.Backoff{
+	Steps:    10,
+	Duration: time.Second,
+	Factor:   2,
+	Jitter:   0.5,
+	Cap:      time.Minute,
+}
+
+// backoffLoop reruns a long-running function, waiting for the next step of
+// backoff whenever it returns. now and sleep are only replaced in tests.
+type backoffLoop struct {
+	backoff wait.Backoff
+	now     func() time.Time
+	sleep   func(ctx context.Context, delay time.Duration) bool
+}
+
+func newBackoffLoop(backoff wait.Backoff) *backoffLoop {
+	return &backoffLoop{backoff: backoff, now: time.Now, sleep: sleepContext}
+}
+
+// run calls fn until ctx is done. A run that lasted longer than the backoff's
+// cap counts as stable and the delay starts over from the shortest one.
+func (l *backoffLoop) run(ctx context.Context, fn func(context.Context)) {
+	current := l.backoff
+	for ctx.Err() == nil {
+		started := l.now()
+		fn(ctx)
+		if l.now().Sub(started) > l.backoff.Cap {
+			current = l.backoff
+		}
+
+		delay := current.Step()
+		slog.Debug("Restarting after backoff", "delay", delay)
+		if !l.sleep(ctx, delay) {
+			return
+		}
+	}
+}
+
+// sleepContext waits for delay and reports whether it passed before ctx was
+// done.
+func sleepContext(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// retryTransient calls fn until it succeeds, fails with an error that is not
+// transient, or the backoff or ctx run out.
+func retryTransient(ctx context.Context, fn func() error) error {
+	return retry.OnError(apiBackoff, func(err error) bool {
+		return ctx.Err() == nil && transientError(err)
+	}, fn)
+}
+
+// transientError reports whether an API call failed in a way that may succeed
+// when retried. NotFound and other definitive answers are not retried.
+func transientError(err error) bool {
+	return apierrors.IsTimeout(err) ||
+		apierrors.IsServerTimeout(err) ||
+		apierrors.IsTooManyRequests(err) ||
+		apierrors.IsConflict(err) ||
+		apierrors.IsInternalError(err) ||
+		apierrors.IsServiceUnavailable(err) ||
+		utilnet.IsConnectionReset(err) ||
+		utilnet.IsConnectionRefused(err) ||
+		utilnet.IsProbableEOF(err)
+}
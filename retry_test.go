@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// fakeBackoffLoop returns a loop on a fake clock that records the delays it
+// sleeps for, advancing the clock by each of them at once.
+func fakeBackoffLoop(backoff wait.Backoff) (*backoffLoop, *time.Time, *[]time.Duration) {
+	now := time.Unix(0, 0)
+	var delays []time.Duration
+	loop := &backoffLoop{
+		backoff: backoff,
+		now:     func() time.Time { return now },
+		sleep: func(ctx context.Context, delay time.Duration) bool {
+			if ctx.Err() != nil {
+				return false
+			}
+			delays = append(delays, delay)
+			now = now.Add(delay)
+			return true
+		},
+	}
+	return loop, &now, &delays
+}
+
+func TestBackoffLoop(t *testing.T) {
+	backoff := wait.Backoff{Steps: 10, Duration: time.Second, Factor: 2, Jitter: 0.5, Cap: 10 * time.Second}
+
+	// Each run lasts as long as given, the loop stops after the last one. A
+	// run longer than the cap resets the backoff.
+	runs := []time.Duration{0, 0, 0, 0, 0, 0, time.Minute, 0, 0}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second, time.Second, 2 * time.Second}
+
+	loop, now, delays := fakeBackoffLoop(backoff)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	calls := 0
+	loop.run(ctx, func(context.Context) {
+		*now = now.Add(runs[calls])
+		calls++
+		if calls == len(runs) {
+			cancel()
+		}
+	})
+
+	if calls != len(runs) {
+		t.Fatalf("ran %d times, want %d", calls, len(runs))
+	}
+	if len(*delays) != len(want) {
+		t.Fatalf("slept %d times, want %d", len(*delays), len(want))
+	}
+	jittered := false
+	for i, delay := range *delays {
+		maximum := time.Duration(float64(want[i]) * (1 + backoff.Jitter))
+		if delay < want[i] || delay > maximum {
+			t.Errorf("delay %d = %s, want between %s and %s", i, delay, want[i], maximum)
+		}
+		jittered = jittered || delay != want[i]
+	}
+	if !jittered {
+		t.Error("no delay was jittered")
+	}
+}
+
+func TestBackoffLoopStopsWithContext(t *testing.T) {
+	loop, _, _ := fakeBackoffLoop(reconnectBackoff)
+	loop.sleep = func(context.Context, time.Duration) bool { return false }
+
+	calls := 0
+	loop.run(context.Background(), func(context.Context) { calls++ })
+	if calls != 1 {
+		t.Errorf("ran %d times after the sleep was cut short, want 1", calls)
+	}
+}
+
+func TestSleepContext(t *testing.T) {
+	if !sleepContext(context.Background(), time.Millisecond) {
+		t.Error("sleepContext() = false without a cancelled context")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if sleepContext(ctx, time.Hour) {
+		t.Error("sleepContext() = true with a cancelled context")
+	}
+}
+
+// fastAPIBackoff shortens the retry delays for the duration of the test.
+func fastAPIBackoff(t *testing.T) {
+	previous := apiBackoff
+	apiBackoff.Duration = time.Millisecond
+	t.Cleanup(func() { apiBackoff = previous })
+}
+
+func TestRetryTransient(t *testing.T) {
+	tests := []struct {
+		name  string
+		err   error
+		calls int
+	}{
+		{"success", nil, 1},
+		{"not found is not retried", apierrors.NewNotFound(schema.GroupResource{Resource: "pods"}, "pod"), 1},
+		{"other errors are not retried", errors.New("invalid"), 1},
+		{"transient errors are retried", apierrors.NewServiceUnavailable("unavailable"), apiBackoff.Steps},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fastAPIBackoff(t)
+			calls := 0
+			err := retryTransient(context.Background(), func() error {
+				calls++
+				return tt.err
+			})
+			if !errors.Is(err, tt.err) && err != tt.err {
+				t.Errorf("retryTransient() error = %v, want %v", err, tt.err)
+			}
+			if calls != tt.calls {
+				t.Errorf("called %d times, want %d", calls, tt.calls)
+			}
+		})
+	}
+}
+
+// failFirst answers the first failures requests for resource with a
+// ServiceUnavailable error and passes all others to handler. calls counts the
+// requests for resource.
+func failFirst(resource string, failures int, calls *atomic.Int32, handler http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.Path, "/"+resource) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		if int(calls.Add(1)) > failures {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		status := apierrors.NewServiceUnavailable("etcd leader changed").ErrStatus
+		status.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Status"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(&status)
+	}
+}
+
+func TestRetryTransientAPICalls(t *testing.T) {
+	tests := []struct {
+		name     string
+		resource string
+		failures int
+		allowed  bool
+		message  string
+	}{
+		{"config lookup fails twice", "configmaps", 2, true, ""},
+		{"pod list fails twice", "pods", 2, true, ""},
+		{"pod list keeps failing", "pods", 10, false, "could not list pods"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fastAPIBackoff(t)
+			configMap, pods := serveConfigMap(map[string]string{"limitCPU": "2", "limitMemory": "2Gi"}), servePods()
+			var calls atomic.Int32
+			ctrl := newAPIServerController(t, failFirst(tt.resource, tt.failures, &calls, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.Contains(r.URL.Path, "/configmaps") {
+					configMap(w, r)
+					return
+				}
+				pods(w, r)
+			})))
+
+			resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("new", "tenant-a", "1", "1Gi"), nil))
+			checkResponse(t, resp, tt.allowed, tt.message)
+			if want := min(tt.failures+1, apiBackoff.Steps); int(calls.Load()) != want {
+				t.Errorf("called the API %d times, want %d", calls.Load(), want)
+			}
+		})
+	}
+}
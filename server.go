@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultListenAddr = ":8443"
+	defaultCertFile   = "/etc/webhook/certs/tls.crt"
+	defaultKeyFile    = "/etc/webhook/certs/tls.key"
+)
+
+// ServerConfig holds the settings of the HTTPS server, read from the
+// environment.
+type ServerConfig struct {
+	ListenAddr string
+	CertFile   string
+	KeyFile    string
+
+	// MinVersion is the lowest TLS version accepted. CipherSuites, if set,
+	// restricts the TLS 1.2 cipher suites; TLS 1.3 suites are not
+	// configurable.
+	MinVersion   uint16
+	CipherSuites []uint16
+
+	// ClientCAFile, if set, enables mutual TLS: clients must present a
+	// certificate signed by one of the CAs in the file.
+	ClientCAFile string
+}
+
+func loadServerConfig() (ServerConfig, error) {
+	config := ServerConfig{
+		ListenAddr: getEnv("LISTEN_ADDR", defaultListenAddr),
+		CertFile:   getEnv("TLS_CERT_FILE", defaultCertFile),
+		KeyFile:    getEnv("TLS_KEY_FILE", defaultKeyFile),
+		MinVersion: tls.VersionTLS12,
+
+		ClientCAFile: os.Getenv("TLS_CLIENT_CA_FILE"),
+	}
+
+	if value := os.Getenv("TLS_MIN_VERSION"); value != "" {
+		switch value {
+		case "1.2":
+			config.MinVersion = tls.VersionTLS12
+		case "1.3":
+			config.MinVersion = tls.VersionTLS13
+		default:
+			return ServerConfig{}, fmt.Errorf("invalid TLS_MIN_VERSION %q, must be 1.2 or 1.3", value)
+		}
+	}
+
+	if value := os.Getenv("TLS_CIPHER_SUITES"); value != "" {
+		suites, err := parseCipherSuites(value)
+		if err != nil {
+			return ServerConfig{}, err
+		}
+		config.CipherSuites = suites
+	}
+
+	return config, nil
+}
+
+// parseCipherSuites parses a comma-separated list of cipher suite names as
+// listed by tls.CipherSuites. Suites Go considers insecure are not accepted.
+func parseCipherSuites(value string) ([]uint16, error) {
+	known := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	var suites []uint16
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q in TLS_CIPHER_SUITES", name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// tlsConfig returns the server's TLS settings, serving the certificate
+// returned by getCertificate.
+func (c ServerConfig) tlsConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) (*tls.Config, error) {
+	config := &tls.Config{
+		GetCertificate: getCertificate,
+		MinVersion:     c.MinVersion,
+		CipherSuites:   c.CipherSuites,
+	}
+	if c.ClientCAFile == "" {
+		return config, nil
+	}
+
+	bundle, err := os.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", c.ClientCAFile)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
+
+// getEnv returns the value of the environment variable key, or fallback if it
+// is unset or empty.
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// maxRequestBodyBytes caps the size of an admission request body. The default
+// leaves room for a review carrying both the old and the new copy of an object
+// at the API server's object size limit. It can be overridden with
+// MAX_REQUEST_BODY_BYTES.
+var maxRequestBodyBytes int64 = 4 << 20
+
+// shutdownTimeout bounds how long in-flight admission requests may take to
+// finish once a termination signal is received.
+const shutdownTimeout = 10 * time.Second
+
+// serve runs the server until ctx is cancelled and then shuts it down
+// gracefully, waiting up to timeout for in-flight requests to drain. The
+// server's TLSConfig must provide the certificate.
+func serve(ctx context.Context, server *http.Server, timeout time.Duration) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.ListenAndServeTLS("", "")
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("could not shut down server gracefully: %v", err)
+	}
+	if err := <-errCh; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	slog.Info("Server stopped")
+	return nil
+}
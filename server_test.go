@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate for commonName and its
+// key to dir and returns the file paths.
+func writeTestCertificate(t *testing.T, dir, commonName string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "tls.crt")
+	keyFile := filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// testServer returns a TLS server on a free local port serving handler.
+func testServer(t *testing.T, handler http.Handler) *http.Server {
+	t.Helper()
+	certFile, keyFile := writeTestCertificate(t, t.TempDir(), "webhook")
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	return &http.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+}
+
+func testClient() *http.Client {
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+}
+
+// waitForServer polls the server until it accepts connections.
+func waitForServer(t *testing.T, addr string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server at %s did not come up", addr)
+}
+
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- serve(ctx, server, 5*time.Second) }()
+	waitForServer(t, server.Addr)
+
+	respErr := make(chan error, 1)
+	var status int
+	go func() {
+		resp, err := testClient().Get("https://" + server.Addr + "/")
+		if err == nil {
+			status = resp.StatusCode
+			resp.Body.Close()
+		}
+		respErr <- err
+	}()
+
+	<-started
+	cancel()
+	select {
+	case err := <-serveErr:
+		t.Fatalf("serve returned %v before the in-flight request finished", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-respErr; err != nil {
+		t.Fatalf("in-flight request failed: %v", err)
+	}
+	if status != http.StatusOK {
+		t.Errorf("status = %d, want %d", status, http.StatusOK)
+	}
+	if err := <-serveErr; err != nil {
+		t.Errorf("serve returned %v, want nil", err)
+	}
+
+	if _, err := testClient().Get("https://" + server.Addr + "/"); err == nil {
+		t.Error("server still accepts requests after shutdown")
+	}
+}
+
+func TestServeShutdownTimeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	server := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- serve(ctx, server, 50*time.Millisecond) }()
+	waitForServer(t, server.Addr)
+
+	go testClient().Get("https://" + server.Addr + "/")
+	<-started
+	cancel()
+
+	select {
+	case err := <-serveErr:
+		if err == nil {
+			t.Error("serve returned nil, want a shutdown timeout error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not give up after the shutdown timeout")
+	}
+}
+
+func TestServeListenError(t *testing.T) {
+	server := &http.Server{Addr: "127.0.0.1:-1", TLSConfig: &tls.Config{}}
+	if err := serve(context.Background(), server, time.Second); err == nil {
+		t.Error("serve returned nil for an invalid address")
+	}
+}
+
+func TestLoadServerConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    ServerConfig
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			want: ServerConfig{ListenAddr: defaultListenAddr, CertFile: defaultCertFile, KeyFile: defaultKeyFile, MinVersion: tls.VersionTLS12},
+		},
+		{
+			name: "overridden",
+			env:  map[string]string{"LISTEN_ADDR": ":9443", "TLS_CERT_FILE": "/certs/cert.pem", "TLS_KEY_FILE": "/certs/key.pem"},
+			want: ServerConfig{ListenAddr: ":9443", CertFile: "/certs/cert.pem", KeyFile: "/certs/key.pem", MinVersion: tls.VersionTLS12},
+		},
+		{
+			name: "empty values fall back to the defaults",
+			env:  map[string]string{"LISTEN_ADDR": "", "TLS_CERT_FILE": ""},
+			want: ServerConfig{ListenAddr: defaultListenAddr, CertFile: defaultCertFile, KeyFile: defaultKeyFile, MinVersion: tls.VersionTLS12},
+		},
+		{
+			name: "TLS 1.3 and a client CA",
+			env:  map[string]string{"TLS_MIN_VERSION": "1.3", "TLS_CLIENT_CA_FILE": "/certs/ca.pem"},
+			want: ServerConfig{ListenAddr: defaultListenAddr, CertFile: defaultCertFile, KeyFile: defaultKeyFile, MinVersion: tls.VersionTLS13, ClientCAFile: "/certs/ca.pem"},
+		},
+		{
+			name: "cipher suites",
+			env:  map[string]string{"TLS_CIPHER_SUITES": "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+			want: ServerConfig{
+				ListenAddr: defaultListenAddr, CertFile: defaultCertFile, KeyFile: defaultKeyFile, MinVersion: tls.VersionTLS12,
+				CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+			},
+		},
+		{name: "invalid TLS version", env: map[string]string{"TLS_MIN_VERSION": "1.1"}, wantErr: true},
+		{name: "insecure cipher suite", env: map[string]string{"TLS_CIPHER_SUITES": "TLS_RSA_WITH_RC4_128_SHA"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"LISTEN_ADDR", "TLS_CERT_FILE", "TLS_KEY_FILE", "TLS_MIN_VERSION", "TLS_CIPHER_SUITES", "TLS_CLIENT_CA_FILE"} {
+				t.Setenv(key, tt.env[key])
+			}
+
+			got, err := loadServerConfig()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("loadServerConfig() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadServerConfig() error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadServerConfig() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// startServer serves server until the end of the test.
+func startServer(t *testing.T, server *http.Server) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- serve(ctx, server, time.Second) }()
+	t.Cleanup(func() {
+		cancel()
+		<-serveErr
+	})
+	waitForServer(t, server.Addr)
+}
+
+func TestTLSConfig(t *testing.T) {
+	suites := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+	tests := []struct {
+		name   string
+		config ServerConfig
+	}{
+		{"TLS 1.2", ServerConfig{MinVersion: tls.VersionTLS12}},
+		{"TLS 1.3", ServerConfig{MinVersion: tls.VersionTLS13}},
+		{"restricted cipher suites", ServerConfig{MinVersion: tls.VersionTLS12, CipherSuites: suites}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := tt.config.tlsConfig(nil)
+			if err != nil {
+				t.Fatalf("tlsConfig() error: %v", err)
+			}
+			if config.MinVersion != tt.config.MinVersion {
+				t.Errorf("MinVersion = %x, want %x", config.MinVersion, tt.config.MinVersion)
+			}
+			if !reflect.DeepEqual(config.CipherSuites, tt.config.CipherSuites) {
+				t.Errorf("CipherSuites = %v, want %v", config.CipherSuites, tt.config.CipherSuites)
+			}
+			if config.ClientAuth != tls.NoClientCert {
+				t.Errorf("ClientAuth = %v, want no client certificates without a CA", config.ClientAuth)
+			}
+		})
+	}
+}
+
+func TestTLSMinVersionEnforced(t *testing.T) {
+	server := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	config, err := ServerConfig{MinVersion: tls.VersionTLS13}.tlsConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Certificates = server.TLSConfig.Certificates
+	server.TLSConfig = config
+	startServer(t, server)
+
+	tests := []struct {
+		name       string
+		maxVersion uint16
+		wantErr    bool
+	}{
+		{"TLS 1.2 client", tls.VersionTLS12, true},
+		{"TLS 1.3 client", tls.VersionTLS13, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := tls.Dial("tcp", server.Addr, &tls.Config{InsecureSkipVerify: true, MaxVersion: tt.maxVersion})
+			if err == nil {
+				conn.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("handshake error = %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	server := testServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	caFile, caKeyFile := writeTestCertificate(t, t.TempDir(), "api-server")
+	otherFile, otherKeyFile := writeTestCertificate(t, t.TempDir(), "intruder")
+
+	// The API server's self-signed certificate is its own CA.
+	config, err := ServerConfig{MinVersion: tls.VersionTLS12, ClientCAFile: caFile}.tlsConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ClientAuth != tls.RequireAndVerifyClientCert || config.ClientCAs == nil {
+		t.Fatalf("ClientAuth = %v, want client certificates required", config.ClientAuth)
+	}
+	config.Certificates = server.TLSConfig.Certificates
+	server.TLSConfig = config
+	startServer(t, server)
+
+	loadPair := func(certFile, keyFile string) []tls.Certificate {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []tls.Certificate{cert}
+	}
+	tests := []struct {
+		name    string
+		certs   []tls.Certificate
+		wantErr bool
+	}{
+		{"valid client certificate", loadPair(caFile, caKeyFile), false},
+		{"no client certificate", nil, true},
+		{"certificate of another CA", loadPair(otherFile, otherKeyFile), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: tt.certs}}}
+			resp, err := client.Get("https://" + server.Addr + "/")
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("request error = %v, want an error: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMutualTLSInvalidCA(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(empty, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range []string{empty, filepath.Join(dir, "missing.pem")} {
+		if _, err := (ServerConfig{ClientCAFile: file}).tlsConfig(nil); err == nil {
+			t.Errorf("tlsConfig() accepted the client CA file %s", filepath.Base(file))
+		}
+	}
+}
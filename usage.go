@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+type usageResponse struct {
+	Namespace string       `json:"namespace"`
+	Tenant    string       `json:"tenant"`
+	Team      string       `json:"team,omitempty"`
+	Usage     usageSummary `json:"usage"`
+	Quota     quotaSummary `json:"quota"`
+}
+
+type usageSummary struct {
+	Limits   corev1.ResourceList `json:"limits"`
+	Requests corev1.ResourceList `json:"requests"`
+	Pods     int                 `json:"pods"`
+}
+
+type quotaSummary struct {
+	Scope    string              `json:"scope"`
+	Limits   corev1.ResourceList `json:"limits"`
+	Requests corev1.ResourceList `json:"requests"`
+	MaxPods  int                 `json:"maxPods,omitempty"`
+}
+
+// handleUsage reports the current usage of a tenant in a namespace next to its
+// quota, as the webhook would compute it for the next pod.
+func (ctrl *Controller) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	namespace := r.URL.Query().Get("namespace")
+	tenant := r.URL.Query().Get("tenant")
+	if namespace == "" || tenant == "" {
+		http.Error(w, "namespace and tenant query parameters are required", http.StatusBadRequest)
+		return
+	}
+	if errs := validation.IsValidLabelValue(tenant); len(errs) > 0 {
+		http.Error(w, fmt.Sprintf("invalid tenant %q: %s", tenant, strings.Join(errs, "; ")), http.StatusBadRequest)
+		return
+	}
+	team := r.URL.Query().Get("team")
+	if errs := validation.IsValidLabelValue(team); len(errs) > 0 {
+		http.Error(w, fmt.Sprintf("invalid team %q: %s", team, strings.Join(errs, "; ")), http.StatusBadRequest)
+		return
+	}
+
+	config, err := ctrl.loadConfig(r.Context())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not load config: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	config, err = config.forTenant(tenant).forTeam(tenant, team).withNamespaceQuota(r.Context(), ctrl, namespace)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not get namespace quota: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	config, err = config.withResourceQuota(r.Context(), ctrl, namespace)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not get ResourceQuota: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	config, err = config.withNodeAllocatable(r.Context(), ctrl)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not get node allocatable: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+
+	quota, err := parseQuota(config)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid quota in config: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	usage, err := ctrl.calculateResourceUsage(r.Context(), namespace, tenant, team, config, nil)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not list pods: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+
+	respBytes, err := json.Marshal(usageResponse{
+		Namespace: namespace,
+		Tenant:    tenant,
+		Team:      team,
+		Usage:     usageSummary{Limits: usage.Limits, Requests: usage.Requests, Pods: usage.Pods},
+		Quota:     quotaSummary{Scope: quota.Scope, Limits: quota.Limits, Requests: quota.Requests, MaxPods: config.MaxPods},
+	})
+	if err != nil {
+		http.Error(w, "could not marshal response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(respBytes)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleUsage(t *testing.T) {
+	ctrl := newTestController(map[string]string{"limitCPU": "4", "limitMemory": "8Gi", "requestCPU": "2", "maxPods": "10"}, testPod("web", "tenant-a", "1", "1Gi"), testPod("worker", "tenant-a", "500m", "512Mi"), testPod("other", "tenant-b", "2", "2Gi"))
+
+	recorder := httptest.NewRecorder()
+	ctrl.handleUsage(recorder, httptest.NewRequest(http.MethodGet, "/usage?namespace=tenant-a-ns&tenant=tenant-a", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d (%s)", recorder.Code, http.StatusOK, recorder.Body.String())
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", contentType)
+	}
+
+	var got usageResponse
+	if err := json.Unmarshal(recorder.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if got.Namespace != testNamespace || got.Tenant != "tenant-a" {
+		t.Errorf("response is for %s/%s, want tenant-a-ns/tenant-a", got.Namespace, got.Tenant)
+	}
+	checkResources(t, got.Usage.Limits, "1500m", "1536Mi")
+	checkResources(t, got.Usage.Requests, "1500m", "1536Mi")
+	if got.Usage.Pods != 2 {
+		t.Errorf("pods = %d, want 2", got.Usage.Pods)
+	}
+	checkResources(t, got.Quota.Limits, "4", "8Gi")
+	if cpu := got.Quota.Requests.Cpu(); cpu.String() != "2" || len(got.Quota.Requests) != 1 {
+		t.Errorf("request quota = %v, want cpu 2 only", resourceListStrings(got.Quota.Requests))
+	}
+	if got.Quota.Scope != quotaScopeLimits || got.Quota.MaxPods != 10 {
+		t.Errorf("quota has scope %q and maxPods %d, want Limits and 10", got.Quota.Scope, got.Quota.MaxPods)
+	}
+}
+
+func TestHandleUsageInvalidRequests(t *testing.T) {
+	ctrl := newTestController(map[string]string{"limitCPU": "4", "limitMemory": "8Gi"})
+	tests := []struct {
+		name   string
+		method string
+		target string
+		status int
+	}{
+		{"post", http.MethodPost, "/usage?namespace=ns&tenant=tenant-a", http.StatusMethodNotAllowed},
+		{"missing namespace", http.MethodGet, "/usage?tenant=tenant-a", http.StatusBadRequest},
+		{"missing tenant", http.MethodGet, "/usage?namespace=ns", http.StatusBadRequest},
+		{"invalid tenant", http.MethodGet, "/usage?namespace=ns&tenant=not%20a%20label", http.StatusBadRequest},
+		{"invalid team", http.MethodGet, "/usage?namespace=ns&tenant=tenant-a&team=-bad-", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			ctrl.handleUsage(recorder, httptest.NewRequest(tt.method, tt.target, nil))
+			if recorder.Code != tt.status {
+				t.Errorf("status = %d, want %d", recorder.Code, tt.status)
+			}
+		})
+	}
+}
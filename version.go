@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// version and gitCommit identify the build. They are set at build time, e.g.
+// go build -ldflags "-X main.version=v1.2.0 -X main.gitCommit=$(git rev-parse HEAD)".
+var (
+	version   = "dev"
+	gitCommit = "unknown"
+)
+
+var buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "build_info",
+	Help: "Always 1, labeled by the version, git commit and Go version of the running build.",
+}, []string{"version", "commit", "go_version"})
+
+func init() {
+	prometheus.MustRegister(buildInfo)
+	buildInfo.WithLabelValues(version, gitCommit, runtime.Version()).Set(1)
+}
+
+type versionResponse struct {
+	Version   string `json:"version"`
+	GitCommit string `json:"gitCommit"`
+	GoVersion string `json:"goVersion"`
+}
+
+// handleVersion reports which build is serving.
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	respBytes, err := json.Marshal(versionResponse{Version: version, GitCommit: gitCommit, GoVersion: runtime.Version()})
+	if err != nil {
+		http.Error(w, "could not marshal response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(respBytes)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHandleVersion(t *testing.T) {
+	previousVersion, previousCommit := version, gitCommit
+	version, gitCommit = "v1.2.0", "0123abc"
+	t.Cleanup(func() { version, gitCommit = previousVersion, previousCommit })
+
+	recorder := httptest.NewRecorder()
+	handleVersion(recorder, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", recorder.Code, http.StatusOK)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", contentType)
+	}
+
+	var fields map[string]string
+	if err := json.Unmarshal(recorder.Body.Bytes(), &fields); err != nil {
+		t.Fatalf("response is not a JSON object: %v", err)
+	}
+	want := map[string]string{"version": "v1.2.0", "gitCommit": "0123abc", "goVersion": runtime.Version()}
+	for key, value := range want {
+		if fields[key] != value {
+			t.Errorf("%s = %q, want %q", key, fields[key], value)
+		}
+	}
+}
+
+func TestBuildInfo(t *testing.T) {
+	if got := testutil.CollectAndCount(buildInfo); got != 1 {
+		t.Fatalf("build_info has %d series, want 1", got)
+	}
+	if got := testutil.ToFloat64(buildInfo.WithLabelValues(version, gitCommit, runtime.Version())); got != 1 {
+		t.Errorf("build_info = %v, want 1 for the running build", got)
+	}
+}
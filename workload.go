@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// admissionTarget is the pod under review. For a workload it is built from the
+// pod template and stands for as many pods as the workload has replicas.
+type admissionTarget struct {
+	pod      *corev1.Pod
+	replicas int
+	ref      corev1.ObjectReference
+}
+
+var (
+	podsResource         = corev1.SchemeGroupVersion.WithResource("pods")
+	deploymentsResource  = appsv1.SchemeGroupVersion.WithResource("deployments")
+	statefulSetsResource = appsv1.SchemeGroupVersion.WithResource("statefulsets")
+)
+
+// reviewedResource reports whether the webhook decides on the given resource.
+// The group and version are compared too, so that a resource of the same
+// name in another API group is passed through.
+func reviewedResource(resource metav1.GroupVersionResource) bool {
+	gvr := schema.GroupVersionResource(resource)
+	return gvr == podsResource || gvr == deploymentsResource || gvr == statefulSetsResource
+}
+
+// specSubresources are the pod subresources whose requests change what the pod
+// requests: ephemeral containers are added through one and resources are
+// resized in place through the other. Their object is the whole pod.
+var specSubresources = map[string]bool{"ephemeralcontainers": true, "resize": true}
+
+// reviewedSubresource reports whether requests for the subresource are
+// decided on. Other subresources, such as pods/status, pods/exec, pods/binding
+// or deployments/scale, carry no pod spec and are passed through.
+func reviewedSubresource(resource metav1.GroupVersionResource, subResource string) bool {
+	return subResource == "" || (schema.GroupVersionResource(resource) == podsResource && specSubresources[subResource])
+}
+
+// decodeTarget decodes the object of a pods, deployments or statefulsets
+// request into the pod that is charged against the quota.
+func decodeTarget(resource string, raw []byte) (admissionTarget, error) {
+	switch resource {
+	case "deployments":
+		var deployment appsv1.Deployment
+		if err := json.Unmarshal(raw, &deployment); err != nil {
+			return admissionTarget{}, fmt.Errorf("could not unmarshal deployment object")
+		}
+		return workloadTarget("Deployment", deployment.ObjectMeta, deployment.Spec.Replicas, deployment.Spec.Template), nil
+	case "statefulsets":
+		var statefulSet appsv1.StatefulSet
+		if err := json.Unmarshal(raw, &statefulSet); err != nil {
+			return admissionTarget{}, fmt.Errorf("could not unmarshal statefulset object")
+		}
+		return workloadTarget("StatefulSet", statefulSet.ObjectMeta, statefulSet.Spec.Replicas, statefulSet.Spec.Template), nil
+	}
+
+	var pod corev1.Pod
+	if err := json.Unmarshal(raw, &pod); err != nil {
+		return admissionTarget{}, fmt.Errorf("could not unmarshal pod object")
+	}
+	// Pods created from a generateName have no name yet and are referenced by
+	// the prefix instead.
+	name := pod.Name
+	if name == "" {
+		name = strings.TrimSuffix(pod.GenerateName, "-")
+	}
+	return admissionTarget{
+		pod:      &pod,
+		replicas: 1,
+		ref:      corev1.ObjectReference{APIVersion: "v1", Kind: "Pod", Name: name},
+	}, nil
+}
+
+// workloadTarget builds the pod a workload's template produces. The template's
+// labels and annotations are laid over the workload's own, so the tenant label
+// may be set on either. Replicas default to one, as they do in the API server.
+func workloadTarget(kind string, meta metav1.ObjectMeta, replicas *int32, template corev1.PodTemplateSpec) admissionTarget {
+	labels := mergeMaps(meta.Labels, template.Labels)
+	annotations := mergeMaps(meta.Annotations, template.Annotations)
+
+	count := 1
+	if replicas != nil {
+		count = int(*replicas)
+	}
+
+	return admissionTarget{
+		pod: &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Labels: labels, Annotations: annotations},
+			Spec:       template.Spec,
+		},
+		replicas: count,
+		ref:      corev1.ObjectReference{APIVersion: "apps/v1", Kind: kind, Name: meta.Name},
+	}
+}
+
+// mergeMaps returns a copy of base with the entries of overlay laid over it.
+func mergeMaps(base, overlay map[string]string) map[string]string {
+	merged := map[string]string{}
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range overlay {
+		merged[key] = value
+	}
+	return merged
+}
+
+// usage returns what the target adds to the tenant's usage once all of its
+// pods are running.
+func (t admissionTarget) usage(config Config) Usage {
+	return podUsage(t.pod, config).times(t.replicas)
+}
+
+// workload reports whether the target stands for the pods of a workload rather
+// than a single pod.
+func (t admissionTarget) workload() bool {
+	return t.ref.Kind != "Pod"
+}
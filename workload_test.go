@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// testDeployment returns a Deployment of the tenant whose pods are testPods
+// with the given resources.
+func testDeployment(name, tenant string, replicas int32, cpu, memory string) *appsv1.Deployment {
+	pod := testPod("", tenant, cpu, memory)
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: &replicas,
+			Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: pod.Labels}, Spec: pod.Spec},
+		},
+	}
+}
+
+// runningPods returns count running pods of the tenant, as a workload's
+// replicas would be.
+func runningPods(tenant string, count int, cpu, memory string) []runtime.Object {
+	var pods []runtime.Object
+	for i := 0; i < count; i++ {
+		pods = append(pods, testPod(fmt.Sprintf("%s-%d", tenant, i), tenant, cpu, memory))
+	}
+	return pods
+}
+
+func TestReviewWorkloadMaxPods(t *testing.T) {
+	data := map[string]string{"limitCPU": "10", "limitMemory": "10Gi", "maxPods": "3"}
+	deploymentReview := func(t *testing.T, operation admissionv1.Operation, deployment, old *appsv1.Deployment) admissionv1.AdmissionReview {
+		if old == nil {
+			return admissionReview(t, metav1.GroupVersionResource(deploymentsResource), operation, deployment, nil)
+		}
+		return admissionReview(t, metav1.GroupVersionResource(deploymentsResource), operation, deployment, old)
+	}
+
+	tests := []struct {
+		name    string
+		running int
+		ar      func(t *testing.T) admissionv1.AdmissionReview
+		allowed bool
+		message string
+	}{
+		{"create within maxPods", 0, func(t *testing.T) admissionv1.AdmissionReview {
+			return deploymentReview(t, admissionv1.Create, testDeployment("web", "tenant-a", 3, "100m", "64Mi"), nil)
+		}, true, ""},
+		{"create over maxPods", 1, func(t *testing.T) admissionv1.AdmissionReview {
+			return deploymentReview(t, admissionv1.Create, testDeployment("web", "tenant-a", 3, "100m", "64Mi"), nil)
+		}, false, "pod limit exceeded"},
+		{"scale up within maxPods", 1, func(t *testing.T) admissionv1.AdmissionReview {
+			return deploymentReview(t, admissionv1.Update, testDeployment("web", "tenant-a", 3, "100m", "64Mi"), testDeployment("web", "tenant-a", 1, "100m", "64Mi"))
+		}, true, ""},
+		{"scale up over maxPods", 1, func(t *testing.T) admissionv1.AdmissionReview {
+			return deploymentReview(t, admissionv1.Update, testDeployment("web", "tenant-a", 50, "100m", "64Mi"), testDeployment("web", "tenant-a", 1, "100m", "64Mi"))
+		}, false, "pod limit exceeded"},
+		{"scale down while over maxPods", 5, func(t *testing.T) admissionv1.AdmissionReview {
+			return deploymentReview(t, admissionv1.Update, testDeployment("web", "tenant-a", 4, "100m", "64Mi"), testDeployment("web", "tenant-a", 5, "100m", "64Mi"))
+		}, true, ""},
+		{"pod update at maxPods", 3, func(t *testing.T) admissionv1.AdmissionReview {
+			return podReview(t, admissionv1.Update, testPod("tenant-a-0", "tenant-a", "200m", "64Mi"), testPod("tenant-a-0", "tenant-a", "100m", "64Mi"))
+		}, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newTestController(data, runningPods("tenant-a", tt.running, "100m", "64Mi")...)
+			resp := ctrl.processAdmissionReview(context.Background(), tt.ar(t))
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestReviewedResource(t *testing.T) {
+	tests := []struct {
+		resource metav1.GroupVersionResource
+		want     bool
+	}{
+		{metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}, true},
+		{metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}, true},
+		{metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "statefulsets"}, true},
+		{metav1.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "pods"}, false},
+		{metav1.GroupVersionResource{Group: "metrics.k8s.io", Version: "v1beta1", Resource: "pods"}, false},
+		{metav1.GroupVersionResource{Group: "", Version: "v2", Resource: "pods"}, false},
+		{metav1.GroupVersionResource{Group: "example.com", Version: "v1", Resource: "deployments"}, false},
+		{metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "daemonsets"}, false},
+	}
+	for _, tt := range tests {
+		if got := reviewedResource(tt.resource); got != tt.want {
+			t.Errorf("reviewedResource(%v) = %v, want %v", tt.resource, got, tt.want)
+		}
+	}
+}
+
+func TestNonCorePodsPassThrough(t *testing.T) {
+	data := map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "missingResourcesMode": "Inject", "defaultLimits": `{"cpu": "500m", "memory": "256Mi"}`}
+	ctrl := newTestController(data, testPod("running", "tenant-a", "1", "1Gi"))
+	pod := testPod("new", "tenant-a", "8", "8Gi")
+	unlimited := testPod("bare", "tenant-a", "1", "1Gi")
+	unlimited.Spec.Containers[0].Resources = corev1.ResourceRequirements{}
+
+	for _, group := range []string{"example.com", "metrics.k8s.io"} {
+		t.Run(group, func(t *testing.T) {
+			resource := metav1.GroupVersionResource{Group: group, Version: "v1", Resource: "pods"}
+			resp := ctrl.processAdmissionReview(context.Background(), admissionReview(t, resource, admissionv1.Create, pod, nil))
+			if !resp.Allowed || resp.Result != nil || resp.Warnings != nil || resp.AuditAnnotations != nil {
+				t.Errorf("response = %+v, want the request passed through untouched", resp)
+			}
+
+			resp = ctrl.processMutation(context.Background(), admissionReview(t, resource, admissionv1.Create, unlimited, nil))
+			if !resp.Allowed || resp.Patch != nil {
+				t.Errorf("mutation = %+v, want no patch", resp)
+			}
+		})
+	}
+
+	// The same pod as a core pod is defaulted and the others were not charged
+	// to the tenant.
+	if resp := ctrl.processMutation(context.Background(), podReview(t, admissionv1.Create, unlimited, nil)); resp.Patch == nil {
+		t.Errorf("mutation of the core pod = %+v, want a patch", resp)
+	}
+	resp := ctrl.processAdmissionReview(context.Background(), podReview(t, admissionv1.Create, testPod("core", "tenant-a", "1", "1Gi"), nil))
+	checkResponse(t, resp, true, "")
+}
+
+func TestReviewSubresources(t *testing.T) {
+	data := map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "countEphemeralContainers": "true"}
+	old := testPod("tenant-a-0", "tenant-a", "1", "1Gi")
+	resized := testPod("tenant-a-0", "tenant-a", "3", "1Gi")
+	debugged := old.DeepCopy()
+	debugged.Spec.EphemeralContainers = []corev1.EphemeralContainer{{
+		EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debug", Resources: resized.Spec.Containers[0].Resources},
+	}}
+
+	tests := []struct {
+		subResource string
+		pod         *corev1.Pod
+		allowed     bool
+		message     string
+	}{
+		{"resize", resized, false, "CPU limit exceeded"},
+		{"ephemeralcontainers", debugged, false, "CPU limit exceeded"},
+		{"status", resized, true, ""},
+		{"binding", resized, true, ""},
+		{"eviction", resized, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.subResource, func(t *testing.T) {
+			ctrl := newTestController(data, old)
+			ar := podReview(t, admissionv1.Update, tt.pod, old)
+			ar.Request.SubResource = tt.subResource
+			resp := ctrl.processAdmissionReview(context.Background(), ar)
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}
+
+func TestReviewedSubresource(t *testing.T) {
+	pods := metav1.GroupVersionResource(podsResource)
+	deployments := metav1.GroupVersionResource(deploymentsResource)
+	tests := []struct {
+		resource    metav1.GroupVersionResource
+		subResource string
+		want        bool
+	}{
+		{pods, "", true},
+		{pods, "ephemeralcontainers", true},
+		{pods, "resize", true},
+		{pods, "status", false},
+		{pods, "exec", false},
+		{pods, "log", false},
+		{pods, "portforward", false},
+		{pods, "attach", false},
+		{pods, "binding", false},
+		{pods, "eviction", false},
+		{deployments, "", true},
+		{deployments, "scale", false},
+		{deployments, "resize", false},
+	}
+	for _, tt := range tests {
+		if got := reviewedSubresource(tt.resource, tt.subResource); got != tt.want {
+			t.Errorf("reviewedSubresource(%s, %q) = %v, want %v", tt.resource.Resource, tt.subResource, got, tt.want)
+		}
+	}
+}
+
+func TestSubresourcesPassThrough(t *testing.T) {
+	data := map[string]string{"limitCPU": "2", "limitMemory": "2Gi", "missingResourcesMode": "Inject", "defaultLimits": `{"cpu": "500m", "memory": "256Mi"}`}
+	ctrl := newTestController(data, testPod("running", "tenant-a", "1", "1Gi"))
+	// As plain pod requests the first would be denied and the second patched.
+	pod := testPod("running", "tenant-a", "8", "8Gi")
+	unlimited := testPod("running", "tenant-a", "1", "1Gi")
+	unlimited.Spec.Containers[0].Resources = corev1.ResourceRequirements{}
+
+	for _, subResource := range []string{"exec", "attach", "status"} {
+		t.Run(subResource, func(t *testing.T) {
+			ar := podReview(t, admissionv1.Create, pod, nil)
+			ar.Request.SubResource = subResource
+			resp := ctrl.processAdmissionReview(context.Background(), ar)
+			checkResponse(t, resp, true, "")
+
+			ar = podReview(t, admissionv1.Create, unlimited, nil)
+			ar.Request.SubResource = subResource
+			if resp := ctrl.processMutation(context.Background(), ar); !resp.Allowed || resp.Patch != nil {
+				t.Errorf("mutation = %+v, want no patch", resp)
+			}
+		})
+	}
+}
+
+func TestReviewDeployment(t *testing.T) {
+	unlabeled := testDeployment("web", "tenant-a", 4, "500m", "256Mi")
+	unlabeled.Spec.Template.Labels = nil
+
+	tests := []struct {
+		name       string
+		deployment *appsv1.Deployment
+		allowed    bool
+		message    string
+	}{
+		{"template fits for every replica", testDeployment("web", "tenant-a", 3, "500m", "256Mi"), true, ""},
+		{"template exceeds the quota", testDeployment("web", "tenant-a", 4, "500m", "256Mi"), false, "CPU limit exceeded: requested 2 on top of 500m used, limit is 2"},
+		{"single replica by default", func() *appsv1.Deployment {
+			deployment := testDeployment("web", "tenant-a", 0, "1500m", "256Mi")
+			deployment.Spec.Replicas = nil
+			return deployment
+		}(), true, ""},
+		{"deployment without a tenant", unlabeled, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := newAPIServerController(t, servePods(*testPod("running", "tenant-a", "500m", "256Mi")))
+			ctrl.setConfig(Config{LimitCPU: "2", LimitMemory: "2Gi", QuotaScope: quotaScopeLimits, TenantLabelKey: defaultTenantLabelKey, UsagePhases: defaultUsagePhases})
+			raw, err := json.Marshal(tt.deployment)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp := ctrl.processAdmissionReview(context.Background(), admissionv1.AdmissionReview{Request: &admissionv1.AdmissionRequest{
+				UID:       "review-uid",
+				Resource:  metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"},
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Raw: raw},
+			}})
+			checkResponse(t, resp, tt.allowed, tt.message)
+		})
+	}
+}